@@ -2,4 +2,4 @@ export GOROOT=/opt/go
 export GOPATH=/app/owntracks2ha
 export PATH=$PATH:$GOROOT/bin:$GOPATH/bin
 
-cd /app/owntracks2ha/src; go build -o /app/owntracks2ha/bin/owntracks2ha /app/owntracks2ha/src/main.go
\ No newline at end of file
+cd /app/owntracks2ha/src; go build -ldflags "-X main.version=$(git describe --tags --always 2>/dev/null || echo dev)" -o /app/owntracks2ha/bin/owntracks2ha /app/owntracks2ha/src/main.go
\ No newline at end of file
@@ -0,0 +1,586 @@
+// Package converter turns OwnTracks messages into the payloads owntracks2ha
+// publishes for Home Assistant. It has no broker or configuration
+// dependencies, so it can be used on its own.
+package converter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// HAPayload is the location published for the Home Assistant MQTT device
+// tracker.
+type HAPayload struct {
+	GPSAccuracy int     `json:"gps_accuracy"`
+	Altitude    int     `json:"altitude"`
+	Battery     int     `json:"battery_level"`
+	Latitude    float64 `json:"latitude"`
+	Longitude   float64 `json:"longitude"`
+
+	// Attributes holds extra fields merged into the published JSON object.
+	Attributes map[string]interface{} `json:"-"`
+}
+
+// MarshalJSON flattens Attributes into the top-level object. The fixed
+// fields always win over an attribute of the same name.
+func (p HAPayload) MarshalJSON() ([]byte, error) {
+	type plain HAPayload
+	base, err := json.Marshal(plain(p))
+	if err != nil || len(p.Attributes) == 0 {
+		return base, err
+	}
+
+	merged := make(map[string]interface{}, len(p.Attributes)+5)
+	for k, v := range p.Attributes {
+		merged[k] = v
+	}
+	if err := json.Unmarshal(base, &merged); err != nil {
+		return nil, err
+	}
+	return json.Marshal(merged)
+}
+
+// SetAttribute adds an extra field to the payload.
+func (p *HAPayload) SetAttribute(key string, value interface{}) {
+	if p.Attributes == nil {
+		p.Attributes = make(map[string]interface{})
+	}
+	p.Attributes[key] = value
+}
+
+// TransitionEvent is published for every transition. event_type carries
+// enter/leave as expected by the Home Assistant MQTT event entity.
+type TransitionEvent struct {
+	EventType   string  `json:"event_type"`
+	Region      string  `json:"region"`
+	RegionID    string  `json:"region_id,omitempty"`
+	Device      string  `json:"device"`
+	Trigger     string  `json:"trigger,omitempty"`
+	Timestamp   int64   `json:"timestamp"`
+	Time        string  `json:"time,omitempty"`
+	Latitude    float64 `json:"latitude"`
+	Longitude   float64 `json:"longitude"`
+	GPSAccuracy int     `json:"gps_accuracy"`
+}
+
+// RoomPresence is published for a beacon seen by a device, in the shape of
+// the Home Assistant mqtt_room sensor and ESPresense: id is the device and
+// distance its estimated distance to the beacon in meters.
+type RoomPresence struct {
+	ID        string  `json:"id"`
+	Name      string  `json:"name"`
+	Distance  float64 `json:"distance"`
+	RSSI      int     `json:"rssi,omitempty"`
+	UUID      string  `json:"uuid"`
+	Major     int     `json:"major"`
+	Minor     int     `json:"minor"`
+	Timestamp int64   `json:"timestamp,omitempty"`
+}
+
+// Zone is published for every waypoint. Its fields follow the Home Assistant
+// zone configuration so it can be fed to zone.create or a YAML package.
+type Zone struct {
+	Name      string  `json:"name"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Radius    int     `json:"radius"`
+	Passive   bool    `json:"passive"`
+	RegionID  string  `json:"region_id,omitempty"`
+	Device    string  `json:"device"`
+}
+
+// CardState is published for a friend card. The picture is published on its
+// own, as Home Assistant image entities expect.
+type CardState struct {
+	Name   string `json:"name"`
+	TID    string `json:"tid,omitempty"`
+	Device string `json:"device"`
+}
+
+// BatteryState is published to the battery topic of a device.
+type BatteryState struct {
+	BatteryLevel    int   `json:"battery_level"`
+	BatteryCharging *bool `json:"battery_charging,omitempty"`
+}
+
+// DefaultPassthroughFields are the OwnTracks fields copied into the
+// attributes when no other list is given.
+var DefaultPassthroughFields = []string{"vel", "cog", "tst", "tid", "vac", "bs", "conn", "SSID", "BSSID", "t"}
+
+var (
+	// ErrInvalidCoordinates is returned for a location without latitude or
+	// longitude.
+	ErrInvalidCoordinates = errors.New("missing latitude or longitude")
+
+	// ErrNullIsland is returned for a location at latitude and longitude 0,
+	// which phones report when they have no fix. The location is returned
+	// with it, for callers that accept such positions.
+	ErrNullIsland = errors.New("location at latitude 0, longitude 0")
+
+	// ErrNotLocation is returned when a message of another type is passed
+	// to Convert.
+	ErrNotLocation = errors.New("not a location message")
+
+	// ErrInvalidTransition is returned for a transition that is neither an
+	// enter nor a leave event.
+	ErrInvalidTransition = errors.New("unknown transition event")
+
+	// ErrUnknownCommand is returned by BuildCommand for an action the
+	// OwnTracks apps do not know.
+	ErrUnknownCommand = errors.New("unknown command action")
+)
+
+// Convert converts an OwnTracks location message into the Home Assistant
+// payload, passing DefaultPassthroughFields through as attributes.
+func Convert(ownTracksJSON []byte) (HAPayload, error) {
+	location, err := ParseLocation(ownTracksJSON)
+	if err != nil {
+		return HAPayload{}, err
+	}
+	return ConvertLocation(location, ownTracksJSON, Options{}), nil
+}
+
+// MessageType returns the _type of an OwnTracks message, e.g. location,
+// transition, waypoint, waypoints, lwt, card or status.
+func MessageType(data []byte) (string, error) {
+	var envelope struct {
+		Type string `json:"_type"`
+	}
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return "", err
+	}
+	return envelope.Type, nil
+}
+
+// ParseLocation decodes an OwnTracks location message. Errors other than
+// ErrInvalidCoordinates, ErrNullIsland and ErrNotLocation come from the JSON
+// decoder. A latitude or longitude of 0 alone is a valid position on the
+// equator or the prime meridian.
+func ParseLocation(data []byte) (Location, error) {
+	var location Location
+	if err := json.Unmarshal(data, &location); err != nil {
+		return location, err
+	}
+	// Location has plain coordinates, so their presence is checked apart.
+	var coordinates struct {
+		Lat *float64 `json:"lat"`
+		Lon *float64 `json:"lon"`
+	}
+	if err := json.Unmarshal(data, &coordinates); err != nil {
+		return location, err
+	}
+	if location.Type != "" && location.Type != "location" {
+		return location, fmt.Errorf("%w: %s", ErrNotLocation, location.Type)
+	}
+	if coordinates.Lat == nil || coordinates.Lon == nil {
+		return location, ErrInvalidCoordinates
+	}
+	if location.Lat == 0 && location.Lon == 0 {
+		return location, ErrNullIsland
+	}
+	return location, nil
+}
+
+// Options adjust how a location is converted.
+type Options struct {
+	// PassthroughFields are the OwnTracks fields copied verbatim into the
+	// attributes; nil means DefaultPassthroughFields.
+	PassthroughFields []string
+
+	// Units is "metric" (the default) or "imperial", which reports speed in
+	// mph and altitude in feet.
+	Units string
+
+	// CoordinatePrecision rounds latitude and longitude to this many decimal
+	// places (3 is about 100 m); zero keeps them as reported.
+	CoordinatePrecision int
+
+	// PressureUnit is the unit of the pressure attribute: "hPa" (the
+	// default), "kPa", "inHg" or "mmHg".
+	PressureUnit string
+
+	// SeaLevelPressure in hPa is the reference of the barometric altitude;
+	// zero means the standard atmosphere, 1013.25 hPa.
+	SeaLevelPressure float64
+}
+
+const (
+	mphPerKmh    = 0.621371
+	feetPerMeter = 3.28084
+
+	standardPressure = 1013.25 // hPa
+)
+
+// hPaPer are the pressure units of Options.PressureUnit in hPa.
+var hPaPer = map[string]float64{"hPa": 1, "kPa": 10, "inHg": 33.8639, "mmHg": 1.33322}
+
+// ConvertLocation builds the payload for a parsed location. raw is the
+// message it was parsed from.
+func ConvertLocation(location Location, raw []byte, opts Options) HAPayload {
+	imperial := opts.Units == "imperial"
+	payload := HAPayload{
+		GPSAccuracy: location.Acc,
+		Altitude:    location.Alt,
+		Battery:     location.Batt,
+		Latitude:    RoundCoordinate(location.Lat, opts.CoordinatePrecision),
+		Longitude:   RoundCoordinate(location.Lon, opts.CoordinatePrecision),
+		Attributes:  PassthroughAttributes(raw, opts.PassthroughFields),
+	}
+	if imperial {
+		payload.Altitude = int(math.Round(float64(location.Alt) * feetPerMeter))
+	}
+	if opts.CoordinatePrecision > 0 {
+		// Passing "*" through would otherwise forward the exact position.
+		delete(payload.Attributes, "lat")
+		delete(payload.Attributes, "lon")
+	}
+	if charging, known := BatteryCharging(location.BS); known {
+		payload.SetAttribute("battery_charging", charging)
+	}
+	if connection, known := ConnectionType(location.Conn); known {
+		payload.SetAttribute("connection", connection)
+	}
+	if trigger, known := TriggerName(location.Trigger); known {
+		payload.SetAttribute("trigger", trigger)
+	}
+
+	// vel, cog and vac are optional, and 0 is a valid value for them.
+	var motion struct {
+		Vel      *int     `json:"vel"`
+		Cog      *int     `json:"cog"`
+		Vac      *int     `json:"vac"`
+		Pressure *float64 `json:"p"`
+	}
+	if json.Unmarshal(raw, &motion) == nil {
+		if motion.Vel != nil {
+			speed := float64(*motion.Vel)
+			if imperial {
+				speed = math.Round(speed*mphPerKmh*10) / 10
+			}
+			payload.SetAttribute("speed", speed)
+		}
+		if motion.Cog != nil {
+			payload.SetAttribute("course", *motion.Cog)
+		}
+		if motion.Vac != nil {
+			vac := *motion.Vac
+			if imperial {
+				vac = int(math.Round(float64(vac) * feetPerMeter))
+			}
+			payload.SetAttribute("vertical_accuracy", vac)
+		}
+		// OwnTracks reports the barometer in kPa; phones without one send
+		// nothing.
+		if motion.Pressure != nil && *motion.Pressure > 0 {
+			setPressure(&payload, *motion.Pressure*10, opts, imperial)
+		}
+	}
+	return payload
+}
+
+// setPressure adds the pressure and the barometric altitude derived from it
+// for a pressure in hPa.
+func setPressure(payload *HAPayload, pressure float64, opts Options, imperial bool) {
+	unit := opts.PressureUnit
+	if _, ok := hPaPer[unit]; !ok {
+		unit = "hPa"
+	}
+	payload.SetAttribute("pressure", math.Round(pressure/hPaPer[unit]*100)/100)
+	payload.SetAttribute("pressure_unit", unit)
+
+	seaLevel := opts.SeaLevelPressure
+	if seaLevel <= 0 {
+		seaLevel = standardPressure
+	}
+	// The international barometric formula, for the troposphere.
+	altitude := 44330 * (1 - math.Pow(pressure/seaLevel, 1/5.255))
+	if imperial {
+		altitude *= feetPerMeter
+	}
+	payload.SetAttribute("barometric_altitude", math.Round(altitude))
+}
+
+// RoundCoordinate rounds a latitude or longitude to decimals places. Zero or
+// fewer decimals leave it unchanged.
+func RoundCoordinate(value float64, decimals int) float64 {
+	if decimals <= 0 {
+		return value
+	}
+	scale := math.Pow(10, float64(decimals))
+	return math.Round(value*scale) / scale
+}
+
+// PassthroughAttributes copies the given OwnTracks fields verbatim from the
+// raw payload so they reach Home Assistant as attributes. "*" copies every
+// field not starting with an underscore and nil means
+// DefaultPassthroughFields.
+func PassthroughAttributes(payload []byte, fields []string) map[string]interface{} {
+	if fields == nil {
+		fields = DefaultPassthroughFields
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &raw); err != nil {
+		return nil
+	}
+
+	attributes := make(map[string]interface{})
+	for _, field := range fields {
+		if field == "*" {
+			for k, v := range raw {
+				if !strings.HasPrefix(k, "_") {
+					attributes[k] = v
+				}
+			}
+			continue
+		}
+		if v, ok := raw[field]; ok {
+			attributes[field] = v
+		}
+	}
+	return attributes
+}
+
+// ApplyFieldOverrides renames and drops fields of an encoded payload.
+func ApplyFieldOverrides(payload []byte, rename map[string]string, drop []string) ([]byte, error) {
+	if len(rename) == 0 && len(drop) == 0 {
+		return payload, nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return nil, err
+	}
+	for _, name := range drop {
+		delete(fields, name)
+	}
+	for from, to := range rename {
+		if value, ok := fields[from]; ok {
+			delete(fields, from)
+			fields[to] = value
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// BatteryCharging maps the OwnTracks battery status (bs: 0 unknown,
+// 1 unplugged, 2 charging, 3 full) to whether the phone is charging.
+func BatteryCharging(bs int) (charging, known bool) {
+	return bs == 2, bs > 0
+}
+
+// ConnectionType maps the OwnTracks connectivity (conn: w WiFi, o offline,
+// m mobile data) to wifi, offline or mobile.
+func ConnectionType(conn string) (string, bool) {
+	switch conn {
+	case "w":
+		return "wifi", true
+	case "o":
+		return "offline", true
+	case "m":
+		return "mobile", true
+	}
+	return "", false
+}
+
+// TriggerNames are the names of the OwnTracks triggers (t), which say why the
+// phone published a location: p a background ping, c and C a region event
+// (C for follow regions), b a beacon, r a reportLocation command, u the
+// user, t the timer of move mode and v the iOS visit monitoring.
+var TriggerNames = map[string]string{
+	"p": "ping", "c": "region", "C": "region", "b": "beacon", "r": "report",
+	"u": "manual", "t": "timer", "v": "visit",
+}
+
+// TriggerName returns the name of an OwnTracks trigger, e.g. manual for u.
+func TriggerName(t string) (string, bool) {
+	name, ok := TriggerNames[t]
+	return name, ok
+}
+
+// ConvertBattery returns the battery state reported with a location.
+func ConvertBattery(location Location) BatteryState {
+	state := BatteryState{BatteryLevel: location.Batt}
+	if charging, known := BatteryCharging(location.BS); known {
+		state.BatteryCharging = &charging
+	}
+	return state
+}
+
+// ParseTransition decodes an OwnTracks transition message. It returns
+// ErrInvalidTransition, together with the decoded message, for events other
+// than enter and leave.
+func ParseTransition(data []byte) (Transition, error) {
+	var transition Transition
+	if err := json.Unmarshal(data, &transition); err != nil {
+		return transition, err
+	}
+	if transition.Event != "enter" && transition.Event != "leave" {
+		return transition, ErrInvalidTransition
+	}
+	return transition, nil
+}
+
+// ConvertTransition builds the event published for a transition of device.
+func ConvertTransition(transition Transition, device string) TransitionEvent {
+	event := TransitionEvent{
+		EventType:   transition.Event,
+		Region:      transition.Desc,
+		RegionID:    transition.RID,
+		Device:      device,
+		Trigger:     transition.Trigger,
+		Timestamp:   transition.Tst,
+		Latitude:    transition.Lat,
+		Longitude:   transition.Lon,
+		GPSAccuracy: transition.Acc,
+	}
+	if transition.Tst > 0 {
+		event.Time = time.Unix(transition.Tst, 0).UTC().Format(time.RFC3339)
+	}
+	return event
+}
+
+// ParseBeacon decodes an OwnTracks beacon message.
+func ParseBeacon(data []byte) (Beacon, error) {
+	var beacon Beacon
+	err := json.Unmarshal(data, &beacon)
+	return beacon, err
+}
+
+// proximityDistance is the distance in meters assumed for an iOS proximity
+// when the beacon message carries no estimate.
+var proximityDistance = map[int]float64{1: 0.5, 2: 3, 3: 10}
+
+// BeaconDistance returns the distance of a device to a beacon in meters: the
+// estimate of the phone or, without one, a guess from its proximity. It
+// reports false for a beacon out of range.
+func BeaconDistance(beacon Beacon) (float64, bool) {
+	if beacon.Acc > 0 {
+		return math.Round(beacon.Acc*100) / 100, true
+	}
+	distance, ok := proximityDistance[beacon.Prox]
+	return distance, ok
+}
+
+// ConvertBeacon builds the room presence published for a beacon seen by
+// device at distance.
+func ConvertBeacon(beacon Beacon, device string, distance float64) RoomPresence {
+	return RoomPresence{
+		ID:        device,
+		Name:      device,
+		Distance:  distance,
+		RSSI:      beacon.RSSI,
+		UUID:      beacon.UUID,
+		Major:     beacon.Major,
+		Minor:     beacon.Minor,
+		Timestamp: beacon.Tst,
+	}
+}
+
+// ParseWaypoints decodes an OwnTracks waypoint or waypoints message into the
+// regions it defines.
+func ParseWaypoints(data []byte) ([]Waypoint, error) {
+	var list Waypoints
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	if list.Type == "waypoints" {
+		return list.Waypoints, nil
+	}
+	var waypoint Waypoint
+	if err := json.Unmarshal(data, &waypoint); err != nil {
+		return nil, err
+	}
+	return []Waypoint{waypoint}, nil
+}
+
+// ConvertWaypoint builds the zone published for a region of device.
+func ConvertWaypoint(waypoint Waypoint, device string) Zone {
+	return Zone{
+		Name:      waypoint.Desc,
+		Latitude:  waypoint.Lat,
+		Longitude: waypoint.Lon,
+		Radius:    waypoint.Rad,
+		RegionID:  waypoint.RID,
+		Device:    device,
+	}
+}
+
+// CommandActions are the actions of OwnTracks cmd messages
+// (https://owntracks.org/booklet/tech/json/#_typecmd).
+var CommandActions = []string{"reportLocation", "reportSteps", "setWaypoints", "clearWaypoints", "setConfiguration", "waypoints", "dump", "status", "action"}
+
+// BuildCommand turns a request for a device into an OwnTracks cmd message: a
+// plain action such as reportLocation, or a JSON object with the action and
+// its fields, e.g. {"action":"setWaypoints","waypoints":{...}}. _type is set
+// to cmd.
+func BuildCommand(data []byte) ([]byte, error) {
+	command := map[string]interface{}{}
+	if trimmed := strings.TrimSpace(string(data)); strings.HasPrefix(trimmed, "{") {
+		if err := json.Unmarshal(data, &command); err != nil {
+			return nil, err
+		}
+	} else {
+		command["action"] = trimmed
+	}
+	action, _ := command["action"].(string)
+	if !slices.Contains(CommandActions, action) {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownCommand, action)
+	}
+	command["_type"] = "cmd"
+	return json.Marshal(command)
+}
+
+// ParseCard decodes an OwnTracks card message.
+func ParseCard(data []byte) (Card, error) {
+	var card Card
+	err := json.Unmarshal(data, &card)
+	return card, err
+}
+
+// ConvertCard builds the state published for the card of device.
+func ConvertCard(card Card, device string) CardState {
+	return CardState{Name: card.Name, TID: card.TID, Device: device}
+}
+
+// FaceContentType returns the MIME type of a base64 encoded card picture,
+// judged by the encoded signature of PNG and JPEG files.
+func FaceContentType(face string) string {
+	if strings.HasPrefix(face, "/9j/") {
+		return "image/jpeg"
+	}
+	return "image/png"
+}
+
+var invalidIDChars = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// ZoneID returns the topic level a region is published on: its region id,
+// or its name for regions without one, reduced to characters safe in an
+// object id. It is empty for regions with neither.
+func ZoneID(waypoint Waypoint) string {
+	id := waypoint.RID
+	if id == "" {
+		id = waypoint.Desc
+	}
+	return strings.Trim(invalidIDChars.ReplaceAllString(id, "_"), "_")
+}
+
+// DeviceID derives a Home Assistant object id from an OwnTracks topic, e.g.
+// owntracks/user1/device1 becomes user1_device1.
+func DeviceID(topic string) string {
+	parts := strings.Split(topic, "/")
+	if len(parts) > 2 {
+		parts = parts[len(parts)-2:]
+	}
+	id := invalidIDChars.ReplaceAllString(strings.Join(parts, "_"), "_")
+	return strings.Trim(id, "_")
+}
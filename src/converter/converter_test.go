@@ -0,0 +1,206 @@
+package converter
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestConvert(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		want    string
+		err     error
+	}{
+		{
+			name:    "location",
+			message: `{"_type":"location","lat":52.1,"lon":4.3,"acc":12,"alt":5,"batt":80,"bs":2,"vel":0,"tid":"ph","t":"u"}`,
+			want:    `{"altitude":5,"battery_charging":true,"battery_level":80,"bs":2,"gps_accuracy":12,"latitude":52.1,"longitude":4.3,"speed":0,"t":"u","tid":"ph","trigger":"manual","vel":0}`,
+		},
+		{
+			name:    "location without _type",
+			message: `{"lat":-33.9,"lon":18.4,"acc":3}`,
+			want:    `{"gps_accuracy":3,"altitude":0,"battery_level":0,"latitude":-33.9,"longitude":18.4}`,
+		},
+		{
+			name:    "transition",
+			message: `{"_type":"transition","event":"enter","desc":"Home","lat":52.1,"lon":4.3}`,
+			err:     ErrNotLocation,
+		},
+		{
+			name:    "card",
+			message: `{"_type":"card","name":"Anna","tid":"an"}`,
+			err:     ErrNotLocation,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, err := Convert([]byte(tt.message))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Convert() error = %v, want %v", err, tt.err)
+			}
+			if tt.err != nil {
+				return
+			}
+			got, err := json.Marshal(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Convert() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConvertTransition(t *testing.T) {
+	transition, err := ParseTransition([]byte(`{"_type":"transition","event":"leave","desc":"Work","rid":"w1","t":"c","tst":1700000000,"lat":52.1,"lon":4.3,"acc":20}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := TransitionEvent{
+		EventType:   "leave",
+		Region:      "Work",
+		RegionID:    "w1",
+		Device:      "anna_phone",
+		Trigger:     "c",
+		Timestamp:   1700000000,
+		Time:        "2023-11-14T22:13:20Z",
+		Latitude:    52.1,
+		Longitude:   4.3,
+		GPSAccuracy: 20,
+	}
+	if got := ConvertTransition(transition, "anna_phone"); got != want {
+		t.Errorf("ConvertTransition() = %+v, want %+v", got, want)
+	}
+
+	if _, err := ParseTransition([]byte(`{"_type":"transition","event":"dwell"}`)); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("ParseTransition(dwell) error = %v, want %v", err, ErrInvalidTransition)
+	}
+}
+
+func TestConvertCard(t *testing.T) {
+	card, err := ParseCard([]byte(`{"_type":"card","name":"Anna","tid":"an","face":"/9j/4AAQ"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := CardState{Name: "Anna", TID: "an", Device: "anna_phone"}
+	if got := ConvertCard(card, "anna_phone"); got != want {
+		t.Errorf("ConvertCard() = %+v, want %+v", got, want)
+	}
+	if got := FaceContentType(card.Face); got != "image/jpeg" {
+		t.Errorf("FaceContentType() = %q, want image/jpeg", got)
+	}
+}
+
+func TestParseLocation(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		err     error
+	}{
+		{"valid", `{"_type":"location","lat":52.1,"lon":4.3}`, nil},
+		{"on the equator", `{"_type":"location","lat":0,"lon":4.3}`, nil},
+		{"on the prime meridian", `{"_type":"location","lat":52.1,"lon":0}`, nil},
+		{"null island", `{"_type":"location","lat":0,"lon":0}`, ErrNullIsland},
+		{"missing lat", `{"_type":"location","lon":4.3}`, ErrInvalidCoordinates},
+		{"missing lon", `{"_type":"location","lat":52.1}`, ErrInvalidCoordinates},
+		{"missing both", `{"_type":"location","acc":10}`, ErrInvalidCoordinates},
+		{"other type", `{"_type":"waypoint","lat":52.1,"lon":4.3}`, ErrNotLocation},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseLocation([]byte(tt.message)); !errors.Is(err, tt.err) {
+				t.Errorf("ParseLocation() error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+
+	if _, err := ParseLocation([]byte(`{"lat":`)); err == nil {
+		t.Error("ParseLocation() of invalid JSON returned no error")
+	}
+}
+
+func TestRoundCoordinate(t *testing.T) {
+	tests := []struct {
+		value    float64
+		decimals int
+		want     float64
+	}{
+		{52.123456, 0, 52.123456},
+		{52.123456, -1, 52.123456},
+		{52.123456, 1, 52.1},
+		{52.123456, 3, 52.123},
+		{52.12351, 3, 52.124},
+		{-4.56789, 2, -4.57},
+		{0, 4, 0},
+	}
+	for _, tt := range tests {
+		if got := RoundCoordinate(tt.value, tt.decimals); got != tt.want {
+			t.Errorf("RoundCoordinate(%v, %d) = %v, want %v", tt.value, tt.decimals, got, tt.want)
+		}
+	}
+}
+
+func TestSetPressure(t *testing.T) {
+	tests := []struct {
+		name     string
+		pressure float64
+		opts     Options
+		imperial bool
+		want     map[string]interface{}
+	}{
+		{
+			name:     "default unit",
+			pressure: 1000,
+			want:     map[string]interface{}{"pressure": 1000.0, "pressure_unit": "hPa", "barometric_altitude": 111.0},
+		},
+		{
+			name:     "kPa",
+			pressure: 1000,
+			opts:     Options{PressureUnit: "kPa"},
+			want:     map[string]interface{}{"pressure": 100.0, "pressure_unit": "kPa", "barometric_altitude": 111.0},
+		},
+		{
+			name:     "inHg",
+			pressure: 1000,
+			opts:     Options{PressureUnit: "inHg"},
+			want:     map[string]interface{}{"pressure": 29.53, "pressure_unit": "inHg", "barometric_altitude": 111.0},
+		},
+		{
+			name:     "mmHg",
+			pressure: 1000,
+			opts:     Options{PressureUnit: "mmHg"},
+			want:     map[string]interface{}{"pressure": 750.06, "pressure_unit": "mmHg", "barometric_altitude": 111.0},
+		},
+		{
+			name:     "unknown unit",
+			pressure: 1000,
+			opts:     Options{PressureUnit: "psi"},
+			want:     map[string]interface{}{"pressure": 1000.0, "pressure_unit": "hPa", "barometric_altitude": 111.0},
+		},
+		{
+			name:     "sea level pressure",
+			pressure: 1000,
+			opts:     Options{SeaLevelPressure: 1000},
+			want:     map[string]interface{}{"pressure": 1000.0, "pressure_unit": "hPa", "barometric_altitude": 0.0},
+		},
+		{
+			name:     "imperial",
+			pressure: 1000,
+			imperial: true,
+			want:     map[string]interface{}{"pressure": 1000.0, "pressure_unit": "hPa", "barometric_altitude": 364.0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var payload HAPayload
+			setPressure(&payload, tt.pressure, tt.opts, tt.imperial)
+			if !reflect.DeepEqual(payload.Attributes, tt.want) {
+				t.Errorf("setPressure() attributes = %v, want %v", payload.Attributes, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package converter
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Decrypt opens an OwnTracks `_type: encrypted` payload. The data field is
+// the base64 encoded secretbox nonce followed by the ciphertext and the key
+// is the shared secret zero-padded to 32 bytes, as libsodium does on the
+// phone. Payloads that are not encrypted are returned unchanged.
+func Decrypt(payload []byte, secret string) ([]byte, error) {
+	var envelope struct {
+		Type string `json:"_type"`
+		Data string `json:"data"`
+	}
+	if err := json.Unmarshal(payload, &envelope); err != nil || envelope.Type != "encrypted" {
+		return payload, nil
+	}
+	if secret == "" {
+		return nil, fmt.Errorf("encrypted payload received but no encryption_key is configured")
+	}
+
+	box, err := base64.StdEncoding.DecodeString(envelope.Data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encrypted data: %w", err)
+	}
+	if len(box) < 24+secretbox.Overhead {
+		return nil, fmt.Errorf("encrypted data too short")
+	}
+
+	var key [32]byte
+	copy(key[:], secret)
+	var nonce [24]byte
+	copy(nonce[:], box[:24])
+
+	plain, ok := secretbox.Open(nil, box[24:], &nonce, &key)
+	if !ok {
+		return nil, fmt.Errorf("decryption failed, check the encryption_key")
+	}
+	return plain, nil
+}
@@ -0,0 +1,92 @@
+package converter
+
+// Location mirrors the OwnTracks location payload
+// (https://owntracks.org/booklet/tech/json/#_typelocation).
+type Location struct {
+	Type      string   `json:"_type,omitempty"`
+	Acc       int      `json:"acc"`
+	Alt       int      `json:"alt"`
+	Batt      int      `json:"batt"`
+	Lat       float64  `json:"lat"`
+	Lon       float64  `json:"lon"`
+	BS        int      `json:"bs,omitempty"`
+	Cog       int      `json:"cog,omitempty"`
+	Rad       int      `json:"rad,omitempty"`
+	Trigger   string   `json:"t,omitempty"`
+	TID       string   `json:"tid,omitempty"`
+	Tst       int64    `json:"tst,omitempty"`
+	Vac       int      `json:"vac,omitempty"`
+	Vel       int      `json:"vel,omitempty"`
+	Pressure  float64  `json:"p,omitempty"`
+	POI       string   `json:"poi,omitempty"`
+	Conn      string   `json:"conn,omitempty"`
+	Tag       string   `json:"tag,omitempty"`
+	Topic     string   `json:"topic,omitempty"`
+	InRegions []string `json:"inregions,omitempty"`
+	InRIDs    []string `json:"inrids,omitempty"`
+	SSID      string   `json:"SSID,omitempty"`
+	BSSID     string   `json:"BSSID,omitempty"`
+	CreatedAt int64    `json:"created_at,omitempty"`
+	Monitor   int      `json:"m,omitempty"`
+	ID        string   `json:"_id,omitempty"`
+}
+
+// Transition is an OwnTracks region enter/leave event
+// (https://owntracks.org/booklet/tech/json/#_typetransition).
+type Transition struct {
+	Type    string  `json:"_type"`
+	Event   string  `json:"event"`
+	Desc    string  `json:"desc"`
+	RID     string  `json:"rid"`
+	Trigger string  `json:"t"`
+	Tst     int64   `json:"tst"`
+	Wtst    int64   `json:"wtst"`
+	Acc     int     `json:"acc"`
+	Lat     float64 `json:"lat"`
+	Lon     float64 `json:"lon"`
+	TID     string  `json:"tid"`
+}
+
+// Beacon is an OwnTracks iBeacon ranging report
+// (https://owntracks.org/booklet/tech/json/#_typebeacon). Prox is the
+// proximity iOS estimates: 0 unknown, 1 immediate, 2 near, 3 far; Acc the
+// estimated distance in meters.
+type Beacon struct {
+	Type  string  `json:"_type"`
+	UUID  string  `json:"uuid"`
+	Major int     `json:"major"`
+	Minor int     `json:"minor"`
+	Tst   int64   `json:"tst"`
+	Acc   float64 `json:"acc"`
+	RSSI  int     `json:"rssi"`
+	Prox  int     `json:"prox"`
+}
+
+// Waypoint is an OwnTracks region definition
+// (https://owntracks.org/booklet/tech/json/#_typewaypoint).
+type Waypoint struct {
+	Type string  `json:"_type"`
+	Desc string  `json:"desc"`
+	Lat  float64 `json:"lat"`
+	Lon  float64 `json:"lon"`
+	Rad  int     `json:"rad"`
+	Tst  int64   `json:"tst"`
+	RID  string  `json:"rid"`
+}
+
+// Card is the name and picture a user shares with their friends
+// (https://owntracks.org/booklet/tech/json/#_typecard). Face is a base64
+// encoded PNG or JPEG image.
+type Card struct {
+	Type string `json:"_type"`
+	Name string `json:"name"`
+	Face string `json:"face"`
+	TID  string `json:"tid"`
+}
+
+// Waypoints is the list of regions OwnTracks publishes on export
+// (https://owntracks.org/booklet/tech/json/#_typewaypoints).
+type Waypoints struct {
+	Type      string     `json:"_type"`
+	Waypoints []Waypoint `json:"waypoints"`
+}
@@ -0,0 +1,117 @@
+package converter
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// queryFields lists the URL parameters of GPSLogger and OsmAnd style
+// trackers that ParseQuery reads, by the first name found.
+var queryFields = map[string][]string{
+	"lat":     {"lat", "latitude"},
+	"lon":     {"lon", "lng", "longitude"},
+	"acc":     {"acc", "accuracy"},
+	"alt":     {"alt", "altitude"},
+	"batt":    {"batt", "battery", "bat"},
+	"speed":   {"speed", "spd"},
+	"cog":     {"cog", "bearing", "heading", "dir"},
+	"time":    {"timestamp", "time", "tst"},
+	"charge":  {"charging", "charge"},
+	"tracker": {"tid"},
+}
+
+func queryValue(query url.Values, field string) string {
+	for _, name := range queryFields[field] {
+		if value := query.Get(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// ParseQuery builds a location from the URL parameters of a GPSLogger or
+// OsmAnd style tracker, e.g. ?lat=52.1&lon=4.3&acc=12&batt=80&speed=3.5.
+// speed is in m/s, the time in Unix seconds, milliseconds or RFC 3339, and
+// charging true or false. Like ParseLocation it returns
+// ErrInvalidCoordinates and ErrNullIsland with the location.
+func ParseQuery(query url.Values) (Location, error) {
+	location := Location{Type: "location"}
+	number := func(field string) (float64, bool, error) {
+		value := queryValue(query, field)
+		if value == "" {
+			return 0, false, nil
+		}
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return 0, false, fmt.Errorf("invalid %s %q", field, value)
+		}
+		return f, true, nil
+	}
+
+	lat, hasLat, err := number("lat")
+	if err != nil {
+		return location, err
+	}
+	lon, hasLon, err := number("lon")
+	if err != nil {
+		return location, err
+	}
+	location.Lat, location.Lon = lat, lon
+	for field, target := range map[string]*int{"acc": &location.Acc, "alt": &location.Alt, "batt": &location.Batt, "cog": &location.Cog} {
+		value, _, err := number(field)
+		if err != nil {
+			return location, err
+		}
+		*target = int(math.Round(value))
+	}
+	speed, _, err := number("speed")
+	if err != nil {
+		return location, err
+	}
+	// OwnTracks reports the velocity in km/h.
+	location.Vel = int(math.Round(speed * 3.6))
+
+	if value := queryValue(query, "time"); value != "" {
+		if location.Tst, err = queryTime(value); err != nil {
+			return location, err
+		}
+	}
+	if value := queryValue(query, "charge"); value != "" {
+		charging, err := strconv.ParseBool(value)
+		if err != nil {
+			return location, fmt.Errorf("invalid charging %q", value)
+		}
+		location.BS = 1
+		if charging {
+			location.BS = 2
+		}
+	}
+	location.TID = queryValue(query, "tracker")
+
+	if !hasLat || !hasLon {
+		return location, ErrInvalidCoordinates
+	}
+	if location.Lat == 0 && location.Lon == 0 {
+		return location, ErrNullIsland
+	}
+	return location, nil
+}
+
+// queryTime parses a time of ParseQuery into Unix seconds.
+func queryTime(value string) (int64, error) {
+	if n, err := strconv.ParseFloat(value, 64); err == nil {
+		// Milliseconds, as sent by OsmAnd, are past the year 33658 in seconds.
+		if n > 1e12 {
+			n /= 1000
+		}
+		return int64(n), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timestamp %q", value)
+	}
+	return t.Unix(), nil
+}
@@ -4,5 +4,11 @@ export PATH=$PATH:$GOROOT/bin:$GOPATH/bin
 
 cd /app/owntracks2ha/src/
 go mod init owntracks2ha 
-go get gopkg.in/yaml.v2
-go get github.com/eclipse/paho.mqtt.golang
\ No newline at end of file
+go get gopkg.in/yaml.v3
+go get github.com/eclipse/paho.mqtt.golang
+go get github.com/eclipse/paho.golang
+go get golang.org/x/crypto
+go get go.etcd.io/bbolt
+go get modernc.org/sqlite
+go get go.starlark.net
+go get github.com/BurntSushi/toml
\ No newline at end of file
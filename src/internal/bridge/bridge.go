@@ -0,0 +1,637 @@
+// Package bridge runs owntracks2ha: it receives OwnTracks messages from the
+// source broker or over HTTP, converts them and publishes the result to Home
+// Assistant.
+package bridge
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+
+	"owntracks2ha/internal/history"
+	"owntracks2ha/internal/mqttclient"
+)
+
+// Options are the command-line settings the bridge is started with.
+type Options struct {
+	ConfigPath   string
+	ConfigFormat string
+	Debug        bool
+	DryRun       bool
+	Version      string
+
+	// ReplayFile is a capture file replayed instead of subscribing to the
+	// source broker, at ReplaySpeed times the captured timing (0 for no
+	// pauses).
+	ReplayFile  string
+	ReplaySpeed float64
+}
+
+// version is reported at startup and in the geocoder User-Agent.
+var version = "dev"
+
+// Run loads the configuration, connects to the brokers and forwards messages
+// until the bridge is shut down. It only returns through os.Exit.
+func Run(opts Options) {
+	running.setOptions(opts)
+	if opts.Version != "" {
+		version = opts.Version
+	}
+
+	configPath, _ := running.configFile()
+	loadConfig(configPath)
+	cfg := currentConfig()
+	slog.Info("Starting owntracks2ha", "version", version, "config", configPath)
+	if cfg.RunMode == "dry-run" {
+		running.setDryRun()
+	}
+	dryRun := running.dryRun()
+	if dryRun {
+		slog.Info("Dry-run mode: messages are converted and logged but never published; the target is not contacted")
+	}
+	if opts.ReplayFile != "" {
+		prepareReplay(cfg)
+	}
+
+	invalid := false
+	for _, problem := range cfg.Validate() {
+		if problem.Warning {
+			slog.Warn("Questionable configuration", "setting", problem.Setting(), "problem", problem.Message)
+			continue
+		}
+		slog.Error("Invalid configuration", "setting", problem.Setting(), "error", problem.Message)
+		invalid = true
+	}
+	if invalid {
+		os.Exit(exitConfigError)
+	}
+	if err := loadScripts(cfg); err != nil {
+		slog.Error("Invalid transform script", "error", err)
+		os.Exit(exitConfigError)
+	}
+
+	if cfg.MetricsListen != "" {
+		go serveMetrics(cfg.MetricsListen)
+	}
+	if cfg.HealthListen != "" {
+		go serveHealth(cfg.HealthListen)
+	}
+
+	if cfg.BufferFile != "" && cfg.BufferSize > 0 && !dryRun {
+		if err := running.targetBuffer.open(cfg.BufferFile); err != nil {
+			slog.Error("Failed to open the on-disk queue", "file", cfg.BufferFile, "error", err)
+			os.Exit(exitFailure)
+		}
+		slog.Info("Opened the on-disk queue", "file", cfg.BufferFile, "pending", running.targetBuffer.len())
+	}
+
+	var recorder *history.Recorder
+	var exporter *history.Exporter
+	var store *history.Store
+	if cfg.History.SQLitePath != "" {
+		var err error
+		recorder, err = history.Open(cfg.History.SQLitePath)
+		if err != nil {
+			slog.Error("Failed to open the location history", "file", cfg.History.SQLitePath, "error", err)
+			os.Exit(exitFailure)
+		}
+		slog.Info("Recording location history", "file", cfg.History.SQLitePath)
+	}
+	if cfg.History.ExportDir != "" && !dryRun {
+		var err error
+		exporter, err = history.NewExporter(cfg.History.ExportDir, cfg.History.ExportFormat)
+		if err != nil {
+			slog.Error("Failed to set up the track export", "dir", cfg.History.ExportDir, "error", err)
+			os.Exit(exitFailure)
+		}
+		slog.Info("Exporting tracks", "dir", cfg.History.ExportDir, "format", cfg.History.ExportFormat)
+	}
+	if cfg.History.RecorderDir != "" && !dryRun {
+		var err error
+		store, err = history.NewStore(cfg.History.RecorderDir)
+		if err != nil {
+			slog.Error("Failed to set up the Recorder store", "dir", cfg.History.RecorderDir, "error", err)
+			os.Exit(exitFailure)
+		}
+		slog.Info("Writing the Recorder store", "dir", cfg.History.RecorderDir)
+	}
+	running.setHistory(recorder, exporter, store)
+	if cfg.History.APIListen != "" && recorder != nil {
+		go serveRecorderAPI(cfg.History.APIListen, recorder)
+	}
+
+	if cfg.RecordFile != "" {
+		capture, err := openCaptureFile(cfg)
+		if err != nil {
+			slog.Error("Failed to open the capture file", "file", cfg.RecordFile, "error", err)
+			os.Exit(exitFailure)
+		}
+		running.setCapture(capture)
+		slog.Info("Recording received messages", "file", cfg.RecordFile)
+	}
+
+	// A replay hands over messages one at a time, so they are processed in
+	// order without a worker queue that could overflow.
+	if opts.ReplayFile == "" {
+		running.workers.Store(newWorkerPool(cfg.Workers, cfg.WorkerQueueSize, processMessage))
+	}
+
+	// Source broker setup. Without a source broker locations only arrive
+	// through the OwnTracks HTTP endpoint.
+	if len(cfg.SourceBroker) == 0 && len(cfg.Sources) == 0 && cfg.HTTPListen == "" && opts.ReplayFile == "" {
+		slog.Error("Invalid Source broker settings: source_broker or sources is required unless http_listen is set")
+		os.Exit(exitConfigError)
+	}
+	var sourceBrokers []string
+	var sourceUser, sourcePass string
+	var sourceTLSConfig *tls.Config
+	var err error
+	if len(cfg.SourceBroker) > 0 {
+		sourceUseTLS := cfg.SourceTLS.TLSEnabled(cfg.UseTLS)
+		sourceBrokers, err = mqttclient.BrokerURLs(cfg.SourceBroker, cfg.SourcePort, sourceUseTLS, cfg.SourceTransport)
+		if err == nil {
+			sourceUser, sourcePass, err = mqttclient.Credentials(cfg.SourceAuth, cfg.SourceUser, cfg.SourcePass)
+		}
+		if err != nil {
+			slog.Error("Invalid Source broker settings", "error", err)
+			os.Exit(exitConfigError)
+		}
+		if sourceUseTLS || slices.ContainsFunc(sourceBrokers, mqttclient.URLUsesTLS) {
+			if sourceTLSConfig, err = mqttclient.BuildTLSConfig(cfg.SourceTLS); err != nil {
+				slog.Error("Invalid Source TLS settings", "error", err)
+				os.Exit(exitConfigError)
+			}
+		}
+	}
+
+	// Target broker settings. With single_broker the source connection
+	// publishes too, so no target host is needed.
+	if len(cfg.TargetBroker) == 0 && cfg.Output != "ha_rest" && !(cfg.SingleBroker && len(cfg.SourceBroker) > 0) && !dryRun {
+		slog.Error("Invalid Target broker settings: target_broker is required unless output is ha_rest or single_broker is set")
+		os.Exit(exitConfigError)
+	}
+	var targetBrokers []string
+	var targetUser, targetPass string
+	var targetTLSConfig *tls.Config
+	if len(cfg.TargetBroker) > 0 {
+		targetUseTLS := cfg.TargetTLS.TLSEnabled(cfg.UseTLS)
+		targetBrokers, err = mqttclient.BrokerURLs(cfg.TargetBroker, cfg.TargetPort, targetUseTLS, cfg.TargetTransport)
+		if err == nil {
+			targetUser, targetPass, err = mqttclient.Credentials(cfg.TargetAuth, cfg.TargetUser, cfg.TargetPass)
+		}
+		if err != nil {
+			slog.Error("Invalid Target broker settings", "error", err)
+			os.Exit(exitConfigError)
+		}
+		if targetUseTLS || slices.ContainsFunc(targetBrokers, mqttclient.URLUsesTLS) {
+			if targetTLSConfig, err = mqttclient.BuildTLSConfig(cfg.TargetTLS); err != nil {
+				slog.Error("Invalid Target TLS settings", "error", err)
+				os.Exit(exitConfigError)
+			}
+		}
+	}
+
+	// With OwnTracks and Home Assistant on the same broker one connection
+	// both subscribes and publishes.
+	var sourceClient, targetClient MQTT.Client
+	sharedClient := len(sourceBrokers) > 0 && cfg.Output != "ha_rest" && (cfg.SingleBroker || slices.Equal(sourceBrokers, targetBrokers) &&
+		sourceUser == targetUser && sourcePass == targetPass &&
+		reflect.DeepEqual(cfg.SourceTLS, cfg.TargetTLS))
+	if sharedClient {
+		slog.Info("Source and target are the same broker, sharing one connection", "broker", strings.Join(sourceBrokers, ", "))
+		for _, output := range cfg.OverlappingOutputs() {
+			slog.Warn("Output topic matches a subscribed filter; the bridge ignores its own messages on it", "topic", output)
+		}
+	}
+
+	onTargetConnect := func(client MQTT.Client) {
+		brokerConnected.set("target", 1)
+		go resumeElection(client)
+		go resumeCommands(client)
+		go resumeReverse(client)
+		go publishStatus(client, currentConfig().StatusTopic, statusOnline)
+		go flushTargetBuffer()
+	}
+	onTargetConnectionLost := func(client MQTT.Client, err error) {
+		brokerConnected.set("target", 0)
+		slog.Warn("Target MQTT connection lost", "error", err)
+	}
+
+	if len(sourceBrokers) > 0 && !cfg.CleanSessionEnabled() && cfg.SourceClientID == "" {
+		slog.Error("Invalid Source broker settings: clean_session false needs a source_client_id to resume the session with")
+		os.Exit(exitConfigError)
+	}
+	if len(sourceBrokers) > 0 {
+		slog.Info("Connecting to Source MQTT broker", "broker", strings.Join(sourceBrokers, ", "))
+		sourceOpts := mqttclient.Options(sourceBrokers, clientID(cfg.SourceClientID, "ot2ha_source"), sourceUser, sourcePass, sourceTLSConfig, cfg.ProtocolVersion)
+		mqttclient.ApplyConnectionSettings(sourceOpts, cfg)
+		sourceOpts.SetCleanSession(cfg.CleanSessionEnabled())
+		sourceOpts.SetDefaultPublishHandler(messageHandler)
+		// The handler only queues messages for the workers, so the client can
+		// deliver them in order without being blocked.
+		sourceOpts.SetOrderMatters(true)
+		sourceOpts.SetOnConnectHandler(func(client MQTT.Client) {
+			brokerConnected.set("source", 1)
+			if sharedClient {
+				onTargetConnect(client)
+			} else {
+				go resumeElection(client)
+				go resumeCommands(client)
+			}
+			// A broker that lost the session on restart no longer knows the
+			// subscriptions, so they are set up again on every reconnect.
+			if running.sourceSubscribed.Load() && !running.shuttingDown.Load() {
+				go resubscribe(client)
+			}
+		})
+		sourceOpts.SetConnectionLostHandler(func(client MQTT.Client, err error) {
+			brokerConnected.set("source", 0)
+			slog.Warn("Source MQTT connection lost", "error", err)
+			if sharedClient {
+				brokerConnected.set("target", 0)
+			}
+		})
+		if sharedClient && cfg.StatusTopic != "" && !dryRun {
+			sourceOpts.SetWill(cfg.StatusTopic, statusOffline, byte(cfg.QoS), true)
+		}
+		watchBroker(sourceOpts, "source")
+		sourceClient = mqttclient.New(sourceOpts, cfg.ProtocolVersion, cfg.SessionExpirySeconds)
+		if sharedClient {
+			targetClient = sourceClient
+		}
+		running.clients.set(sourceClient, targetClient, sharedClient)
+		token := sourceClient.Connect()
+		if token.Wait() && token.Error() != nil {
+			slog.Error("Source MQTT connection failed", "error", token.Error())
+			os.Exit(exitSourceConnect)
+		}
+		for !sourceClient.IsConnected() {
+			slog.Info("Waiting for Source MQTT connection to establish")
+			time.Sleep(500 * time.Millisecond)
+		}
+		slog.Info("Connected to Source MQTT broker", "broker", strings.Join(sourceBrokers, ", "))
+	}
+
+	// Target broker setup. The ha_rest output posts to Home Assistant and
+	// needs no target broker; dry-run never publishes.
+	if !sharedClient && cfg.Output != "ha_rest" && !dryRun {
+		slog.Info("Connecting to Target MQTT broker", "broker", strings.Join(targetBrokers, ", "))
+		targetOpts := mqttclient.Options(targetBrokers, clientID(cfg.TargetClientID, "ot2ha_target"), targetUser, targetPass, targetTLSConfig, cfg.ProtocolVersion)
+		mqttclient.ApplyConnectionSettings(targetOpts, cfg)
+		if cfg.StatusTopic != "" && !dryRun {
+			targetOpts.SetWill(cfg.StatusTopic, statusOffline, byte(cfg.QoS), true)
+		}
+		targetOpts.SetOnConnectHandler(onTargetConnect)
+		targetOpts.SetConnectionLostHandler(onTargetConnectionLost)
+		watchBroker(targetOpts, "target")
+		targetClient = mqttclient.New(targetOpts, cfg.ProtocolVersion, cfg.SessionExpirySeconds)
+		running.clients.set(sourceClient, targetClient, sharedClient)
+		token := targetClient.Connect()
+		if token.Wait() && token.Error() != nil {
+			slog.Error("Target MQTT connection failed", "error", token.Error())
+			os.Exit(exitTargetConnect)
+		}
+		for !targetClient.IsConnected() {
+			slog.Info("Waiting for Target MQTT connection to establish")
+			time.Sleep(500 * time.Millisecond)
+		}
+		slog.Info("Connected to Target MQTT broker", "broker", strings.Join(targetBrokers, ", "))
+	}
+
+	if zonesEnabled(cfg) {
+		loadZones(cfg)
+	}
+
+	if !dryRun {
+		if err := connectTargets(cfg); err != nil {
+			slog.Error("Invalid Target broker settings", "error", err)
+			os.Exit(exitConfigError)
+		}
+	}
+
+	// Leader election and commands use the target broker, which Home
+	// Assistant is on, or the source broker when locations are posted to
+	// Home Assistant.
+	controlClient := targetClient
+	if controlClient == nil {
+		controlClient = sourceClient
+	}
+	daemon := cfg.RunMode == "daemon" && opts.ReplayFile == "" && !dryRun
+	if cfg.LeaderElectionTopic != "" && daemon {
+		if controlClient == nil {
+			slog.Error("Invalid leader election settings: leader_election_topic needs a source or target broker")
+			os.Exit(exitConfigError)
+		}
+		startLeaderElection(cfg, controlClient)
+	}
+	if cfg.CommandTopic != "" && daemon {
+		if controlClient == nil {
+			slog.Error("Invalid command settings: command_topic needs a source or target broker")
+			os.Exit(exitConfigError)
+		}
+		startCommands(cfg, controlClient, func() { reloadConfig(configPath, sourceClient) })
+	}
+	if len(cfg.ReverseMappings) > 0 && daemon {
+		if targetClient == nil {
+			slog.Error("Invalid reverse mapping settings: reverse_mappings need a target broker")
+			os.Exit(exitConfigError)
+		}
+		startReverse(targetClient)
+	}
+
+	if cfg.DiscoveryEnabled && (targetClient != nil || len(cfg.Targets) > 0 || dryRun) {
+		publishDiscovery()
+	}
+
+	if err := startOutputs(cfg); err != nil {
+		slog.Error("Invalid output settings", "error", err)
+		os.Exit(exitConfigError)
+	}
+	if err := loadFilters(cfg); err != nil {
+		slog.Error("Invalid filter settings", "error", err)
+		os.Exit(exitConfigError)
+	}
+	close(running.ready)
+
+	// Subscribe to topics with retries
+	if sourceClient != nil {
+		for _, subTopic := range cfg.SubscriptionTopics() {
+			subscribeWithRetry(sourceClient, subTopic)
+		}
+		running.sourceSubscribed.Store(true)
+	}
+	// A replay keeps the sources for their mappings but does not connect
+	// them.
+	if opts.ReplayFile == "" {
+		if err := connectSources(cfg); err != nil {
+			slog.Error("Invalid Source broker settings", "error", err)
+			os.Exit(exitConfigError)
+		}
+	}
+
+	if cfg.HTTPListen != "" {
+		go serveHTTPIngest(cfg.HTTPListen, cfg.HTTPPath, cfg.HTTPGetPath)
+	}
+	if err := startInputs(cfg); err != nil {
+		slog.Error("Failed to start input", "error", err)
+		os.Exit(exitConfigError)
+	}
+
+	running.lastMessage.Store(time.Now().UnixNano())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGHUP {
+				slog.Info("Received SIGHUP, reloading configuration")
+				reloadConfig(configPath, sourceClient)
+				continue
+			}
+			slog.Info("Shutting down", "signal", sig.String())
+			shutdown(exitOK)
+		}
+	}()
+
+	if cfg.ConfigWatchIntervalSeconds > 0 {
+		go watchConfig(configPath, time.Duration(cfg.ConfigWatchIntervalSeconds)*time.Second, sourceClient)
+	}
+
+	go watchIdle()
+	if targetClient != nil && !dryRun && cfg.RunMode == "daemon" {
+		go publishStats()
+	}
+
+	// Under systemd with Type=notify the service counts as started only now
+	// that the brokers are connected and the topics subscribed.
+	sdNotify("READY=1")
+	if interval, ok := watchdogInterval(); ok {
+		slog.Info("Pinging the systemd watchdog", "interval", interval)
+		go runWatchdog(interval)
+	}
+
+	if opts.ReplayFile != "" {
+		shutdown(replay(opts.ReplayFile, opts.ReplaySpeed))
+	}
+	if cfg.RunMode == "once" {
+		shutdown(waitOnce(cfg))
+	}
+
+	slog.Info("Waiting for messages (daemon mode)")
+	select {}
+}
+
+func subscribeWithRetry(client MQTT.Client, subTopic string) {
+	cfg := currentConfig()
+	slog.Info("Subscribing to topic", "topic", subTopic)
+	for attempt := 1; attempt <= 5; attempt++ {
+		if !client.IsConnected() {
+			slog.Info("Client not connected yet, waiting to subscribe", "topic", subTopic)
+			time.Sleep(1 * time.Second)
+			continue
+		}
+		token := client.Subscribe(cfg.SubscriptionFilter(subTopic), cfg.SubscriptionQoS(subTopic), nil)
+		token.Wait()
+		if token.Error() != nil {
+			slog.Warn("Subscription attempt failed", "topic", subTopic, "attempt", attempt, "error", token.Error())
+			time.Sleep(1 * time.Second)
+		} else {
+			slog.Info("Subscribed to topic", "topic", subTopic)
+			return
+		}
+	}
+}
+
+// clientID returns the configured client ID, or prefix with a random suffix
+// when none is set.
+func clientID(configured, prefix string) string {
+	if configured != "" {
+		return configured
+	}
+	return fmt.Sprintf("%s_%08x", prefix, rand.Uint32())
+}
+
+// watchBroker logs and counts switches between the brokers of a failover
+// list and reports the one in use on the active broker metric.
+func watchBroker(opts *MQTT.ClientOptions, name string) {
+	mqttclient.WatchBroker(opts, func(previous, current string) {
+		if previous != "" {
+			activeBroker.set(name+","+previous, 0)
+			brokerFailovers.inc(name)
+			slog.Warn("Active MQTT broker changed", "broker", name, "from", previous, "to", current)
+		}
+		activeBroker.set(name+","+current, 1)
+	})
+}
+
+// resubscribe subscribes again to all source topics after the source client
+// reconnected.
+func resubscribe(client MQTT.Client) {
+	topics := currentConfig().SubscriptionTopics()
+	slog.Info("Source MQTT connection restored, resubscribing", "topics", len(topics))
+	for _, subTopic := range topics {
+		subscribeWithRetry(client, subTopic)
+	}
+}
+
+const (
+	statusOnline  = "online"
+	statusOffline = "offline"
+)
+
+// publishStatus publishes the retained bridge availability state to the
+// status topic, rewritten for the targets of the targets list. The broker
+// publishes "offline" through the last will when the bridge disappears
+// without a clean shutdown.
+func publishStatus(client MQTT.Client, topic, state string) {
+	cfg := currentConfig()
+	if topic == "" || running.dryRun() || !client.IsConnectionOpen() {
+		return
+	}
+
+	token := client.Publish(topic, byte(cfg.QoS), true, state)
+	if !token.WaitTimeout(5 * time.Second) {
+		slog.Warn("Timed out publishing bridge status", "topic", topic, "state", state)
+	} else if token.Error() != nil {
+		slog.Error("Failed to publish bridge status", "topic", topic, "state", state, "error", token.Error())
+	} else {
+		slog.Info("Published bridge status", "topic", topic, "state", state)
+	}
+}
+
+// shutdown stops the bridge cleanly: it unsubscribes and stops the inputs,
+// waits for messages being processed, flushes buffered publishes and
+// disconnects both clients, all within drain_timeout_seconds, then exits with
+// code.
+func shutdown(code int) {
+	running.shutdownOnce.Do(func() {
+		running.shuttingDown.Store(true)
+		sourceClient, targetClient, sharedClient := running.clients.source(), running.clients.target(), running.clients.shared()
+		sdNotify("STOPPING=1")
+		cfg := currentConfig()
+
+		timeout := time.Duration(cfg.DrainTimeoutSeconds) * time.Second
+		if timeout <= 0 {
+			timeout = 5 * time.Second
+		}
+		deadline := time.Now().Add(timeout)
+
+		// A persistent session keeps its subscriptions, so the broker queues
+		// what arrives until the bridge is back.
+		if cfg.CleanSessionEnabled() {
+			if sourceClient != nil {
+				unsubscribeSource(sourceClient, cfg.SubscriptionTopics(), deadline)
+			}
+			for _, source := range running.clients.extraSources() {
+				if settings, ok := cfg.Source(source.name); ok {
+					unsubscribeSource(source.client, cfg.SourceSubscriptionTopics(settings), deadline)
+				}
+			}
+		}
+		closeInputs()
+
+		// Handlers hold processingMu for reading, so taking the write lock
+		// waits for messages that are still being handed over; the workers
+		// then finish what is queued.
+		if !waitUntil(deadline, func() {
+			running.processingMu.Lock()
+			running.processingMu.Unlock()
+		}) {
+			slog.Warn("Timed out waiting for in-flight messages")
+		}
+		if workers := running.workers.Load(); workers != nil && !waitUntil(deadline, workers.wait) {
+			slog.Warn("Timed out waiting for queued messages")
+		}
+
+		if pending := running.targetBuffer.len(); pending > 0 && targetClient != nil && targetClient.IsConnectionOpen() {
+			slog.Info("Flushing buffered messages before exit", "count", pending)
+			if !waitUntil(deadline, flushTargetBuffer) {
+				slog.Warn("Timed out flushing buffered messages")
+			}
+		}
+		if pending := running.targetBuffer.len(); pending > 0 {
+			if cfg.BufferFile != "" {
+				slog.Info("Keeping undelivered messages in the on-disk queue", "count", pending, "file", cfg.BufferFile)
+			} else {
+				slog.Warn("Discarding undelivered buffered messages", "count", pending)
+			}
+		}
+		releaseLeadership()
+		running.targetBuffer.close()
+		closeOutputs()
+		if recorder, _, _ := running.locationHistory(); recorder != nil {
+			recorder.Close()
+		}
+		if capture := running.messageCapture(); capture != nil {
+			capture.close()
+		}
+
+		quiesce := time.Until(deadline).Milliseconds()
+		if quiesce < 250 {
+			quiesce = 250
+		}
+		if !sharedClient && sourceClient != nil {
+			sourceClient.Disconnect(250)
+		}
+		for _, source := range running.clients.extraSources() {
+			source.client.Disconnect(250)
+		}
+		if targetClient != nil {
+			publishStatus(targetClient, cfg.StatusTopic, statusOffline)
+			targetClient.Disconnect(uint(quiesce))
+		}
+		for _, target := range running.clients.extraTargets() {
+			if settings, ok := cfg.Target(target.name); ok && cfg.StatusTopic != "" {
+				publishStatus(target.client, settings.RewriteTopic(cfg.StatusTopic), statusOffline)
+			}
+			target.client.Disconnect(250)
+		}
+		slog.Info("Shutdown complete")
+		os.Exit(code)
+	})
+}
+
+// unsubscribeSource unsubscribes a source client from topics on shutdown.
+func unsubscribeSource(client MQTT.Client, topics []string, deadline time.Time) {
+	if len(topics) == 0 || !client.IsConnectionOpen() {
+		return
+	}
+	cfg := currentConfig()
+	filters := make([]string, len(topics))
+	for i, topic := range topics {
+		filters[i] = cfg.SubscriptionFilter(topic)
+	}
+	if token := client.Unsubscribe(filters...); !token.WaitTimeout(time.Until(deadline)) {
+		slog.Warn("Timed out unsubscribing from source topics")
+	} else if token.Error() != nil {
+		slog.Error("Failed to unsubscribe from source topics", "error", token.Error())
+	}
+}
+
+// waitUntil runs fn and reports whether it returned before the deadline.
+func waitUntil(deadline time.Time, fn func()) bool {
+	done := make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
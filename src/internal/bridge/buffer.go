@@ -0,0 +1,384 @@
+package bridge
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	bolt "go.etcd.io/bbolt"
+
+	"owntracks2ha/internal/config"
+	"owntracks2ha/internal/mqttclient"
+)
+
+// pendingMessage is a target publish held back while the target broker is
+// unavailable.
+type pendingMessage struct {
+	topic    string
+	qos      byte
+	retained bool
+	payload  []byte
+	seq      uint64
+
+	// tst is the OwnTracks timestamp of the location the message carries,
+	// or 0 for other messages.
+	tst int64
+
+	// sourceTopic is the OwnTracks topic the message was converted from.
+	sourceTopic string
+}
+
+// messageBuffer is a bounded FIFO of pending target publishes. With
+// buffer_file set every queued message is also written to a bbolt database,
+// keyed by its sequence number, so it survives a restart.
+//
+// Workers and phones sending their own backlog queue locations out of fix
+// order, so delivered keeps the newest tst published on every target topic
+// and a flush skips locations older than it instead of moving a device back.
+type messageBuffer struct {
+	mu        sync.Mutex
+	items     []pendingMessage
+	nextSeq   uint64
+	flushing  bool
+	db        *bolt.DB
+	delivered map[string]int64
+}
+
+// storedMessage is the on-disk form of a pendingMessage.
+type storedMessage struct {
+	Topic       string    `json:"topic"`
+	QoS         byte      `json:"qos"`
+	Retained    bool      `json:"retained"`
+	Payload     []byte    `json:"payload"`
+	SourceTopic string    `json:"source_topic,omitempty"`
+	Tst         int64     `json:"tst,omitempty"`
+	QueuedAt    time.Time `json:"queued_at"`
+}
+
+var queueBucket = []byte("queue")
+
+// errBuffered is returned by publishTarget when a message was queued for
+// later delivery instead of being published.
+var errBuffered = errors.New("message buffered")
+
+// push appends a message, applying the overflow policy when the buffer is
+// full. It reports whether the message was kept.
+func (b *messageBuffer) push(msg pendingMessage) bool {
+	cfg := currentConfig()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.items) >= cfg.BufferSize {
+		if cfg.BufferOverflow == "drop_newest" {
+			slog.Warn("Target buffer full, dropping message", "topic", msg.topic, "buffer_size", cfg.BufferSize)
+			return false
+		}
+		slog.Warn("Target buffer full, dropping oldest message", "topic", b.items[0].topic, "buffer_size", cfg.BufferSize)
+		b.remove(b.items[0].seq)
+		b.items = b.items[1:]
+	}
+	b.nextSeq++
+	msg.seq = b.nextSeq
+	b.items = append(b.items, msg)
+	b.store(msg)
+	return true
+}
+
+// open backs the buffer with the on-disk queue in filename and loads the
+// messages a previous run could not deliver, in the order they were queued.
+func (b *messageBuffer) open(filename string) error {
+	db, err := bolt.Open(filename, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(queueBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.ForEach(func(key, value []byte) error {
+			var stored storedMessage
+			if len(key) != 8 || json.Unmarshal(value, &stored) != nil {
+				slog.Warn("Skipping unreadable message in the on-disk queue", "file", filename)
+				return nil
+			}
+			msg := pendingMessage{
+				topic:       stored.Topic,
+				qos:         stored.QoS,
+				retained:    stored.Retained,
+				payload:     stored.Payload,
+				seq:         binary.BigEndian.Uint64(key),
+				tst:         stored.Tst,
+				sourceTopic: stored.SourceTopic,
+			}
+			b.items = append(b.items, msg)
+			b.nextSeq = msg.seq
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return err
+	}
+	b.db = db
+	return nil
+}
+
+// close closes the on-disk queue; undelivered messages stay in it.
+func (b *messageBuffer) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.db != nil {
+		b.db.Close()
+		b.db = nil
+	}
+}
+
+func queueKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+// store writes msg to the on-disk queue. Callers hold b.mu.
+func (b *messageBuffer) store(msg pendingMessage) {
+	if b.db == nil {
+		return
+	}
+	value, err := json.Marshal(storedMessage{
+		Topic:       msg.topic,
+		QoS:         msg.qos,
+		Retained:    msg.retained,
+		Payload:     msg.payload,
+		SourceTopic: msg.sourceTopic,
+		Tst:         msg.tst,
+		QueuedAt:    time.Now(),
+	})
+	if err == nil {
+		err = b.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(queueBucket).Put(queueKey(msg.seq), value)
+		})
+	}
+	if err != nil {
+		slog.Error("Failed to write message to the on-disk queue, keeping it in memory only", "topic", msg.topic, "error", err)
+	}
+}
+
+// remove deletes a delivered or dropped message from the on-disk queue.
+// Callers hold b.mu.
+func (b *messageBuffer) remove(seq uint64) {
+	if b.db == nil {
+		return
+	}
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(queueBucket).Delete(queueKey(seq))
+	})
+	if err != nil {
+		slog.Error("Failed to remove message from the on-disk queue", "error", err)
+	}
+}
+
+// markDelivered records that msg was published to the target.
+func (b *messageBuffer) markDelivered(msg pendingMessage) {
+	if msg.tst <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.delivered == nil {
+		b.delivered = map[string]int64{}
+	}
+	if msg.tst > b.delivered[msg.topic] {
+		b.delivered[msg.topic] = msg.tst
+	}
+}
+
+// superseded reports whether a newer location than msg was already
+// published on its topic. Callers hold b.mu.
+func (b *messageBuffer) superseded(msg pendingMessage) bool {
+	return msg.tst > 0 && msg.tst < b.delivered[msg.topic]
+}
+
+func (b *messageBuffer) len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.items)
+}
+
+// publishTarget publishes a message to the target broker and the targets
+// list. When buffering is enabled, messages published while the target is
+// disconnected (or while older messages are still waiting) are queued and
+// errBuffered is returned.
+func publishTarget(topic string, qos byte, retained bool, payload []byte, sourceTopic string) error {
+	return publishPending(pendingMessage{topic: topic, qos: qos, retained: retained, payload: payload, sourceTopic: sourceTopic})
+}
+
+// publishPending is publishTarget for a message built by the caller, e.g. a
+// location with its tst so the buffer can replay it in fix order.
+func publishPending(msg pendingMessage) error {
+	cfg := currentConfig()
+	if running.dryRun() {
+		slog.Info("[DRY-RUN] Would publish", "topic", msg.topic, "qos", msg.qos, "retained", msg.retained, "payload", string(msg.payload))
+		return nil
+	}
+
+	publishExtraTargets(cfg, msg)
+
+	targetClient := running.clients.target()
+	if targetClient == nil {
+		return errors.New("no target broker: output is ha_rest")
+	}
+
+	buffering := cfg.BufferSize > 0
+
+	if buffering && (!targetClient.IsConnectionOpen() || running.targetBuffer.len() > 0) {
+		return bufferMessage(msg)
+	}
+
+	if err := publishWithRetry(cfg, msg); err != nil {
+		if buffering {
+			slog.Error("Failed to publish message", "topic", msg.topic, "error", err)
+			return bufferMessage(msg)
+		}
+		return err
+	}
+	publishes.inc("success")
+	running.targetBuffer.markDelivered(msg)
+	return nil
+}
+
+// maxRetryDelay caps the backoff between publish retries.
+const maxRetryDelay = 30 * time.Second
+
+// publishWithRetry publishes msg to the target, retrying a failed publish up
+// to publish_retries times with exponential backoff. It gives up early when
+// the bridge is shutting down.
+func publishWithRetry(cfg *config.Config, msg pendingMessage) error {
+	backoff := time.Duration(cfg.PublishRetryBackoffMs) * time.Millisecond
+	if backoff <= 0 {
+		backoff = 500 * time.Millisecond
+	}
+	for attempt := 0; ; attempt++ {
+		token := publishMessage(running.clients.target(), msg)
+		token.Wait()
+		err := token.Error()
+		if err == nil {
+			notePublishResult(nil)
+			return nil
+		}
+		publishes.inc("failure")
+		if attempt >= cfg.PublishRetries || running.shuttingDown.Load() {
+			notePublishResult(err)
+			return err
+		}
+		delay := retryDelay(backoff, attempt)
+		slog.Warn("Publish failed, retrying", "topic", msg.topic, "attempt", attempt+1, "retry_in", delay, "error", err)
+		time.Sleep(delay)
+	}
+}
+
+// retryDelay returns the wait before retry attempt+1: backoff doubled for
+// every earlier attempt, then randomized between half and the full value so
+// that retries of many devices do not line up.
+func retryDelay(backoff time.Duration, attempt int) time.Duration {
+	delay := maxRetryDelay
+	if attempt < 16 && backoff<<attempt < maxRetryDelay {
+		delay = backoff << attempt
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// publishMessage publishes msg on client, adding MQTT v5 properties when the
+// client speaks v5.
+func publishMessage(client MQTT.Client, msg pendingMessage) MQTT.Token {
+	if running.clients.shared() {
+		running.ownTopics.Store(msg.topic, struct{}{})
+	}
+	return mqttclient.Publish(client, mqttclient.Message{
+		Topic:                msg.topic,
+		QoS:                  msg.qos,
+		Retained:             msg.retained,
+		Payload:              msg.payload,
+		MessageExpirySeconds: currentConfig().MessageExpirySeconds,
+		SourceTopic:          msg.sourceTopic,
+	})
+}
+
+func bufferMessage(msg pendingMessage) error {
+	if !running.targetBuffer.push(msg) {
+		return fmt.Errorf("target buffer full")
+	}
+	slog.Warn("Target broker unavailable, buffered message", "topic", msg.topic, "pending", running.targetBuffer.len())
+	return errBuffered
+}
+
+// flushTargetBuffer publishes buffered messages in order, skipping
+// locations older than one already published on their topic. It stops at
+// the first failure and leaves the remaining messages for the next
+// reconnect.
+func flushTargetBuffer() {
+	running.targetBuffer.mu.Lock()
+	if running.targetBuffer.flushing {
+		running.targetBuffer.mu.Unlock()
+		return
+	}
+	running.targetBuffer.flushing = true
+	running.targetBuffer.mu.Unlock()
+
+	defer func() {
+		running.targetBuffer.mu.Lock()
+		running.targetBuffer.flushing = false
+		running.targetBuffer.mu.Unlock()
+	}()
+
+	flushed, skipped := 0, 0
+	for {
+		running.targetBuffer.mu.Lock()
+		if len(running.targetBuffer.items) == 0 {
+			running.targetBuffer.mu.Unlock()
+			break
+		}
+		msg := running.targetBuffer.items[0]
+		if running.targetBuffer.superseded(msg) {
+			running.targetBuffer.remove(msg.seq)
+			running.targetBuffer.items = running.targetBuffer.items[1:]
+			running.targetBuffer.mu.Unlock()
+			slog.Debug("Skipping buffered location older than the last one published", "topic", msg.topic, "tst", msg.tst)
+			skipped++
+			continue
+		}
+		running.targetBuffer.mu.Unlock()
+
+		token := publishMessage(running.clients.target(), msg)
+		token.Wait()
+		if token.Error() != nil {
+			publishes.inc("failure")
+			slog.Error("Failed to flush buffered message", "topic", msg.topic, "error", token.Error())
+			return
+		}
+		publishes.inc("success")
+		running.targetBuffer.markDelivered(msg)
+
+		running.targetBuffer.mu.Lock()
+		// The head may have been dropped by the overflow policy meanwhile.
+		if len(running.targetBuffer.items) > 0 && running.targetBuffer.items[0].seq == msg.seq {
+			running.targetBuffer.remove(msg.seq)
+			running.targetBuffer.items = running.targetBuffer.items[1:]
+		}
+		running.targetBuffer.mu.Unlock()
+		flushed++
+	}
+
+	if flushed > 0 || skipped > 0 {
+		slog.Info("Flushed buffered messages to the target broker", "count", flushed, "skipped", skipped)
+	}
+}
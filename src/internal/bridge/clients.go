@@ -0,0 +1,82 @@
+package bridge
+
+import (
+	"sync"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// brokerClients holds the broker connections of the bridge. Run sets them
+// while the HTTP endpoints and the client callbacks are already running, so
+// they are only read through its methods.
+type brokerClients struct {
+	mu           sync.RWMutex
+	sourceClient MQTT.Client
+	targetClient MQTT.Client
+	// sharedClient is set when source and target are the same broker and
+	// targetClient is the source client.
+	sharedClient bool
+	// sources and targets are the clients of the sources and targets lists.
+	sources []namedClient
+	targets []namedClient
+}
+
+type namedClient struct {
+	name   string
+	client MQTT.Client
+}
+
+func (c *brokerClients) set(source, target MQTT.Client, shared bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sourceClient, c.targetClient, c.sharedClient = source, target, shared
+}
+
+// source returns the source client, or nil without a source broker.
+func (c *brokerClients) source() MQTT.Client {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.sourceClient
+}
+
+// target returns the target client, or nil when nothing is published over
+// MQTT.
+func (c *brokerClients) target() MQTT.Client {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.targetClient
+}
+
+// addSource records the client of a source from the sources list.
+func (c *brokerClients) addSource(name string, client MQTT.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sources = append(c.sources, namedClient{name, client})
+}
+
+// extraSources returns the clients of the sources list.
+func (c *brokerClients) extraSources() []namedClient {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([]namedClient(nil), c.sources...)
+}
+
+// addTarget records the client of a target from the targets list.
+func (c *brokerClients) addTarget(name string, client MQTT.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.targets = append(c.targets, namedClient{name, client})
+}
+
+// extraTargets returns the clients of the targets list.
+func (c *brokerClients) extraTargets() []namedClient {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([]namedClient(nil), c.targets...)
+}
+
+func (c *brokerClients) shared() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.sharedClient
+}
@@ -0,0 +1,263 @@
+package bridge
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+
+	"owntracks2ha/converter"
+	"owntracks2ha/internal/config"
+)
+
+// commandRequest is a message on command_topic: a JSON object, or plain
+// text such as "set-log-level debug" while no command_token is set.
+type commandRequest struct {
+	Command string `json:"command"`
+	Arg     string `json:"arg"`
+	Token   string `json:"token"`
+}
+
+// commandResponse is published on <command_topic>/response for every
+// command.
+type commandResponse struct {
+	Command string       `json:"command"`
+	OK      bool         `json:"ok"`
+	Error   string       `json:"error,omitempty"`
+	State   *bridgeState `json:"state,omitempty"`
+}
+
+// bridgeState is the answer to dump-state.
+type bridgeState struct {
+	Paused        bool                   `json:"paused"`
+	PausedDevices []string               `json:"paused_devices,omitempty"`
+	Leader        bool                   `json:"leader"`
+	LogLevel      string                 `json:"log_level"`
+	Stats         bridgeStats            `json:"stats"`
+	Devices       map[string]deviceState `json:"devices"`
+}
+
+// deviceState is the last location forwarded for a source topic, with the
+// rounded or blurred position it was forwarded with.
+type deviceState struct {
+	Latitude     float64   `json:"latitude"`
+	Longitude    float64   `json:"longitude"`
+	Received     time.Time `json:"received"`
+	Tst          int64     `json:"tst,omitempty"`
+	Availability string    `json:"availability,omitempty"`
+}
+
+// devicePaused reports whether forwarding is paused for the device of topic.
+func devicePaused(cfg *config.Config, topic string) bool {
+	subTopic := cfg.MappingTopic(topic)
+	found := false
+	running.pausedDevices.Range(func(key, _ any) bool {
+		found = deviceMatches(key.(string), subTopic)
+		return !found
+	})
+	return found
+}
+
+// deviceMatches reports whether target, a source topic, mapping filter or
+// device ID, names the device of subTopic.
+func deviceMatches(target, subTopic string) bool {
+	if target == converter.DeviceID(subTopic) {
+		return true
+	}
+	_, ok := config.TopicMatch(target, subTopic)
+	return ok
+}
+
+// pauseDevice pauses forwarding for target and publishes pause_availability
+// for the devices it matches that have been seen.
+func pauseDevice(cfg *config.Config, target string) {
+	if _, loaded := running.pausedDevices.LoadOrStore(target, true); !loaded {
+		slog.Warn("Paused forwarding locations of a device until resumed", "device", target)
+	}
+	if cfg.PauseAvailability == "" || cfg.AvailabilityTopic == "" || cfg.Output == "ha_rest" {
+		return
+	}
+	for _, subTopic := range knownDevices() {
+		if deviceMatches(target, subTopic) {
+			publishAvailability(cfg, subTopic, cfg.PauseAvailability)
+		}
+	}
+}
+
+// resumeDevice lifts "pause <target>" and marks the devices it paused online
+// again, unless another pause still covers them.
+func resumeDevice(cfg *config.Config, target string) error {
+	if _, ok := running.pausedDevices.LoadAndDelete(target); !ok {
+		return fmt.Errorf("device %q is not paused", target)
+	}
+	slog.Info("Resumed forwarding locations of a device", "device", target)
+	if cfg.PauseAvailability == "" || cfg.AvailabilityTopic == "" || cfg.Output == "ha_rest" {
+		return nil
+	}
+	for _, subTopic := range knownDevices() {
+		if !deviceMatches(target, subTopic) || devicePaused(cfg, subTopic) {
+			continue
+		}
+		if state, ok := running.deviceAvailability.Load(subTopic); ok && state == cfg.PauseAvailability {
+			publishAvailability(cfg, subTopic, statusOnline)
+		}
+	}
+	return nil
+}
+
+// knownDevices returns the source topics locations were forwarded for.
+func knownDevices() []string {
+	var subTopics []string
+	running.lastForwarded.Range(func(key, _ any) bool {
+		subTopics = append(subTopics, key.(string))
+		return true
+	})
+	return subTopics
+}
+
+// commandListener subscribes the command topic on client. reload reloads the
+// configuration like SIGHUP.
+type commandListener struct {
+	topic  string
+	client MQTT.Client
+	reload func()
+}
+
+// startCommands subscribes to command_topic.
+func startCommands(cfg *config.Config, client MQTT.Client, reload func()) {
+	l := &commandListener{topic: cfg.CommandTopic, client: client, reload: reload}
+	running.commands.Store(l)
+	if cfg.CommandToken == "" {
+		slog.Warn("Accepting commands without a command_token", "topic", l.topic)
+	}
+	l.subscribe()
+}
+
+// resumeCommands subscribes to the command topic again after client
+// reconnected.
+func resumeCommands(client MQTT.Client) {
+	if l := running.commands.Load(); l != nil && l.client == client && !running.shuttingDown.Load() {
+		l.subscribe()
+	}
+}
+
+func (l *commandListener) subscribe() {
+	token := l.client.Subscribe(l.topic, 1, func(_ MQTT.Client, msg MQTT.Message) {
+		// A reload can take a while, which must not hold up the client.
+		go l.handle(msg.Payload())
+	})
+	if !token.WaitTimeout(5 * time.Second) {
+		slog.Warn("Timed out subscribing to the command topic", "topic", l.topic)
+	} else if token.Error() != nil {
+		slog.Error("Failed to subscribe to the command topic", "topic", l.topic, "error", token.Error())
+	} else {
+		slog.Info("Listening for commands", "topic", l.topic)
+	}
+}
+
+func (l *commandListener) handle(payload []byte) {
+	cfg := currentConfig()
+	var request commandRequest
+	if trimmed := strings.TrimSpace(string(payload)); strings.HasPrefix(trimmed, "{") {
+		if err := json.Unmarshal(payload, &request); err != nil {
+			slog.Warn("Ignoring invalid command", "topic", l.topic, "error", err)
+			l.respond(commandResponse{Error: "invalid JSON: " + err.Error()})
+			return
+		}
+	} else {
+		request.Command, request.Arg, _ = strings.Cut(trimmed, " ")
+		request.Arg = strings.TrimSpace(request.Arg)
+	}
+	if subtle.ConstantTimeCompare([]byte(request.Token), []byte(cfg.CommandToken)) != 1 {
+		slog.Warn("Rejected command with a wrong token", "topic", l.topic, "command", request.Command)
+		l.respond(commandResponse{Command: request.Command, Error: "wrong or missing token"})
+		return
+	}
+
+	response := commandResponse{Command: request.Command, OK: true}
+	if err := l.run(request, &response); err != nil {
+		response.OK, response.Error = false, err.Error()
+		slog.Warn("Command failed", "command", request.Command, "error", err)
+	}
+	l.respond(response)
+}
+
+// run carries out a command, filling in the response of dump-state.
+func (l *commandListener) run(request commandRequest, response *commandResponse) error {
+	slog.Info("Received command", "command", request.Command, "arg", request.Arg)
+	switch request.Command {
+	case "reload":
+		l.reload()
+	case "pause":
+		if request.Arg != "" {
+			pauseDevice(currentConfig(), request.Arg)
+		} else if !running.paused.Swap(true) {
+			slog.Warn("Paused forwarding locations until resumed")
+		}
+	case "resume":
+		if request.Arg != "" {
+			return resumeDevice(currentConfig(), request.Arg)
+		}
+		if running.paused.Swap(false) {
+			slog.Info("Resumed forwarding locations")
+		}
+	case "dump-state":
+		state := dumpState()
+		response.State = &state
+	case "set-log-level":
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(request.Arg)); err != nil {
+			return fmt.Errorf("invalid log level %q (expected debug, info, warn or error)", request.Arg)
+		}
+		logLevel.Set(level)
+		slog.Info("Log level changed", "level", level.String())
+	default:
+		return fmt.Errorf("unknown command %q (expected reload, pause, resume, dump-state or set-log-level)", request.Command)
+	}
+	return nil
+}
+
+func dumpState() bridgeState {
+	state := bridgeState{
+		Paused:   running.paused.Load(),
+		Leader:   isLeader(),
+		LogLevel: logLevel.Level().String(),
+		Stats:    collectStats(),
+		Devices:  map[string]deviceState{},
+	}
+	running.pausedDevices.Range(func(key, _ any) bool {
+		state.PausedDevices = append(state.PausedDevices, key.(string))
+		return true
+	})
+	slices.Sort(state.PausedDevices)
+	running.lastForwarded.Range(func(key, value any) bool {
+		location := value.(forwardedLocation)
+		device := deviceState{Latitude: location.shownLat, Longitude: location.shownLon, Received: location.at.UTC(), Tst: location.tst}
+		if availability, ok := running.deviceAvailability.Load(key); ok {
+			device.Availability, _ = availability.(string)
+		}
+		state.Devices[key.(string)] = device
+		return true
+	})
+	return state
+}
+
+func (l *commandListener) respond(response commandResponse) {
+	payload, err := json.Marshal(response)
+	if err != nil {
+		slog.Error("Error encoding command response", "error", err)
+		return
+	}
+	topic := l.topic + "/response"
+	token := l.client.Publish(topic, byte(currentConfig().QoS), false, payload)
+	if !token.WaitTimeout(5 * time.Second) {
+		slog.Warn("Timed out publishing command response", "topic", topic)
+	} else if token.Error() != nil {
+		slog.Error("Failed to publish command response", "topic", topic, "error", token.Error())
+	}
+}
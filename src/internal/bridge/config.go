@@ -0,0 +1,225 @@
+package bridge
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+
+	"owntracks2ha/internal/config"
+)
+
+// currentConfig returns the active configuration. Callers should read it
+// once and keep the snapshot, since a reload may replace it at any time.
+func currentConfig() *config.Config {
+	return running.config.Load()
+}
+
+func loadConfig(filename string) {
+	_, format := running.configFile()
+	cfg, err := config.ReadFormat(filename, format)
+	if err != nil {
+		slog.Error("Failed to load configuration", "error", err)
+		os.Exit(exitConfigError)
+	}
+	applyFlagOverrides(cfg)
+	if err := configureLogging(cfg); err != nil {
+		slog.Error("Invalid logging settings", "error", err)
+		os.Exit(exitConfigError)
+	}
+	running.config.Store(cfg)
+}
+
+// applyFlagOverrides applies command-line flags that take precedence over
+// the config file and environment.
+func applyFlagOverrides(cfg *config.Config) {
+	if running.debug() {
+		cfg.Debug = true
+	}
+}
+
+// reloadConfig re-reads the config file and applies mapping, QoS and debug
+// changes to the running bridge. Broker connection settings only take effect
+// after a restart.
+func reloadConfig(filename string, sourceClient MQTT.Client) {
+	_, format := running.configFile()
+	newConfig, err := config.ReadFormat(filename, format)
+	if err != nil {
+		slog.Error("Config reload failed, keeping the current configuration", "error", err)
+		return
+	}
+	applyFlagOverrides(newConfig)
+	if err := configureLogging(newConfig); err != nil {
+		slog.Error("Config reload failed, keeping the current configuration", "error", err)
+		return
+	}
+	for _, problem := range newConfig.Validate() {
+		if !problem.Warning {
+			slog.Error("Config reload failed, keeping the current configuration", "setting", problem.Setting(), "error", problem.Message)
+			return
+		}
+	}
+	if err := loadScripts(newConfig); err != nil {
+		slog.Error("Config reload failed, keeping the current configuration", "error", err)
+		return
+	}
+	oldConfig := currentConfig()
+
+	if !slices.Equal(oldConfig.SourceBroker, newConfig.SourceBroker) || oldConfig.SourcePort != newConfig.SourcePort ||
+		oldConfig.SourceUser != newConfig.SourceUser || oldConfig.SourcePass != newConfig.SourcePass || oldConfig.SourceAuth != newConfig.SourceAuth ||
+		!slices.Equal(oldConfig.TargetBroker, newConfig.TargetBroker) || oldConfig.TargetPort != newConfig.TargetPort ||
+		oldConfig.TargetUser != newConfig.TargetUser || oldConfig.TargetPass != newConfig.TargetPass || oldConfig.TargetAuth != newConfig.TargetAuth ||
+		oldConfig.SourceTransport != newConfig.SourceTransport || oldConfig.TargetTransport != newConfig.TargetTransport ||
+		oldConfig.UseTLS != newConfig.UseTLS || oldConfig.ProtocolVersion != newConfig.ProtocolVersion || !reflect.DeepEqual(oldConfig.SourceTLS, newConfig.SourceTLS) ||
+		!reflect.DeepEqual(oldConfig.TargetTLS, newConfig.TargetTLS) || oldConfig.MetricsListen != newConfig.MetricsListen ||
+		oldConfig.HealthListen != newConfig.HealthListen ||
+		oldConfig.KeepAliveSeconds != newConfig.KeepAliveSeconds || oldConfig.ConnectTimeoutSeconds != newConfig.ConnectTimeoutSeconds ||
+		oldConfig.MaxReconnectSeconds != newConfig.MaxReconnectSeconds || oldConfig.WriteTimeoutSeconds != newConfig.WriteTimeoutSeconds ||
+		oldConfig.SourceClientID != newConfig.SourceClientID || oldConfig.TargetClientID != newConfig.TargetClientID ||
+		oldConfig.CleanSessionEnabled() != newConfig.CleanSessionEnabled() ||
+		oldConfig.BufferFile != newConfig.BufferFile || oldConfig.RecordFile != newConfig.RecordFile ||
+		oldConfig.RecordMaxSizeMB != newConfig.RecordMaxSizeMB || oldConfig.RecordMaxFiles != newConfig.RecordMaxFiles ||
+		oldConfig.HTTPListen != newConfig.HTTPListen || oldConfig.HTTPPath != newConfig.HTTPPath || oldConfig.HTTPGetPath != newConfig.HTTPGetPath ||
+		oldConfig.Workers != newConfig.Workers || oldConfig.WorkerQueueSize != newConfig.WorkerQueueSize ||
+		oldConfig.LeaderElectionTopic != newConfig.LeaderElectionTopic || oldConfig.LeaderLeaseSeconds != newConfig.LeaderLeaseSeconds ||
+		oldConfig.InstanceID != newConfig.InstanceID || oldConfig.CommandTopic != newConfig.CommandTopic ||
+		!reflect.DeepEqual(oldConfig.ReverseMappings, newConfig.ReverseMappings) ||
+		!reflect.DeepEqual(oldConfig.Outputs, newConfig.Outputs) || oldConfig.InfluxDBURL != newConfig.InfluxDBURL ||
+		!reflect.DeepEqual(oldConfig.Inputs, newConfig.Inputs) || !reflect.DeepEqual(oldConfig.Filters, newConfig.Filters) ||
+		!reflect.DeepEqual(sourceConnections(oldConfig), sourceConnections(newConfig)) ||
+		!reflect.DeepEqual(targetConnections(oldConfig), targetConnections(newConfig)) {
+		slog.Warn("Broker, listener, buffer or capture file, worker, leader election, command topic, reverse mapping, input, filter or output settings changed; restart the bridge to apply them")
+	}
+
+	running.config.Store(newConfig)
+	if zonesEnabled(newConfig) {
+		loadZones(newConfig)
+	}
+
+	// Without a source broker there is nothing to subscribe to. Sources
+	// added to or removed from the sources list wait for the restart.
+	if sourceClient != nil {
+		updateSubscriptions(sourceClient, oldConfig, newConfig, oldConfig.SubscriptionTopics(), newConfig.SubscriptionTopics())
+	}
+	for _, source := range running.clients.extraSources() {
+		oldSource, ok := oldConfig.Source(source.name)
+		newSource, exists := newConfig.Source(source.name)
+		if ok && exists && source.client.IsConnectionOpen() {
+			updateSubscriptions(source.client, oldConfig, newConfig, oldConfig.SourceSubscriptionTopics(oldSource), newConfig.SourceSubscriptionTopics(newSource))
+		}
+	}
+
+	if newConfig.DiscoveryEnabled && (running.clients.target() != nil || len(running.clients.extraTargets()) > 0 || running.dryRun()) {
+		publishDiscovery()
+	}
+	slog.Info("Configuration reloaded", "mappings", len(newConfig.AllMappings()), "qos", newConfig.QoS, "debug", newConfig.Debug)
+}
+
+// watchConfig polls the modification times of the config file and the
+// files it includes and reloads the configuration when one of them changes.
+func watchConfig(filename string, interval time.Duration, sourceClient MQTT.Client) {
+	paths := watchedPaths(filename)
+	lastMod := latestModTime(paths)
+	for {
+		time.Sleep(interval)
+		modTime := latestModTime(paths)
+		if !modTime.After(lastMod) {
+			continue
+		}
+		slog.Info("Config file changed, reloading", "file", filename)
+		reloadConfig(filename, sourceClient)
+		paths = watchedPaths(filename)
+		lastMod = latestModTime(paths)
+	}
+}
+
+// watchedPaths returns the config files and the directories they are in,
+// which change when an included file is added or removed.
+func watchedPaths(filename string) []string {
+	paths := []string{filename}
+	_, format := running.configFile()
+	if files, err := config.Files(filename, format); err == nil {
+		for _, file := range files {
+			paths = append(paths, file, filepath.Dir(file))
+		}
+	}
+	return paths
+}
+
+func latestModTime(paths []string) time.Time {
+	var latest time.Time
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// sourceConnections returns the sources list without the mappings, which
+// apply on reload.
+func sourceConnections(cfg *config.Config) []config.SourceSettings {
+	sources := make([]config.SourceSettings, len(cfg.Sources))
+	for i, source := range cfg.Sources {
+		source.Mappings = nil
+		sources[i] = source
+	}
+	return sources
+}
+
+// targetConnections returns the targets list without the topic rewriting and
+// the QoS and retain overrides, which apply on reload.
+func targetConnections(cfg *config.Config) []config.TargetSettings {
+	targets := make([]config.TargetSettings, len(cfg.Targets))
+	for i, target := range cfg.Targets {
+		target.TopicPrefixes, target.QoS, target.Retain = nil, nil, nil
+		targets[i] = target
+	}
+	return targets
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// logLevel is the minimum level of the process logger. configureLogging
+// updates it whenever the configuration is (re)loaded.
+var logLevel = new(slog.LevelVar)
+
+// configureLogging installs the process logger for log_format and
+// log_level. debug (or -debug) always lowers the level to debug.
+func configureLogging(cfg *config.Config) error {
+	level := slog.LevelInfo
+	if cfg.LogLevel != "" {
+		if err := level.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+			return fmt.Errorf("invalid log_level %q (expected debug, info, warn or error)", cfg.LogLevel)
+		}
+	}
+	if cfg.Debug {
+		level = slog.LevelDebug
+	}
+
+	opts := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	switch cfg.LogFormat {
+	case "", "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("invalid log_format %q (expected text or json)", cfg.LogFormat)
+	}
+	logLevel.Set(level)
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
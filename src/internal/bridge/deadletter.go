@@ -0,0 +1,52 @@
+package bridge
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+
+	"owntracks2ha/internal/config"
+)
+
+// deadLetter is published to dead_letter_topic for a message the bridge
+// could not parse, decrypt, map or deliver.
+type deadLetter struct {
+	Reason  string `json:"reason"`
+	Error   string `json:"error,omitempty"`
+	Topic   string `json:"topic"`
+	Time    string `json:"time"`
+	Payload string `json:"payload"`
+}
+
+// publishDeadLetter republishes the payload of a failed message together
+// with the reason it failed. It goes to the target broker, so there is no
+// dead letter topic with the ha_rest output.
+func publishDeadLetter(cfg *config.Config, subTopic, reason string, payload []byte, cause error) {
+	if cfg.DeadLetterTopic == "" || cfg.Output == "ha_rest" {
+		return
+	}
+	letter := deadLetter{
+		Reason:  reason,
+		Topic:   subTopic,
+		Time:    time.Now().UTC().Format(time.RFC3339),
+		Payload: string(payload),
+	}
+	if cause != nil {
+		letter.Error = cause.Error()
+	}
+	encoded, err := json.Marshal(letter)
+	if err != nil {
+		slog.Error("Error encoding dead letter", "topic", subTopic, "error", err)
+		return
+	}
+
+	err = publishTarget(cfg.DeadLetterTopic, byte(cfg.QoS), false, encoded, subTopic)
+	switch {
+	case errors.Is(err, errBuffered):
+	case err != nil:
+		slog.Warn("Failed to publish dead letter", "topic", subTopic, "target", cfg.DeadLetterTopic, "reason", reason, "error", err)
+	default:
+		slog.Debug("Published dead letter", "topic", subTopic, "target", cfg.DeadLetterTopic, "reason", reason)
+	}
+}
@@ -0,0 +1,239 @@
+package bridge
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"owntracks2ha/converter"
+	"owntracks2ha/internal/config"
+)
+
+type DiscoveryDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+}
+
+// Availability is one entry of the availability list of a discovery config.
+type Availability struct {
+	Topic string `json:"topic"`
+}
+
+type DiscoveryConfig struct {
+	Name                string          `json:"name"`
+	UniqueID            string          `json:"unique_id"`
+	ObjectID            string          `json:"object_id"`
+	StateTopic          string          `json:"state_topic,omitempty"`
+	JSONAttributesTopic string          `json:"json_attributes_topic,omitempty"`
+	AvailabilityTopic   string          `json:"availability_topic,omitempty"`
+	Availability        []Availability  `json:"availability,omitempty"`
+	AvailabilityMode    string          `json:"availability_mode,omitempty"`
+	SourceType          string          `json:"source_type,omitempty"`
+	DeviceClass         string          `json:"device_class,omitempty"`
+	UnitOfMeasurement   string          `json:"unit_of_measurement,omitempty"`
+	StateClass          string          `json:"state_class,omitempty"`
+	ValueTemplate       string          `json:"value_template,omitempty"`
+	ImageTopic          string          `json:"image_topic,omitempty"`
+	ImageEncoding       string          `json:"image_encoding,omitempty"`
+	ContentType         string          `json:"content_type,omitempty"`
+	CommandTopic        string          `json:"command_topic,omitempty"`
+	PayloadPress        string          `json:"payload_press,omitempty"`
+	Icon                string          `json:"icon,omitempty"`
+	Device              DiscoveryDevice `json:"device"`
+}
+
+// publishDiscovery publishes discovery configs for all mappings without
+// wildcards. Wildcard mappings are announced when a device first reports.
+// A standby leaves this to the leader.
+func publishDiscovery() {
+	if !isLeader() {
+		return
+	}
+	cfg := currentConfig()
+	for subTopic, mapping := range cfg.AllMappings() {
+		if config.IsWildcardTopic(subTopic) {
+			continue
+		}
+		ensureDiscovery(subTopic, config.ExpandTopic(mapping.Target, subTopic, nil), mapping.OutputStyle)
+	}
+}
+
+// ensureDiscovery publishes the discovery config for a device once per run.
+// style is the output_style of its mapping.
+func ensureDiscovery(subTopic, pubTopic, style string) {
+	cfg := currentConfig()
+	objectID := converter.DeviceID(subTopic)
+	name := strings.ReplaceAll(objectID, "_", " ")
+	// The device tracker reads latitude, longitude and gps_accuracy from the
+	// attributes topic, so no state topic is needed for the JSON payload.
+	discovery := DiscoveryConfig{
+		Name:                name,
+		UniqueID:            "owntracks2ha_" + objectID,
+		ObjectID:            objectID,
+		JSONAttributesTopic: pubTopic,
+		AvailabilityTopic:   cfg.StatusTopic,
+		SourceType:          "gps",
+		Device:              discoveryDevice(objectID),
+	}
+	if locationNameEnabled(cfg) {
+		// The bridge resolves zones itself, so the state is its
+		// location_name rather than Home Assistant's zone match.
+		discovery.StateTopic = pubTopic
+		discovery.ValueTemplate = "{{ value_json.location_name }}"
+	}
+	if style == "state_attributes" {
+		discovery.JSONAttributesTopic = pubTopic + "/attributes"
+		discovery.ValueTemplate = ""
+		discovery.StateTopic = ""
+		if locationNameEnabled(cfg) {
+			discovery.StateTopic = pubTopic + "/state"
+		}
+	}
+	setDeviceAvailability(cfg, subTopic, &discovery)
+	publishDiscoveryConfig(subTopic, "device_tracker", objectID, discovery)
+	if cfg.RequestLocationTopic != "" {
+		ensureRequestLocationDiscovery(subTopic)
+	}
+}
+
+// ensureRequestLocationDiscovery announces a button that asks the phone of
+// a device for its location: it publishes reportLocation to the
+// request_location_topic of the device, which a reverse mapping forwards to
+// its cmd topic.
+func ensureRequestLocationDiscovery(subTopic string) {
+	cfg := currentConfig()
+	objectID := converter.DeviceID(subTopic)
+	name := strings.ReplaceAll(objectID, "_", " ")
+	_, captures, _ := cfg.MatchMapping(subTopic)
+	publishDiscoveryConfig("request_location:"+subTopic, "button", objectID+"_request_location", DiscoveryConfig{
+		Name:              name + " request location update",
+		UniqueID:          "owntracks2ha_" + objectID + "_request_location",
+		ObjectID:          objectID + "_request_location",
+		CommandTopic:      config.ExpandTopic(cfg.RequestLocationTopic, subTopic, captures),
+		PayloadPress:      "reportLocation",
+		Icon:              "mdi:crosshairs-gps",
+		AvailabilityTopic: cfg.StatusTopic,
+		Device:            discoveryDevice(objectID),
+	})
+}
+
+// setDeviceAvailability makes an entity unavailable while its device is
+// offline when availability_topic is set. Together with status_topic both
+// have to report online.
+func setDeviceAvailability(cfg *config.Config, subTopic string, discovery *DiscoveryConfig) {
+	if cfg.AvailabilityTopic == "" {
+		return
+	}
+	_, captures, _ := cfg.MatchMapping(subTopic)
+	discovery.AvailabilityTopic = ""
+	discovery.Availability = []Availability{{Topic: config.ExpandTopic(cfg.AvailabilityTopic, subTopic, captures)}}
+	if cfg.StatusTopic != "" {
+		discovery.Availability = append(discovery.Availability, Availability{Topic: cfg.StatusTopic})
+		discovery.AvailabilityMode = "all"
+	}
+}
+
+// ensureCardDiscovery announces the name of a friend card as a sensor and
+// its picture as an image entity, attached to the same Home Assistant device
+// as the tracker.
+func ensureCardDiscovery(subTopic, cardTopic string, hasFace bool, contentType string) {
+	cfg := currentConfig()
+	objectID := converter.DeviceID(subTopic)
+	name := strings.ReplaceAll(objectID, "_", " ")
+	publishDiscoveryConfig("card:"+subTopic, "sensor", objectID+"_name", DiscoveryConfig{
+		Name:              name + " name",
+		UniqueID:          "owntracks2ha_" + objectID + "_name",
+		ObjectID:          objectID + "_name",
+		StateTopic:        cardTopic,
+		AvailabilityTopic: cfg.StatusTopic,
+		ValueTemplate:     "{{ value_json.name }}",
+		Device:            discoveryDevice(objectID),
+	})
+	if !hasFace {
+		return
+	}
+	publishDiscoveryConfig("card_face:"+subTopic, "image", objectID+"_face", DiscoveryConfig{
+		Name:              name + " picture",
+		UniqueID:          "owntracks2ha_" + objectID + "_face",
+		ObjectID:          objectID + "_face",
+		ImageTopic:        cardTopic + "/face",
+		ImageEncoding:     "b64",
+		ContentType:       contentType,
+		AvailabilityTopic: cfg.StatusTopic,
+		Device:            discoveryDevice(objectID),
+	})
+}
+
+// ensureBatteryDiscovery announces the battery level and charging sensors
+// of a device, attached to the same Home Assistant device as its tracker.
+func ensureBatteryDiscovery(subTopic, batteryTopic string) {
+	cfg := currentConfig()
+	objectID := converter.DeviceID(subTopic)
+	name := strings.ReplaceAll(objectID, "_", " ")
+	publishDiscoveryConfig("battery:"+subTopic, "sensor", objectID+"_battery", DiscoveryConfig{
+		Name:              name + " battery",
+		UniqueID:          "owntracks2ha_" + objectID + "_battery",
+		ObjectID:          objectID + "_battery",
+		StateTopic:        batteryTopic,
+		AvailabilityTopic: cfg.StatusTopic,
+		DeviceClass:       "battery",
+		UnitOfMeasurement: "%",
+		StateClass:        "measurement",
+		ValueTemplate:     "{{ value_json.battery_level }}",
+		Device:            discoveryDevice(objectID),
+	})
+	publishDiscoveryConfig("battery_charging:"+subTopic, "binary_sensor", objectID+"_battery_charging", DiscoveryConfig{
+		Name:              name + " charging",
+		UniqueID:          "owntracks2ha_" + objectID + "_battery_charging",
+		ObjectID:          objectID + "_battery_charging",
+		StateTopic:        batteryTopic,
+		AvailabilityTopic: cfg.StatusTopic,
+		DeviceClass:       "battery_charging",
+		ValueTemplate:     "{{ 'ON' if value_json.battery_charging else 'OFF' }}",
+		Device:            discoveryDevice(objectID),
+	})
+}
+
+func discoveryDevice(objectID string) DiscoveryDevice {
+	return DiscoveryDevice{
+		Identifiers:  []string{"owntracks2ha_" + objectID},
+		Name:         strings.ReplaceAll(objectID, "_", " "),
+		Manufacturer: "OwnTracks",
+		Model:        "owntracks2ha",
+	}
+}
+
+// publishDiscoveryConfig publishes a retained discovery config for a
+// component once per key.
+func publishDiscoveryConfig(key, component, objectID string, discovery DiscoveryConfig) {
+	cfg := currentConfig()
+	if _, done := running.discoveryPublished.LoadOrStore(key, true); done {
+		return
+	}
+
+	prefix := cfg.DiscoveryPrefix
+	if prefix == "" {
+		prefix = "homeassistant"
+	}
+
+	payload, err := json.Marshal(discovery)
+	if err != nil {
+		slog.Error("Error encoding discovery config", "topic", key, "error", err)
+		return
+	}
+
+	discoveryTopic := fmt.Sprintf("%s/%s/%s/config", prefix, component, objectID)
+	err = publishTarget(discoveryTopic, byte(cfg.QoS), true, payload, "")
+	switch {
+	case errors.Is(err, errBuffered):
+	case err != nil:
+		running.discoveryPublished.Delete(key)
+		slog.Error("Failed to publish discovery config", "topic", discoveryTopic, "error", err)
+	default:
+		slog.Info("Published discovery config", "topic", discoveryTopic)
+	}
+}
@@ -0,0 +1,32 @@
+package bridge
+
+import (
+	"log/slog"
+)
+
+// Exit codes of the bridge, so a supervisor can tell a broken configuration
+// (which restarting will not fix) from a broker that could not be reached.
+const (
+	exitOK            = 0
+	exitFailure       = 1
+	exitConfigError   = 2
+	exitSourceConnect = 3
+	exitTargetConnect = 4
+	exitIdleTimeout   = 5
+	exitPublishErrors = 6
+)
+
+// notePublishResult tracks consecutive publish failures and shuts the bridge
+// down once exit_on_publish_error_threshold of them happened in a row.
+func notePublishResult(err error) {
+	if err == nil {
+		running.publishErrors.Store(0)
+		return
+	}
+	threshold := currentConfig().PublishErrorThreshold
+	if failures := running.publishErrors.Add(1); threshold > 0 && failures == int64(threshold) {
+		slog.Error("Too many consecutive publish failures, exiting", "failures", failures, "error", err)
+		// shutdown waits for the workers, one of which is the caller.
+		go shutdown(exitPublishErrors)
+	}
+}
@@ -0,0 +1,225 @@
+package bridge
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"owntracks2ha/internal/config"
+)
+
+// geocodeResult is a cached reverse geocoding answer.
+type geocodeResult struct {
+	Address  string `json:"address"`
+	Locality string `json:"locality"`
+}
+
+// geocoder resolves coordinates to an address through a Nominatim or Photon
+// server. Answers are cached by coordinates rounded to about 11 m and
+// persisted to geocoder_cache_file; requests are spaced by
+// geocoder_interval_seconds to respect the public servers' usage policies.
+type geocoder struct {
+	mu          sync.Mutex
+	cache       map[string]geocodeResult
+	cacheFile   string
+	lastRequest time.Time
+	client      http.Client
+}
+
+func geocodeCacheKey(lat, lon float64) string {
+	return fmt.Sprintf("%.4f,%.4f", math.Round(lat*1e4)/1e4, math.Round(lon*1e4)/1e4)
+}
+
+// lookup returns the address of a location, from the cache when possible.
+func (g *geocoder) lookup(cfg *config.Config, lat, lon float64) (geocodeResult, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.cache == nil || g.cacheFile != cfg.GeocoderCacheFile {
+		g.loadCache(cfg.GeocoderCacheFile)
+	}
+	key := geocodeCacheKey(lat, lon)
+	if result, ok := g.cache[key]; ok {
+		return result, nil
+	}
+
+	interval := time.Duration(cfg.GeocoderIntervalSeconds) * time.Second
+	if wait := interval - time.Since(g.lastRequest); wait > 0 {
+		time.Sleep(wait)
+	}
+	g.lastRequest = time.Now()
+
+	var result geocodeResult
+	var err error
+	switch cfg.GeocoderProvider {
+	case "", "nominatim":
+		result, err = g.nominatim(cfg, lat, lon)
+	case "photon":
+		result, err = g.photon(cfg, lat, lon)
+	default:
+		return result, fmt.Errorf("unknown geocoder_provider %q (expected nominatim or photon)", cfg.GeocoderProvider)
+	}
+	if err != nil {
+		return result, err
+	}
+
+	g.cache[key] = result
+	g.saveCache()
+	return result, nil
+}
+
+func (g *geocoder) loadCache(filename string) {
+	g.cache = make(map[string]geocodeResult)
+	g.cacheFile = filename
+	if filename == "" {
+		return
+	}
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &g.cache)
+	}
+	if err != nil {
+		slog.Warn("Ignoring unreadable geocoder cache", "file", filename, "error", err)
+		g.cache = make(map[string]geocodeResult)
+		return
+	}
+	slog.Info("Loaded geocoder cache", "file", filename, "entries", len(g.cache))
+}
+
+// saveCache rewrites the cache file through a temporary file so a crash
+// never leaves a truncated cache behind.
+func (g *geocoder) saveCache() {
+	if g.cacheFile == "" {
+		return
+	}
+	data, err := json.Marshal(g.cache)
+	if err != nil {
+		slog.Error("Error encoding geocoder cache", "error", err)
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(g.cacheFile), ".geocoder-cache-*")
+	if err == nil {
+		_, err = tmp.Write(data)
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), g.cacheFile)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}
+	if err != nil {
+		slog.Error("Failed to write geocoder cache", "file", g.cacheFile, "error", err)
+	}
+}
+
+func (g *geocoder) get(cfg *config.Config, path string, query url.Values, out interface{}) error {
+	endpoint := strings.TrimSuffix(cfg.GeocoderURL, "/") + path + "?" + query.Encode()
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "owntracks2ha/"+version)
+	if cfg.GeocoderLanguage != "" {
+		req.Header.Set("Accept-Language", cfg.GeocoderLanguage)
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("geocoder returned %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// nominatim queries the reverse endpoint of a Nominatim server
+// (https://nominatim.org/release-docs/latest/api/Reverse/).
+func (g *geocoder) nominatim(cfg *config.Config, lat, lon float64) (geocodeResult, error) {
+	var answer struct {
+		DisplayName string            `json:"display_name"`
+		Address     map[string]string `json:"address"`
+		Error       string            `json:"error"`
+	}
+	query := url.Values{
+		"format": {"jsonv2"},
+		"lat":    {strconv.FormatFloat(lat, 'f', -1, 64)},
+		"lon":    {strconv.FormatFloat(lon, 'f', -1, 64)},
+	}
+	if err := g.get(cfg, "/reverse", query, &answer); err != nil {
+		return geocodeResult{}, err
+	}
+	if answer.Error != "" {
+		return geocodeResult{}, errors.New(answer.Error)
+	}
+
+	result := geocodeResult{Address: answer.DisplayName}
+	for _, key := range []string{"city", "town", "village", "hamlet", "municipality", "suburb"} {
+		if answer.Address[key] != "" {
+			result.Locality = answer.Address[key]
+			break
+		}
+	}
+	return result, nil
+}
+
+// photon queries the reverse endpoint of a Photon server
+// (https://github.com/komoot/photon#reverse-geocode-coordinates).
+func (g *geocoder) photon(cfg *config.Config, lat, lon float64) (geocodeResult, error) {
+	var answer struct {
+		Features []struct {
+			Properties map[string]interface{} `json:"properties"`
+		} `json:"features"`
+	}
+	query := url.Values{
+		"lat": {strconv.FormatFloat(lat, 'f', -1, 64)},
+		"lon": {strconv.FormatFloat(lon, 'f', -1, 64)},
+	}
+	if cfg.GeocoderLanguage != "" {
+		query.Set("lang", cfg.GeocoderLanguage)
+	}
+	if err := g.get(cfg, "/reverse", query, &answer); err != nil {
+		return geocodeResult{}, err
+	}
+	if len(answer.Features) == 0 {
+		return geocodeResult{}, errors.New("no address found")
+	}
+
+	prop := func(key string) string {
+		value, _ := answer.Features[0].Properties[key].(string)
+		return value
+	}
+	street := strings.TrimSpace(prop("street") + " " + prop("housenumber"))
+	if street == "" {
+		street = prop("name")
+	}
+	result := geocodeResult{Locality: prop("city")}
+	if result.Locality == "" {
+		result.Locality = prop("district")
+	}
+	var parts []string
+	for _, part := range []string{street, strings.TrimSpace(prop("postcode") + " " + result.Locality), prop("country")} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	result.Address = strings.Join(parts, ", ")
+	return result, nil
+}
@@ -0,0 +1,1051 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+
+	"owntracks2ha/converter"
+	"owntracks2ha/internal/config"
+	"owntracks2ha/internal/history"
+	"owntracks2ha/internal/plugin"
+	"owntracks2ha/internal/script"
+)
+
+// forwardedLocation is the last location forwarded for a source topic. lat
+// and lon are its exact position, for the throttling, and shownLat and
+// shownLon the rounded or blurred one it was forwarded with. at is when it
+// was received and fix when it was recorded on the phone; tst and sum are its
+// OwnTracks timestamp and a hash of its payload.
+type forwardedLocation struct {
+	lat, lon           float64
+	shownLat, shownLon float64
+	at                 time.Time
+	fix                time.Time
+	tst                int64
+	sum                uint64
+}
+
+// payloadSum hashes a location payload for duplicateReason.
+func payloadSum(data []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(data)
+	return h.Sum64()
+}
+
+// duplicateReason returns why a location repeats the last one forwarded for
+// subTopic, or "" when it does not. OwnTracks resends retained and queued
+// locations as they were, and the same fix with the same tst.
+func duplicateReason(subTopic string, tst int64, sum uint64) string {
+	value, ok := running.lastForwarded.Load(subTopic)
+	if !ok {
+		return ""
+	}
+	last := value.(forwardedLocation)
+	switch {
+	case last.sum == sum:
+		return "identical payload"
+	case tst > 0 && last.tst == tst:
+		return "same tst"
+	}
+	return ""
+}
+
+// distanceMeters returns the great-circle distance between two coordinates.
+func distanceMeters(lat1, lon1, lat2, lon2 float64) float64 {
+	const earthRadius = 6371000.0
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+// bearingDegrees returns the initial compass bearing from the first to the
+// second coordinate, from 0 (north) to 359.
+func bearingDegrees(lat1, lon1, lat2, lon2 float64) int {
+	rad := math.Pi / 180
+	dLon := (lon2 - lon1) * rad
+	y := math.Sin(dLon) * math.Cos(lat2*rad)
+	x := math.Cos(lat1*rad)*math.Sin(lat2*rad) - math.Sin(lat1*rad)*math.Cos(lat2*rad)*math.Cos(dLon)
+	return (int(math.Round(math.Atan2(y, x)/rad)) + 360) % 360
+}
+
+// impliedSpeedKmh returns the speed needed to move from the last forwarded
+// location of subTopic to lat/lon by fix. It reports false without a
+// previous location or when the fixes are not in order.
+func impliedSpeedKmh(subTopic string, lat, lon float64, fix time.Time) (float64, bool) {
+	value, ok := running.lastForwarded.Load(subTopic)
+	if !ok {
+		return 0, false
+	}
+	last := value.(forwardedLocation)
+	elapsed := fix.Sub(last.fix)
+	if elapsed <= 0 {
+		return 0, false
+	}
+	return distanceMeters(last.lat, last.lon, lat, lon) / elapsed.Seconds() * 3.6, true
+}
+
+// fixTime returns when a location was recorded: its tst, or when it was
+// received for messages without one.
+func fixTime(source converter.Location, received time.Time) time.Time {
+	if source.Tst > 0 {
+		return time.Unix(source.Tst, 0)
+	}
+	return received
+}
+
+// throttleReason returns why a location update should be suppressed under
+// the mapping's min_distance_m and min_interval_s, or "" to forward it.
+func throttleReason(subTopic string, mapping config.Mapping, lat, lon float64, now time.Time) string {
+	value, ok := running.lastForwarded.Load(subTopic)
+	if !ok {
+		return ""
+	}
+	last := value.(forwardedLocation)
+	if mapping.MinIntervalS > 0 && now.Sub(last.at) < time.Duration(mapping.MinIntervalS)*time.Second {
+		return fmt.Sprintf("%s since the last update", now.Sub(last.at).Round(time.Second))
+	}
+	if mapping.MinDistanceM > 0 {
+		if moved := distanceMeters(last.lat, last.lon, lat, lon); moved < mapping.MinDistanceM {
+			return fmt.Sprintf("moved %.0f m", moved)
+		}
+	}
+	return ""
+}
+
+// triggerRule returns the first trigger rule of the mapping that names the
+// trigger of a location, by its letter or its name.
+func triggerRule(mapping config.Mapping, trigger string) (config.TriggerRule, bool) {
+	if trigger == "" {
+		return config.TriggerRule{}, false
+	}
+	name, _ := converter.TriggerName(trigger)
+	for _, rule := range mapping.TriggerRules {
+		if slices.Contains(rule.Triggers, trigger) || name != "" && slices.Contains(rule.Triggers, name) {
+			return rule, true
+		}
+	}
+	return config.TriggerRule{}, false
+}
+
+// connectionRule returns the first connection rule the location falls
+// under.
+func connectionRule(cfg *config.Config, source converter.Location) (config.ConnectionRule, bool) {
+	for _, rule := range cfg.ConnectionRules {
+		if rule.Conn == source.Conn && source.Acc > rule.AccuracyAbove {
+			return rule, true
+		}
+	}
+	return config.ConnectionRule{}, false
+}
+
+// quietReason returns why a location is suppressed by the quiet_hours of the
+// mapping, or "" to forward it. A window with min_interval_s lets one
+// location through per interval.
+func quietReason(subTopic string, mapping config.Mapping, now time.Time) string {
+	quiet, ok := mapping.QuietHoursAt(now)
+	if !ok {
+		return ""
+	}
+	if quiet.MinIntervalS <= 0 {
+		return fmt.Sprintf("quiet hours %s-%s", quiet.From, quiet.To)
+	}
+	value, ok := running.lastForwarded.Load(subTopic)
+	if !ok {
+		return ""
+	}
+	if elapsed := now.Sub(value.(forwardedLocation).at); elapsed < time.Duration(quiet.MinIntervalS)*time.Second {
+		return fmt.Sprintf("quiet hours %s-%s, %s since the last update", quiet.From, quiet.To, elapsed.Round(time.Second))
+	}
+	return ""
+}
+
+// quietHoursActive reports whether the mapping of a received topic, or of
+// its OwnTracks base topic, is in one of its quiet_hours windows.
+func quietHoursActive(cfg *config.Config, topic string, now time.Time) bool {
+	mapping, ok := cfg.MappingFor(cfg.MappingTopic(topic))
+	if !ok {
+		return false
+	}
+	_, active := mapping.QuietHoursAt(now)
+	return active
+}
+
+// handleTransition republishes an OwnTracks region enter/leave event to the
+// configured transition topic in a shape Home Assistant automations (and the
+// MQTT event entity) can consume.
+func handleTransition(subTopic string, data []byte) {
+	cfg := currentConfig()
+	if cfg.TransitionTopic == "" {
+		slog.Debug("Ignoring transition: transition_topic is not configured", "topic", subTopic)
+		return
+	}
+
+	transition, err := converter.ParseTransition(data)
+	if errors.Is(err, converter.ErrInvalidTransition) {
+		messagesRejected.inc("invalid_transition")
+		slog.Warn("Invalid transition received: unknown event", "topic", subTopic, "event", transition.Event)
+		publishDeadLetter(cfg, subTopic, "invalid_transition", data, err)
+		return
+	}
+	if err != nil {
+		messagesRejected.inc("bad_json")
+		slog.Warn("Error parsing transition JSON", "topic", subTopic, "error", err)
+		publishDeadLetter(cfg, subTopic, "bad_json", data, err)
+		return
+	}
+
+	filter, captures, ok := cfg.MatchMapping(subTopic)
+	if !ok {
+		messagesRejected.inc("missing_mapping")
+		slog.Warn("No mapping found for topic", "topic", subTopic)
+		publishDeadLetter(cfg, subTopic, "missing_mapping", data, nil)
+		return
+	}
+	pubTopic := config.ExpandTopic(cfg.TransitionTopic, subTopic, captures)
+
+	position, ok := transitionPosition(cfg, subTopic, cfg.AllMappings()[filter], transition)
+	if !ok {
+		return
+	}
+	event := converter.ConvertTransition(transition, converter.DeviceID(subTopic))
+	event.Latitude, event.Longitude, event.GPSAccuracy = position.Latitude, position.Longitude, position.GPSAccuracy
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("Error encoding JSON", "topic", subTopic, "error", err)
+		return
+	}
+
+	slog.Debug("Converted transition", "topic", subTopic, "mapping", filter, "target", pubTopic, "payload", string(payload))
+
+	err = publishTarget(pubTopic, byte(cfg.QoS), false, payload, subTopic)
+	switch {
+	case errors.Is(err, errBuffered):
+	case err != nil:
+		slog.Error("Failed to publish transition", "topic", subTopic, "target", pubTopic, "error", err)
+		publishDeadLetter(cfg, subTopic, "publish_failed", data, err)
+	default:
+		slog.Info("Published transition", "topic", subTopic, "target", pubTopic, "device", event.Device, "event", event.EventType, "region", event.Region)
+	}
+}
+
+// transitionPosition returns the position a region event is forwarded with:
+// rounded like that of locations, or dropped (false) or blurred by the
+// geofence rules of the mapping.
+func transitionPosition(cfg *config.Config, subTopic string, mapping config.Mapping, transition converter.Transition) (converter.HAPayload, bool) {
+	precision := cfg.CoordinatePrecisionFor(mapping)
+	position := converter.HAPayload{
+		Latitude:    converter.RoundCoordinate(transition.Lat, precision),
+		Longitude:   converter.RoundCoordinate(transition.Lon, precision),
+		GPSAccuracy: transition.Acc,
+	}
+	// A device entering a region is in it, as far as region_zones go.
+	source := converter.Location{Lat: transition.Lat, Lon: transition.Lon, Acc: transition.Acc}
+	if transition.Event == "enter" {
+		source.InRegions = []string{transition.Desc}
+	}
+	if rule, ok := geofenceRule(cfg, mapping, source); ok {
+		switch rule.Action {
+		case "drop":
+			messagesRejected.inc("geofence")
+			slog.Debug("Dropping transition by a geofence rule", "topic", subTopic, "zone", rule.Zone, "outside", rule.Outside)
+			return position, false
+		case "blur":
+			position.Latitude, position.Longitude, position.GPSAccuracy = blurPosition(rule, transition.Lat, transition.Lon, transition.Acc)
+		}
+	}
+	return position, true
+}
+
+// postTransition posts a region event to the webhook of the OwnTracks
+// integration, with its position as transitionPosition forwards it.
+func postTransition(cfg *config.Config, subTopic string, data []byte) {
+	transition, err := converter.ParseTransition(data)
+	if err != nil && !errors.Is(err, converter.ErrInvalidTransition) {
+		messagesRejected.inc("bad_json")
+		slog.Warn("Error parsing transition JSON", "topic", subTopic, "error", err)
+		publishDeadLetter(cfg, subTopic, "bad_json", data, err)
+		return
+	}
+	mapping, ok := cfg.MappingFor(subTopic)
+	if !ok {
+		messagesRejected.inc("missing_mapping")
+		slog.Warn("No mapping found for topic", "topic", subTopic)
+		publishDeadLetter(cfg, subTopic, "missing_mapping", data, nil)
+		return
+	}
+	position, ok := transitionPosition(cfg, subTopic, mapping, transition)
+	if !ok {
+		return
+	}
+	if err := postHomeAssistant(subTopic, position, data); err != nil {
+		slog.Error("Failed to post transition to Home Assistant", "topic", subTopic, "error", err)
+	}
+}
+
+// handleWaypoints publishes a retained zone definition for every region in
+// an OwnTracks waypoint or waypoints message, below the configured zones
+// topic.
+func handleWaypoints(subTopic string, data []byte) {
+	cfg := currentConfig()
+	if cfg.ZonesTopic == "" {
+		slog.Debug("Ignoring waypoints: zones_topic is not configured", "topic", subTopic)
+		return
+	}
+
+	waypoints, err := converter.ParseWaypoints(data)
+	if err != nil {
+		messagesRejected.inc("bad_json")
+		slog.Warn("Error parsing waypoints JSON", "topic", subTopic, "error", err)
+		publishDeadLetter(cfg, subTopic, "bad_json", data, err)
+		return
+	}
+
+	filter, captures, ok := cfg.MatchMapping(subTopic)
+	if !ok {
+		messagesRejected.inc("missing_mapping")
+		slog.Warn("No mapping found for topic", "topic", subTopic)
+		publishDeadLetter(cfg, subTopic, "missing_mapping", data, nil)
+		return
+	}
+	baseTopic := config.ExpandTopic(cfg.ZonesTopic, subTopic, captures)
+
+	for _, waypoint := range waypoints {
+		if waypoint.Lat == 0 && waypoint.Lon == 0 {
+			slog.Info("Skipping waypoint without coordinates (beacon regions are not zones)", "topic", subTopic, "region", waypoint.Desc)
+			continue
+		}
+		id := converter.ZoneID(waypoint)
+		if id == "" {
+			slog.Warn("Skipping waypoint without region id or name", "topic", subTopic)
+			continue
+		}
+
+		zone := converter.ConvertWaypoint(waypoint, converter.DeviceID(subTopic))
+		payload, err := json.Marshal(zone)
+		if err != nil {
+			slog.Error("Error encoding JSON", "topic", subTopic, "error", err)
+			continue
+		}
+
+		pubTopic := baseTopic + "/" + id
+		slog.Debug("Converted waypoint", "topic", subTopic, "mapping", filter, "target", pubTopic, "payload", string(payload))
+
+		err = publishTarget(pubTopic, byte(cfg.QoS), true, payload, subTopic)
+		switch {
+		case errors.Is(err, errBuffered):
+		case err != nil:
+			slog.Error("Failed to publish zone", "topic", subTopic, "target", pubTopic, "error", err)
+			publishDeadLetter(cfg, subTopic, "publish_failed", data, err)
+		default:
+			slog.Info("Published zone", "topic", subTopic, "target", pubTopic, "device", zone.Device, "region", zone.Name)
+		}
+	}
+}
+
+// messageHandler receives messages from the source broker and the HTTP
+// endpoint and hands them to the worker pool.
+func messageHandler(client MQTT.Client, msg MQTT.Message) {
+	<-running.ready
+	running.processingMu.RLock()
+	defer running.processingMu.RUnlock()
+	if running.shuttingDown.Load() {
+		return
+	}
+	if capture := running.messageCapture(); capture != nil {
+		capture.record(msg.Topic(), msg.Payload(), time.Now())
+	}
+	if workers := running.workers.Load(); workers != nil {
+		workers.submit(msg)
+		return
+	}
+	processMessage(msg)
+}
+
+// processMessage decrypts a message and dispatches it by its OwnTracks type.
+func processMessage(msg MQTT.Message) {
+	cfg := currentConfig()
+
+	if running.clients.shared() && isOwnTopic(cfg, msg.Topic()) {
+		slog.Debug("Ignoring the bridge's own output", "topic", msg.Topic())
+		return
+	}
+
+	received := time.Now()
+	if replayed, ok := msg.(replayMessage); ok && !replayed.received.IsZero() {
+		received = replayed.received
+	}
+	recordMessageTime(cfg, msg.Topic(), received)
+	messagesReceived.inc("")
+	if cfg.RunMode == "once" {
+		recordOnce(cfg, msg.Topic())
+	}
+	slog.Debug("Received message", "topic", msg.Topic(), "payload", string(msg.Payload()))
+
+	// A standby receives everything the leader does but publishes nothing
+	// until it takes over.
+	if !isLeader() {
+		messagesRejected.inc("standby")
+		slog.Debug("Standing by, not forwarding", "topic", msg.Topic())
+		return
+	}
+	if running.paused.Load() {
+		messagesRejected.inc("paused")
+		slog.Debug("Paused, not forwarding", "topic", msg.Topic())
+		return
+	}
+	if devicePaused(cfg, msg.Topic()) {
+		messagesRejected.inc("paused")
+		slog.Debug("Device paused, not forwarding", "topic", msg.Topic())
+		return
+	}
+	// Quiet hours hold back everything a device sends. Locations are checked
+	// in handleLocation, where min_interval_s and trigger rules may let them
+	// through.
+	quiet := quietHoursActive(cfg, msg.Topic(), received)
+	if filter, captures, ok := cfg.MatchMapping(msg.Topic()); ok && cfg.AllMappings()[filter].Passthrough {
+		if quiet {
+			messagesRejected.inc("quiet_hours")
+			slog.Debug("Suppressing message during quiet hours", "topic", msg.Topic())
+			return
+		}
+		handlePassthrough(cfg, msg, cfg.AllMappings()[filter], captures)
+		return
+	}
+
+	if !running.deviceLimiter.allow(cfg, msg.Topic(), received) {
+		messagesRejected.inc("rate_limited")
+		slog.Debug("Dropping message above the rate limit", "topic", msg.Topic(), "rate_limit_per_minute", cfg.RateLimitPerMinute)
+		return
+	}
+
+	data, err := converter.Decrypt(msg.Payload(), cfg.EncryptionKeyFor(msg.Topic()))
+	if err != nil {
+		messagesRejected.inc("decrypt_error")
+		slog.Warn("Error decrypting payload", "topic", msg.Topic(), "error", err)
+		publishDeadLetter(cfg, msg.Topic(), "decrypt_error", msg.Payload(), err)
+		return
+	}
+
+	messageType, err := converter.MessageType(data)
+	if err != nil {
+		messagesRejected.inc("bad_json")
+		slog.Warn("Error parsing JSON", "topic", msg.Topic(), "error", err)
+		publishDeadLetter(cfg, msg.Topic(), "bad_json", data, err)
+		return
+	}
+	// The last will only marks the device offline, which quiet hours do not
+	// hide.
+	if quiet && messageType != "location" && messageType != "" && messageType != "lwt" {
+		messagesRejected.inc("quiet_hours")
+		slog.Debug("Suppressing message during quiet hours", "topic", msg.Topic(), "type", messageType)
+		return
+	}
+
+	switch messageType {
+	// Payloads without _type are handled as locations, as before the type
+	// was checked.
+	case "location", "":
+		handleLocation(cfg, msg.Topic(), data, received)
+	case "transition":
+		if cfg.Output == "ha_rest" && cfg.HAWebhookID != "" {
+			// The OwnTracks integration handles region events itself.
+			postTransition(cfg, cfg.MappingTopic(msg.Topic()), data)
+			return
+		}
+		handleTransition(cfg.MappingTopic(msg.Topic()), data)
+	case "waypoint", "waypoints":
+		handleWaypoints(cfg.MappingTopic(msg.Topic()), data)
+	case "lwt":
+		handleLWT(cfg, msg.Topic())
+	case "card":
+		handleCard(cfg.MappingTopic(msg.Topic()), data)
+	case "beacon":
+		handleBeacon(cfg.MappingTopic(msg.Topic()), data)
+	case "status":
+		// App status reports have no Home Assistant counterpart.
+		messagesIgnored.inc(messageType)
+		slog.Debug("Ignoring OwnTracks message", "topic", msg.Topic(), "type", messageType)
+	default:
+		messagesIgnored.inc("unknown")
+		slog.Debug("Ignoring OwnTracks message of unknown type", "topic", msg.Topic(), "type", messageType)
+	}
+}
+
+// handleCard publishes the retained name and picture of an OwnTracks friend
+// card to the configured card topic.
+func handleCard(subTopic string, data []byte) {
+	cfg := currentConfig()
+	if cfg.CardTopic == "" {
+		messagesIgnored.inc("card")
+		slog.Debug("Ignoring card: card_topic is not configured", "topic", subTopic)
+		return
+	}
+
+	card, err := converter.ParseCard(data)
+	if err != nil {
+		messagesRejected.inc("bad_json")
+		slog.Warn("Error parsing card JSON", "topic", subTopic, "error", err)
+		publishDeadLetter(cfg, subTopic, "bad_json", data, err)
+		return
+	}
+
+	_, captures, ok := cfg.MatchMapping(subTopic)
+	if !ok {
+		messagesRejected.inc("missing_mapping")
+		slog.Warn("No mapping found for topic", "topic", subTopic)
+		publishDeadLetter(cfg, subTopic, "missing_mapping", data, nil)
+		return
+	}
+	cardTopic := config.ExpandTopic(cfg.CardTopic, subTopic, captures)
+
+	state := converter.ConvertCard(card, converter.DeviceID(subTopic))
+	payload, err := json.Marshal(state)
+	if err != nil {
+		slog.Error("Error encoding JSON", "topic", subTopic, "error", err)
+		return
+	}
+
+	if cfg.DiscoveryEnabled {
+		ensureCardDiscovery(subTopic, cardTopic, card.Face != "", converter.FaceContentType(card.Face))
+	}
+
+	err = publishTarget(cardTopic, byte(cfg.QoS), true, payload, subTopic)
+	switch {
+	case errors.Is(err, errBuffered):
+	case err != nil:
+		slog.Error("Failed to publish card", "topic", subTopic, "target", cardTopic, "error", err)
+		publishDeadLetter(cfg, subTopic, "publish_failed", data, err)
+		return
+	default:
+		slog.Info("Published card", "topic", subTopic, "target", cardTopic, "device", state.Device, "name", state.Name)
+	}
+
+	if card.Face == "" {
+		return
+	}
+	faceTopic := cardTopic + "/face"
+	if err := publishTarget(faceTopic, byte(cfg.QoS), true, []byte(card.Face), subTopic); err != nil && !errors.Is(err, errBuffered) {
+		slog.Error("Failed to publish card picture", "topic", subTopic, "target", faceTopic, "error", err)
+	}
+}
+
+// handleBeacon publishes the presence of a device in the room of a
+// configured iBeacon to beacon_topic, for the Home Assistant mqtt_room
+// sensor or ESPresense consumers. Beacons out of range publish nothing;
+// mqtt_room lets the device time out of the room.
+func handleBeacon(subTopic string, data []byte) {
+	cfg := currentConfig()
+	if cfg.BeaconTopic == "" {
+		messagesIgnored.inc("beacon")
+		slog.Debug("Ignoring beacon: beacon_topic is not configured", "topic", subTopic)
+		return
+	}
+
+	beacon, err := converter.ParseBeacon(data)
+	if err != nil {
+		messagesRejected.inc("bad_json")
+		slog.Warn("Error parsing beacon JSON", "topic", subTopic, "error", err)
+		publishDeadLetter(cfg, subTopic, "bad_json", data, err)
+		return
+	}
+
+	index := slices.IndexFunc(cfg.Beacons, func(b config.BeaconRoom) bool {
+		return b.Matches(beacon.UUID, beacon.Major, beacon.Minor)
+	})
+	if index < 0 {
+		messagesIgnored.inc("beacon")
+		slog.Debug("Ignoring unknown beacon", "topic", subTopic, "uuid", beacon.UUID, "major", beacon.Major, "minor", beacon.Minor)
+		return
+	}
+	room := cfg.Beacons[index].Room
+	distance, inRange := converter.BeaconDistance(beacon)
+	if !inRange {
+		messagesIgnored.inc("beacon")
+		slog.Debug("Ignoring beacon out of range", "topic", subTopic, "room", room)
+		return
+	}
+
+	_, captures, ok := cfg.MatchMapping(subTopic)
+	if !ok {
+		messagesRejected.inc("missing_mapping")
+		slog.Warn("No mapping found for topic", "topic", subTopic)
+		publishDeadLetter(cfg, subTopic, "missing_mapping", data, nil)
+		return
+	}
+	pubTopic := strings.ReplaceAll(config.ExpandTopic(cfg.BeaconTopic, subTopic, captures), "{room}", room)
+
+	presence := converter.ConvertBeacon(beacon, converter.DeviceID(subTopic), distance)
+	payload, err := json.Marshal(presence)
+	if err != nil {
+		slog.Error("Error encoding JSON", "topic", subTopic, "error", err)
+		return
+	}
+
+	err = publishTarget(pubTopic, byte(cfg.QoS), false, payload, subTopic)
+	switch {
+	case errors.Is(err, errBuffered):
+	case err != nil:
+		slog.Error("Failed to publish room presence", "topic", subTopic, "target", pubTopic, "error", err)
+		publishDeadLetter(cfg, subTopic, "publish_failed", data, err)
+	default:
+		slog.Info("Published room presence", "topic", subTopic, "target", pubTopic, "device", presence.ID, "room", room, "distance", distance)
+	}
+}
+
+// handlePassthrough forwards a message of a passthrough mapping unchanged.
+// The message keeps its retained flag, so retained state such as OwnTracks
+// waypoints is retained on the target as well.
+func handlePassthrough(cfg *config.Config, msg MQTT.Message, mapping config.Mapping, captures []string) {
+	subTopic := msg.Topic()
+	pubTopic := config.ExpandTopic(mapping.Target, subTopic, captures)
+	err := publishTarget(pubTopic, mapping.PublishQoS(cfg.QoS), mapping.Retain || msg.Retained(), msg.Payload(), subTopic)
+	switch {
+	case errors.Is(err, errBuffered):
+	case err != nil:
+		slog.Error("Failed to forward message", "topic", subTopic, "target", pubTopic, "error", err)
+		publishDeadLetter(cfg, subTopic, "publish_failed", msg.Payload(), err)
+	default:
+		slog.Debug("Forwarded message unchanged", "topic", subTopic, "target", pubTopic)
+	}
+}
+
+// handleLWT handles the last will OwnTracks registers with the broker, which
+// the broker publishes when the phone disconnects without saying goodbye. It
+// marks the device offline when availability_topic is set.
+func handleLWT(cfg *config.Config, subTopic string) {
+	slog.Info("Device went offline", "topic", subTopic, "device", converter.DeviceID(subTopic))
+	if cfg.AvailabilityTopic == "" || cfg.Output == "ha_rest" {
+		messagesIgnored.inc("lwt")
+		return
+	}
+	publishAvailability(cfg, subTopic, statusOffline)
+}
+
+// publishAvailability publishes the retained availability of a device to the
+// configured availability topic.
+func publishAvailability(cfg *config.Config, subTopic, state string) {
+	if previous, ok := running.deviceAvailability.Load(subTopic); ok && previous == state {
+		return
+	}
+	_, captures, _ := cfg.MatchMapping(subTopic)
+	availabilityTopic := config.ExpandTopic(cfg.AvailabilityTopic, subTopic, captures)
+
+	err := publishTarget(availabilityTopic, byte(cfg.QoS), true, []byte(state), subTopic)
+	switch {
+	case errors.Is(err, errBuffered):
+		running.deviceAvailability.Store(subTopic, state)
+	case err != nil:
+		slog.Error("Failed to publish device availability", "topic", subTopic, "target", availabilityTopic, "error", err)
+	default:
+		running.deviceAvailability.Store(subTopic, state)
+		slog.Debug("Published device availability", "topic", subTopic, "target", availabilityTopic, "state", state)
+	}
+}
+
+// handleLocation converts a location and forwards it to the target.
+func handleLocation(cfg *config.Config, subTopic string, data []byte, received time.Time) {
+	source, err := converter.ParseLocation(data)
+	if errors.Is(err, converter.ErrNullIsland) && cfg.AllowNullIsland {
+		err = nil
+	}
+	switch {
+	case errors.Is(err, converter.ErrNullIsland):
+		messagesRejected.inc("null_island")
+		slog.Warn("Invalid data received: location at latitude 0, longitude 0", "topic", subTopic)
+		publishDeadLetter(cfg, subTopic, "null_island", data, err)
+		return
+	case errors.Is(err, converter.ErrInvalidCoordinates):
+		messagesRejected.inc("invalid_coords")
+		slog.Warn("Invalid data received: missing latitude or longitude", "topic", subTopic)
+		publishDeadLetter(cfg, subTopic, "invalid_coords", data, err)
+		return
+	case err != nil:
+		messagesRejected.inc("bad_json")
+		slog.Warn("Error parsing JSON", "topic", subTopic, "error", err)
+		publishDeadLetter(cfg, subTopic, "bad_json", data, err)
+		return
+	}
+
+	sum := payloadSum(data)
+	if cfg.DropDuplicatesEnabled() {
+		if reason := duplicateReason(subTopic, source.Tst, sum); reason != "" {
+			messagesRejected.inc("duplicate")
+			slog.Debug("Dropping duplicate location", "topic", subTopic, "reason", reason, "tst", source.Tst)
+			return
+		}
+	}
+
+	pubTopic, exists := cfg.ResolveMapping(subTopic)
+	if !exists {
+		messagesRejected.inc("missing_mapping")
+		slog.Warn("No mapping found for topic", "topic", subTopic)
+		publishDeadLetter(cfg, subTopic, "missing_mapping", data, nil)
+		return
+	}
+	mapping, _ := cfg.MappingFor(subTopic)
+	converted := converter.ConvertLocation(source, data, converter.Options{
+		PassthroughFields:   cfg.PassthroughFieldsFor(mapping),
+		Units:               cfg.Units,
+		CoordinatePrecision: cfg.CoordinatePrecisionFor(mapping),
+		PressureUnit:        cfg.PressureUnit,
+		SeaLevelPressure:    cfg.SeaLevelPressureHPa,
+	})
+	// Static attributes go first, so the attributes the bridge computes
+	// below win over them.
+	for key, value := range mapping.StaticAttributes {
+		converted.SetAttribute(key, value)
+	}
+
+	// A known WiFi network places the phone however poor its fix, so such
+	// locations are flagged rather than dropped.
+	_, onWiFi := wifiZone(cfg, source)
+	if limit := cfg.MaxGPSAccuracyFor(subTopic); limit > 0 && source.Acc > limit {
+		if cfg.GPSAccuracyAction != "flag" && !onWiFi {
+			messagesRejected.inc("low_accuracy")
+			slog.Info("Dropping location above the accuracy limit", "topic", subTopic, "accuracy", source.Acc, "limit", limit)
+			return
+		}
+		converted.SetAttribute("gps_accuracy_exceeded", true)
+	}
+	if rule, ok := connectionRule(cfg, source); ok {
+		if rule.Action == "drop" {
+			messagesRejected.inc("connection_rule")
+			slog.Info("Dropping location by a connection rule", "topic", subTopic, "conn", source.Conn, "accuracy", source.Acc, "accuracy_above", rule.AccuracyAbove)
+			return
+		}
+		converted.SetAttribute("gps_accuracy_exceeded", true)
+	}
+
+	if cfg.MaxAgeSeconds > 0 && source.Tst > 0 {
+		if age := received.Sub(time.Unix(source.Tst, 0)); age > time.Duration(cfg.MaxAgeSeconds)*time.Second {
+			if cfg.StaleAction != "flag" {
+				messagesRejected.inc("stale")
+				slog.Info("Dropping stale location", "topic", subTopic, "age", age.Round(time.Second), "max_age_seconds", cfg.MaxAgeSeconds)
+				return
+			}
+			converted.SetAttribute("stale", true)
+		}
+	}
+
+	fix := fixTime(source, received)
+	if cfg.MaxSpeedKmh > 0 {
+		if speed, ok := impliedSpeedKmh(subTopic, source.Lat, source.Lon, fix); ok && speed > cfg.MaxSpeedKmh {
+			messagesRejected.inc("impossible_speed")
+			slog.Info("Dropping location implying an impossible speed", "topic", subTopic, "speed_kmh", math.Round(speed), "max_speed_kmh", cfg.MaxSpeedKmh)
+			return
+		}
+	}
+
+	if reason := filterReason(subTopic, source); reason != "" {
+		messagesRejected.inc(reason)
+		slog.Debug("Dropping location rejected by a filter", "topic", subTopic, "filter", reason)
+		return
+	}
+
+	if cfg.Smoothing {
+		noise := cfg.SmoothingProcessNoise
+		if noise <= 0 {
+			noise = 3
+		}
+		source.Lat, source.Lon = smoothPosition(subTopic, source.Lat, source.Lon, source.Acc, fix, noise)
+		precision := cfg.CoordinatePrecisionFor(mapping)
+		converted.Latitude = converter.RoundCoordinate(source.Lat, precision)
+		converted.Longitude = converter.RoundCoordinate(source.Lon, precision)
+	}
+
+	trigger, hasTriggerRule := triggerRule(mapping, source.Trigger)
+	if hasTriggerRule && trigger.Action == "drop" {
+		messagesRejected.inc("trigger")
+		slog.Debug("Dropping location by its trigger", "topic", subTopic, "trigger", source.Trigger)
+		return
+	}
+	throttled := mapping
+	if hasTriggerRule && trigger.MinIntervalS > 0 {
+		throttled.MinIntervalS = trigger.MinIntervalS
+	}
+
+	if !hasTriggerRule || trigger.Action != "forward" {
+		if reason := quietReason(subTopic, mapping, received); reason != "" {
+			messagesRejected.inc("quiet_hours")
+			slog.Debug("Suppressing location during quiet hours", "topic", subTopic, "reason", reason)
+			return
+		}
+
+		if reason := throttleReason(subTopic, throttled, source.Lat, source.Lon, received); reason != "" {
+			messagesRejected.inc("throttled")
+			slog.Debug("Suppressing location update", "topic", subTopic, "reason", reason)
+			return
+		}
+	}
+
+	if locationNameEnabled(cfg) {
+		// A region the phone reports wins over its WiFi network, which wins
+		// over the zone of its coordinates.
+		name, inZone := regionZone(cfg, source.InRegions)
+		if !inZone {
+			name, inZone = wifiZone(cfg, source)
+		}
+		if !inZone && zonesEnabled(cfg) {
+			name, inZone = zoneAt(source.Lat, source.Lon)
+		}
+		if inZone {
+			converted.SetAttribute("zone", name)
+		} else {
+			name = notHome
+		}
+		converted.SetAttribute("location_name", name)
+		trackZone(cfg, subTopic, name, received)
+	}
+
+	// Geofence rules see the exact position; the rounding and the blur apply
+	// to everything computed from the forwarded coordinates below. forwarded
+	// and raw are the location and message the outputs, scripts and history
+	// get.
+	forwarded, raw := source, data
+	if cfg.CoordinatePrecisionFor(mapping) > 0 {
+		forwarded.Lat, forwarded.Lon = converted.Latitude, converted.Longitude
+		raw = withPosition(data, forwarded)
+	}
+	if rule, ok := geofenceRule(cfg, mapping, source); ok {
+		switch rule.Action {
+		case "drop":
+			messagesRejected.inc("geofence")
+			slog.Debug("Dropping location by a geofence rule", "topic", subTopic, "zone", rule.Zone, "outside", rule.Outside)
+			return
+		case "blur":
+			converted.Latitude, converted.Longitude, converted.GPSAccuracy = blurPosition(rule, source.Lat, source.Lon, converted.GPSAccuracy)
+			// Passing lat and lon through would forward the exact position.
+			delete(converted.Attributes, "lat")
+			delete(converted.Attributes, "lon")
+			forwarded.Lat, forwarded.Lon, forwarded.Acc = converted.Latitude, converted.Longitude, converted.GPSAccuracy
+			raw = withPosition(data, forwarded)
+		}
+	}
+
+	if homeLat, homeLon, ok := homeLocation(cfg); ok {
+		converted.SetAttribute("distance_from_home_m", int(math.Round(distanceMeters(homeLat, homeLon, converted.Latitude, converted.Longitude))))
+		converted.SetAttribute("bearing_from_home", bearingDegrees(homeLat, homeLon, converted.Latitude, converted.Longitude))
+	}
+
+	if cfg.GeocoderURL != "" {
+		// Geocode the forwarded coordinates, so a rounded location does not
+		// get its exact address back.
+		result, err := running.reverseGeocoder.lookup(cfg, converted.Latitude, converted.Longitude)
+		if err != nil {
+			slog.Warn("Reverse geocoding failed, publishing without an address", "topic", subTopic, "error", err)
+		} else {
+			converted.SetAttribute("address", result.Address)
+			converted.SetAttribute("locality", result.Locality)
+		}
+	}
+
+	if slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		raw, _ := json.Marshal(source)
+		conv, _ := json.Marshal(converted)
+		slog.Debug("Converted location", "topic", subTopic, "target", pubTopic, "original", string(raw), "converted", string(conv))
+	}
+
+	payload, err := json.Marshal(converted)
+	if err == nil {
+		payload, err = converter.ApplyFieldOverrides(payload, mapping.RenameFields, mapping.DropFields)
+	}
+	if err != nil {
+		messagesRejected.inc("encode_error")
+		slog.Error("Error encoding JSON", "topic", subTopic, "error", err)
+		publishDeadLetter(cfg, subTopic, "encode_error", raw, err)
+		return
+	}
+
+	// A transform script replaces the payload and may change the topic,
+	// drop the location or publish more messages after the first.
+	var extra []script.Result
+	if transform := scriptFor(mapping); transform != nil {
+		results, err := transform.Transform(subTopic, raw, payload)
+		if err != nil {
+			messagesRejected.inc("script_error")
+			slog.Error("Transform script failed", "topic", subTopic, "script", mapping.Script, "error", err)
+			publishDeadLetter(cfg, subTopic, "script_error", raw, err)
+			return
+		}
+		if len(results) == 0 {
+			messagesRejected.inc("script_dropped")
+			slog.Debug("Transform script dropped the location", "topic", subTopic, "script", mapping.Script)
+			return
+		}
+		if results[0].Topic != "" {
+			pubTopic = results[0].Topic
+		}
+		payload, extra = results[0].Payload, results[1:]
+	}
+	messagesConverted.inc("")
+
+	sendOutputs(plugin.Location{SourceTopic: subTopic, TargetTopic: pubTopic, Payload: payload, Source: forwarded, Received: received})
+
+	if cfg.Output == "ha_rest" {
+		err := postHomeAssistant(subTopic, converted, raw)
+		if err != nil {
+			slog.Error("Failed to post location to Home Assistant", "topic", subTopic, "error", err)
+			publishDeadLetter(cfg, subTopic, "publish_failed", raw, err)
+			return
+		}
+		running.lastForwarded.Store(subTopic, forwardedLocation{lat: source.Lat, lon: source.Lon, shownLat: forwarded.Lat, shownLon: forwarded.Lon, at: received, fix: fix, tst: source.Tst, sum: sum})
+		recordHistory(subTopic, forwarded, raw, received)
+		slog.Info("Posted location to Home Assistant", "topic", subTopic, "device", converter.DeviceID(subTopic), "latency", time.Since(received))
+		return
+	}
+
+	if cfg.DiscoveryEnabled {
+		ensureDiscovery(subTopic, pubTopic, mapping.OutputStyle)
+	}
+
+	// The state_attributes style splits the location over the state and
+	// attributes topics of an MQTT device tracker.
+	baseTopic := pubTopic
+	if mapping.OutputStyle == "state_attributes" {
+		pubTopic = baseTopic + "/attributes"
+		if state, ok := converted.Attributes["location_name"].(string); ok {
+			stateTopic := baseTopic + "/state"
+			stateMsg := pendingMessage{topic: stateTopic, qos: mapping.PublishQoS(cfg.QoS), retained: mapping.Retain, payload: []byte(state), tst: source.Tst, sourceTopic: subTopic}
+			if err := publishPending(stateMsg); err != nil && !errors.Is(err, errBuffered) {
+				slog.Error("Failed to publish location state", "topic", subTopic, "target", stateTopic, "error", err)
+			}
+		}
+	}
+
+	err = publishPending(pendingMessage{topic: pubTopic, qos: mapping.PublishQoS(cfg.QoS), retained: mapping.Retain, payload: payload, tst: source.Tst, sourceTopic: subTopic})
+	if err == nil || errors.Is(err, errBuffered) {
+		running.lastForwarded.Store(subTopic, forwardedLocation{lat: source.Lat, lon: source.Lon, shownLat: forwarded.Lat, shownLon: forwarded.Lon, at: received, fix: fix, tst: source.Tst, sum: sum})
+		recordHistory(subTopic, forwarded, raw, received)
+	}
+	switch {
+	case errors.Is(err, errBuffered):
+	case err != nil:
+		slog.Error("Failed to publish message", "topic", subTopic, "target", pubTopic, "error", err)
+		publishDeadLetter(cfg, subTopic, "publish_failed", raw, err)
+	default:
+		slog.Info("Published location", "topic", subTopic, "target", pubTopic, "device", converter.DeviceID(subTopic), "latency", time.Since(received))
+	}
+	for _, result := range extra {
+		topic := result.Topic
+		if topic == "" {
+			topic = pubTopic
+		}
+		if err := publishTarget(topic, mapping.PublishQoS(cfg.QoS), mapping.Retain, result.Payload, subTopic); err != nil && !errors.Is(err, errBuffered) {
+			slog.Error("Failed to publish message", "topic", subTopic, "target", topic, "error", err)
+		}
+	}
+
+	if cfg.AvailabilityTopic != "" {
+		publishAvailability(cfg, subTopic, statusOnline)
+	}
+
+	if cfg.BatteryTopic != "" && (source.Batt > 0 || source.BS > 0) {
+		publishBattery(subTopic, source, mapping)
+	}
+}
+
+// blurPosition rounds a position to the precision of a blur rule and widens
+// its accuracy to the rounding, so Home Assistant does not draw a precise
+// circle around the blurred position.
+func blurPosition(rule config.GeofenceRule, lat, lon float64, acc int) (float64, float64, int) {
+	precision := rule.BlurPrecision()
+	if blur := int(111000 / math.Pow10(precision) / 2); acc < blur {
+		acc = blur
+	}
+	return converter.RoundCoordinate(lat, precision), converter.RoundCoordinate(lon, precision), acc
+}
+
+// withPosition returns an OwnTracks message with the position and accuracy
+// of location, so a rounded or blurred location does not keep its exact
+// position in the message handed on with it.
+func withPosition(data []byte, location converter.Location) []byte {
+	var message map[string]interface{}
+	if err := json.Unmarshal(data, &message); err != nil {
+		return nil
+	}
+	message["lat"], message["lon"], message["acc"] = location.Lat, location.Lon, location.Acc
+	position, err := json.Marshal(message)
+	if err != nil {
+		return nil
+	}
+	return position
+}
+
+// publishBattery publishes the retained battery state of a device to the
+// configured battery topic, announcing its sensors first when discovery is
+// enabled.
+func publishBattery(subTopic string, source converter.Location, mapping config.Mapping) {
+	cfg := currentConfig()
+	_, captures, _ := cfg.MatchMapping(subTopic)
+	batteryTopic := config.ExpandTopic(cfg.BatteryTopic, subTopic, captures)
+
+	payload, err := json.Marshal(converter.ConvertBattery(source))
+	if err != nil {
+		slog.Error("Error encoding JSON", "topic", subTopic, "error", err)
+		return
+	}
+
+	if cfg.DiscoveryEnabled {
+		ensureBatteryDiscovery(subTopic, batteryTopic)
+	}
+
+	err = publishTarget(batteryTopic, mapping.PublishQoS(cfg.QoS), true, payload, subTopic)
+	switch {
+	case errors.Is(err, errBuffered):
+	case err != nil:
+		slog.Error("Failed to publish battery state", "topic", subTopic, "target", batteryTopic, "error", err)
+	default:
+		slog.Debug("Published battery state", "topic", subTopic, "target", batteryTopic, "payload", string(payload))
+	}
+}
+
+// recordHistory stores a forwarded location in the location history.
+func recordHistory(subTopic string, source converter.Location, data []byte, received time.Time) {
+	entry := history.Entry{
+		Topic:    subTopic,
+		Time:     fixTime(source, received),
+		Received: received,
+		Lat:      source.Lat,
+		Lon:      source.Lon,
+		Payload:  data,
+	}
+	recorder, exporter, store := running.locationHistory()
+	if recorder != nil {
+		if err := recorder.Record(entry); err != nil {
+			slog.Warn("Failed to record location history", "topic", subTopic, "error", err)
+		}
+	}
+	if exporter != nil {
+		if err := exporter.Add(entry); err != nil {
+			slog.Warn("Failed to export location to the track file", "topic", subTopic, "error", err)
+		}
+	}
+	if store != nil {
+		if err := store.Write(entry); err != nil {
+			slog.Warn("Failed to write location to the Recorder store", "topic", subTopic, "error", err)
+		}
+	}
+}
+
+// isOwnTopic reports whether topic is one the bridge publishes to.
+func isOwnTopic(cfg *config.Config, topic string) bool {
+	if topic == cfg.StatusTopic || topic == cfg.StatsTopic || cfg.CommandTopic != "" && topic == cfg.CommandTopic+"/response" {
+		return true
+	}
+	_, own := running.ownTopics.Load(topic)
+	return own
+}
@@ -0,0 +1,159 @@
+package bridge
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"owntracks2ha/internal/config"
+	"owntracks2ha/internal/history"
+)
+
+// stallWindow is how long queued messages may wait without any being
+// processed before the bridge reports itself unhealthy.
+const stallWindow = time.Minute
+
+// healthStatus is the body of the health endpoint.
+type healthStatus struct {
+	Healthy         bool            `json:"healthy"`
+	SourceConnected *bool           `json:"source_connected,omitempty"`
+	TargetConnected *bool           `json:"target_connected,omitempty"`
+	Sources         map[string]bool `json:"sources,omitempty"`
+	Targets         map[string]bool `json:"targets,omitempty"`
+	Leader          *bool           `json:"leader,omitempty"`
+	Processing      bool            `json:"processing"`
+	LastMessage     *time.Time      `json:"last_message,omitempty"`
+}
+
+// checkHealth reports whether the brokers the bridge uses are connected and
+// the workers are processing messages.
+func checkHealth() healthStatus {
+	status := healthStatus{Healthy: true, Processing: true}
+	if sourceClient := running.clients.source(); sourceClient != nil {
+		connected := sourceClient.IsConnected()
+		status.SourceConnected = &connected
+		status.Healthy = status.Healthy && connected
+	}
+	for _, source := range running.clients.extraSources() {
+		if status.Sources == nil {
+			status.Sources = map[string]bool{}
+		}
+		connected := source.client.IsConnectionOpen()
+		status.Sources[source.name] = connected
+		status.Healthy = status.Healthy && connected
+	}
+	if targetClient := running.clients.target(); targetClient != nil {
+		connected := targetClient.IsConnected()
+		status.TargetConnected = &connected
+		status.Healthy = status.Healthy && connected
+	}
+	for _, target := range running.clients.extraTargets() {
+		if status.Targets == nil {
+			status.Targets = map[string]bool{}
+		}
+		connected := target.client.IsConnectionOpen()
+		status.Targets[target.name] = connected
+		status.Healthy = status.Healthy && connected
+	}
+	if running.election.Load() != nil {
+		leader := isLeader()
+		status.Leader = &leader
+	}
+	if workers := running.workers.Load(); workers != nil && workers.stalled(stallWindow) {
+		status.Processing = false
+		status.Healthy = false
+	}
+	if nanos := running.lastMessage.Load(); nanos > 0 {
+		last := time.Unix(0, nanos)
+		status.LastMessage = &last
+	}
+	return status
+}
+
+// serveHealth serves the health status on /healthz: 200 when healthy and
+// 503 otherwise.
+func serveHealth(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		status := checkHealth()
+		w.Header().Set("Content-Type", "application/json")
+		if !status.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(status)
+	})
+
+	slog.Info("Serving health checks", "address", addr, "path", "/healthz")
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		slog.Error("Health server failed", "error", err)
+	}
+}
+
+// serveRecorderAPI serves the OwnTracks Recorder HTTP API from the location
+// history.
+func serveRecorderAPI(addr string, recorder *history.Recorder) {
+	slog.Info("Serving the Recorder API", "address", addr, "path", "/api/0/")
+	if err := http.ListenAndServe(addr, history.APIHandler(recorder)); err != nil {
+		slog.Error("Recorder API server failed", "error", err)
+	}
+}
+
+// HealthCommand runs "owntracks2ha healthcheck", which asks a running bridge
+// whether it is healthy, and returns the exit code: 0 when healthy, 1 when
+// not or when it cannot be reached.
+func HealthCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("healthcheck", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	configPath := flags.String("config", "config/config.yaml", "path to the config file (YAML, JSON or TOML)")
+	configFormat := flags.String("config-format", "", "config file format: yaml, json or toml (defaults to the file extension)")
+	addr := flags.String("addr", "", "health address of the bridge (defaults to health_listen from the config)")
+	timeout := flags.Duration("timeout", 5*time.Second, "how long to wait for the bridge to answer")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if *addr == "" {
+		cfg, err := config.ReadFormat(*configPath, *configFormat)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		*addr = cfg.HealthListen
+	}
+	if *addr == "" {
+		fmt.Fprintln(stderr, "no health endpoint: set health_listen in the config or pass -addr")
+		return 1
+	}
+
+	client := http.Client{Timeout: *timeout}
+	resp, err := client.Get("http://" + dialAddress(*addr) + "/healthz")
+	if err != nil {
+		fmt.Fprintf(stderr, "health check failed: %v\n", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	stdout.Write(body)
+	if resp.StatusCode != http.StatusOK {
+		return 1
+	}
+	return 0
+}
+
+// dialAddress turns a listen address such as ":8081" or "0.0.0.0:8081" into
+// one to connect to on the local host.
+func dialAddress(listen string) string {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return listen
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
+}
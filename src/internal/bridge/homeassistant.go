@@ -0,0 +1,124 @@
+package bridge
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"owntracks2ha/converter"
+)
+
+var homeAssistantClient = http.Client{Timeout: 10 * time.Second}
+
+// seeRequest is the device_tracker.see service call for a location.
+type seeRequest struct {
+	DevID        string                 `json:"dev_id"`
+	GPS          [2]float64             `json:"gps"`
+	GPSAccuracy  int                    `json:"gps_accuracy"`
+	Battery      int                    `json:"battery,omitempty"`
+	LocationName string                 `json:"location_name,omitempty"`
+	Attributes   map[string]interface{} `json:"attributes,omitempty"`
+}
+
+// postHomeAssistant delivers a location through the Home Assistant REST API
+// instead of MQTT. With ha_webhook_id set the OwnTracks payload goes to the
+// webhook of the OwnTracks integration, carrying the converted coordinates,
+// accuracy and attributes; otherwise the converted location is passed to the
+// device_tracker.see service.
+func postHomeAssistant(subTopic string, converted converter.HAPayload, original []byte) error {
+	cfg := currentConfig()
+	parts := strings.Split(subTopic, "/")
+	user, device := parts[0], parts[len(parts)-1]
+	if len(parts) > 1 {
+		user = parts[len(parts)-2]
+	}
+
+	endpoint := strings.TrimSuffix(cfg.HAURL, "/")
+	var body []byte
+	if cfg.HAWebhookID != "" {
+		endpoint += "/api/webhook/" + url.PathEscape(cfg.HAWebhookID)
+		var err error
+		if body, err = webhookBody(converted, original); err != nil {
+			return err
+		}
+	} else {
+		endpoint += "/api/services/device_tracker/see"
+		attributes := map[string]interface{}{"altitude": converted.Altitude}
+		for key, value := range converted.Attributes {
+			attributes[key] = value
+		}
+		// A zone resolved by the bridge sets the device state directly.
+		locationName, _ := converted.Attributes["location_name"].(string)
+		var err error
+		body, err = json.Marshal(seeRequest{
+			DevID:        strings.ToLower(strings.ReplaceAll(converter.DeviceID(subTopic), "-", "_")),
+			GPS:          [2]float64{converted.Latitude, converted.Longitude},
+			GPSAccuracy:  converted.GPSAccuracy,
+			Battery:      converted.Battery,
+			LocationName: locationName,
+			Attributes:   attributes,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if running.dryRun() {
+		slog.Info("[DRY-RUN] Would post to Home Assistant", "url", endpoint, "payload", string(body))
+		return nil
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if cfg.HAToken != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.HAToken)
+	}
+	// The OwnTracks integration names the device after these headers.
+	req.Header.Set("X-Limit-U", user)
+	req.Header.Set("X-Limit-D", device)
+
+	resp, err := homeAssistantClient.Do(req)
+	if err != nil {
+		publishes.inc("failure")
+		notePublishResult(err)
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		publishes.inc("failure")
+		err := fmt.Errorf("home assistant returned %s", resp.Status)
+		notePublishResult(err)
+		return err
+	}
+	publishes.inc("success")
+	notePublishResult(nil)
+	return nil
+}
+
+// webhookBody is the original OwnTracks message with the coordinates and
+// accuracy of the converted location and its attributes, so rounding,
+// smoothing and geofence blurring reach the OwnTracks integration as they
+// reach MQTT. The OwnTracks fields win over attributes of the same name.
+func webhookBody(converted converter.HAPayload, original []byte) ([]byte, error) {
+	message := map[string]interface{}{}
+	for key, value := range converted.Attributes {
+		message[key] = value
+	}
+	if err := json.Unmarshal(original, &message); err != nil {
+		return nil, err
+	}
+	message["lat"] = converted.Latitude
+	message["lon"] = converted.Longitude
+	message["acc"] = converted.GPSAccuracy
+	return json.Marshal(message)
+}
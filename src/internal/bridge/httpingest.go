@@ -0,0 +1,169 @@
+package bridge
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"owntracks2ha/converter"
+)
+
+// httpMessage adapts an OwnTracks HTTP post to MQTT.Message so that it goes
+// through messageHandler like a message from the source broker.
+type httpMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (m httpMessage) Duplicate() bool   { return false }
+func (m httpMessage) Qos() byte         { return 0 }
+func (m httpMessage) Retained() bool    { return false }
+func (m httpMessage) Topic() string     { return m.topic }
+func (m httpMessage) MessageID() uint16 { return 0 }
+func (m httpMessage) Payload() []byte   { return m.payload }
+func (m httpMessage) Ack()              {}
+
+// serveHTTPIngest accepts OwnTracks HTTP mode posts
+// (https://owntracks.org/booklet/tech/http/) on path, /pub by default, and
+// GPSLogger or OsmAnd style locations on getPath when set.
+func serveHTTPIngest(addr, path, getPath string) {
+	if path == "" {
+		path = "/pub"
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, handleHTTPIngest)
+	if getPath != "" {
+		mux.HandleFunc(getPath, handleQueryIngest)
+		slog.Info("Accepting GPSLogger and OsmAnd locations", "address", addr, "path", getPath)
+	}
+
+	slog.Info("Accepting OwnTracks HTTP posts", "address", addr, "path", path)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		slog.Error("OwnTracks HTTP server failed", "error", err)
+		os.Exit(exitFailure)
+	}
+}
+
+// handleHTTPIngest converts one OwnTracks HTTP post. The post is handled as
+// a message on owntracks/<user>/<device>, with user and device taken from the
+// X-Limit-U and X-Limit-D headers (or the u and d query parameters), so it
+// resolves through the same mappings as messages from the source broker.
+func handleHTTPIngest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	authUser, ok := httpAuthorized(w, r)
+	if !ok {
+		return
+	}
+
+	user := r.Header.Get("X-Limit-U")
+	if user == "" {
+		user = r.URL.Query().Get("u")
+	}
+	if user == "" {
+		user = authUser
+	}
+	device := r.Header.Get("X-Limit-D")
+	if device == "" {
+		device = r.URL.Query().Get("d")
+	}
+	if user == "" || device == "" || strings.ContainsAny(user+device, "/+#") {
+		http.Error(w, "missing or invalid user or device", http.StatusBadRequest)
+		return
+	}
+
+	payload, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+
+	messageHandler(nil, httpMessage{topic: "owntracks/" + user + "/" + device, payload: payload})
+
+	// OwnTracks expects a JSON array of messages to deliver to the phone.
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte("[]"))
+}
+
+// httpAuthorized checks the basic auth of a request against http_user and
+// http_pass when either is set, answering 401 when it does not match, and
+// returns the user it carried.
+func httpAuthorized(w http.ResponseWriter, r *http.Request) (string, bool) {
+	cfg := currentConfig()
+	authUser, authPass, hasAuth := r.BasicAuth()
+	if cfg.HTTPUser != "" || cfg.HTTPPass != "" {
+		if !hasAuth || subtle.ConstantTimeCompare([]byte(authUser), []byte(cfg.HTTPUser)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(authPass), []byte(cfg.HTTPPass)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="owntracks2ha"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return "", false
+		}
+	}
+	return authUser, true
+}
+
+// handleQueryIngest converts a location sent as URL parameters (or a form
+// post) by GPSLogger, OsmAnd or a similar tracker into an OwnTracks location
+// on owntracks/<user>/<device>. The device comes from the id, deviceid or d
+// parameter and the user from u or the basic auth user, defaulting to the
+// device.
+func handleQueryIngest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	authUser, ok := httpAuthorized(w, r)
+	if !ok {
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid parameters", http.StatusBadRequest)
+		return
+	}
+
+	device := firstValue(r.Form, "id", "deviceid", "d")
+	user := firstValue(r.Form, "u", "user")
+	if user == "" {
+		user = authUser
+	}
+	if user == "" {
+		user = device
+	}
+	if device == "" || strings.ContainsAny(user+device, "/+#") {
+		http.Error(w, "missing or invalid user or device", http.StatusBadRequest)
+		return
+	}
+
+	location, err := converter.ParseQuery(r.Form)
+	if err != nil && !errors.Is(err, converter.ErrNullIsland) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	payload, err := json.Marshal(location)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Null island is left to the mappings' filters, like from OwnTracks.
+	messageHandler(nil, httpMessage{topic: "owntracks/" + user + "/" + device, payload: payload})
+	w.Write([]byte("OK"))
+}
+
+func firstValue(values url.Values, names ...string) string {
+	for _, name := range names {
+		if value := values.Get(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
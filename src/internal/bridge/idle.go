@@ -0,0 +1,122 @@
+package bridge
+
+import (
+	"log/slog"
+	"time"
+
+	"owntracks2ha/internal/config"
+)
+
+// recordMessageTime notes that a message arrived on topic.
+func recordMessageTime(cfg *config.Config, topic string, received time.Time) {
+	running.lastMessage.Store(received.UnixNano())
+	if filter, _, ok := cfg.MatchMapping(cfg.MappingTopic(topic)); ok {
+		running.lastFilterMessage.Store(filter, received)
+		lastMessageSeconds.set(filter, float64(received.Unix()))
+		mappingMessages.inc(filter)
+	}
+}
+
+// idleAction returns what the idle watchdog does after idle_timeout_seconds
+// without messages, or "" when it is disabled. exit_on_idle alone keeps
+// exiting, as it always did; see watchIdle.
+func idleAction(cfg *config.Config) string {
+	if cfg.IdleTimeoutSeconds <= 0 {
+		return ""
+	}
+	if cfg.IdleAction != "" {
+		return cfg.IdleAction
+	}
+	if cfg.ExitOnIdle {
+		return "exit"
+	}
+	return ""
+}
+
+// watchIdle checks every mapping filter for messages within the idle
+// timeout and runs the idle action for the ones that went silent. A filter
+// is idle again only a full timeout after the action, so reconnect and warn
+// do not repeat on every check. exit_on_idle without an idle_action exits
+// only when no message at all arrived within the timeout, as it always did,
+// so one quiet device does not stop the bridge for the others.
+func watchIdle() {
+	start := time.Now()
+	for range time.Tick(5 * time.Second) {
+		checkIdle(start)
+	}
+}
+
+// checkIdle runs one check of watchIdle, for a bridge started at start.
+func checkIdle(start time.Time) {
+	cfg := currentConfig()
+	action := idleAction(cfg)
+	if action == "" {
+		return
+	}
+	timeout := time.Duration(cfg.IdleTimeoutSeconds) * time.Second
+
+	if cfg.IdleAction == "" {
+		last := time.Unix(0, running.lastMessage.Load())
+		if last.Before(start) {
+			last = start
+		}
+		if time.Since(last) > timeout {
+			idleTimeouts.inc("")
+			slog.Info("No messages received within the idle timeout, exiting", "idle_timeout_seconds", cfg.IdleTimeoutSeconds)
+			shutdown(exitIdleTimeout)
+		}
+		return
+	}
+
+	var idle []string
+	for filter := range cfg.AllMappings() {
+		value, _ := running.lastFilterMessage.LoadOrStore(filter, start)
+		if time.Since(value.(time.Time)) > timeout {
+			idle = append(idle, filter)
+			running.lastFilterMessage.Store(filter, time.Now())
+			idleTimeouts.inc(filter)
+		}
+	}
+	if len(idle) == 0 {
+		return
+	}
+
+	switch action {
+	case "exit":
+		slog.Info("No messages received within the idle timeout, exiting", "topics", idle, "idle_timeout_seconds", cfg.IdleTimeoutSeconds)
+		shutdown(exitIdleTimeout)
+	case "reconnect":
+		slog.Warn("No messages received within the idle timeout, reconnecting", "topics", idle, "idle_timeout_seconds", cfg.IdleTimeoutSeconds)
+		reconnectClients()
+	default:
+		slog.Warn("No messages received within the idle timeout", "topics", idle, "idle_timeout_seconds", cfg.IdleTimeoutSeconds)
+	}
+}
+
+// reconnectClients drops and reopens the broker connections, for a
+// subscription the broker silently stopped serving. The clients keep
+// retrying in the background, and the source client subscribes again from
+// its connect handler.
+func reconnectClients() {
+	sourceClient, targetClient := running.clients.source(), running.clients.target()
+	if sourceClient != nil {
+		sourceClient.Disconnect(250)
+		brokerConnected.set("source", 0)
+		sourceClient.Connect()
+	}
+	for _, source := range running.clients.extraSources() {
+		source.client.Disconnect(250)
+		brokerConnected.set(source.name, 0)
+		source.client.Connect()
+	}
+	for _, target := range running.clients.extraTargets() {
+		target.client.Disconnect(250)
+		brokerConnected.set(target.name, 0)
+		target.client.Connect()
+	}
+	if targetClient != nil && !running.clients.shared() {
+		targetClient.Disconnect(250)
+		brokerConnected.set("target", 0)
+		targetClient.Connect()
+	}
+}
@@ -0,0 +1,74 @@
+package bridge
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"owntracks2ha/converter"
+	"owntracks2ha/internal/config"
+	"owntracks2ha/internal/plugin"
+)
+
+var influxClient = http.Client{Timeout: 10 * time.Second}
+
+// influxTagEscaper escapes the characters that end a measurement name or tag
+// in the line protocol.
+var influxTagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// influxLine renders a location as an InfluxDB line protocol point, tagged
+// with the device and timestamped with the OwnTracks tst (or when it was
+// received, for messages without one).
+func influxLine(measurement, device string, location converter.Location, received time.Time) string {
+	timestamp := received.Unix()
+	if location.Tst > 0 {
+		timestamp = location.Tst
+	}
+	return fmt.Sprintf("%s,device=%s lat=%v,lon=%v,alt=%di,accuracy=%di,battery=%di %d\n",
+		influxTagEscaper.Replace(measurement), influxTagEscaper.Replace(device),
+		location.Lat, location.Lon, location.Alt, location.Acc, location.Batt, timestamp)
+}
+
+// influxOutput writes locations to the InfluxDB v2 write API.
+type influxOutput struct {
+	settings config.OutputSettings
+}
+
+func (o *influxOutput) Send(location plugin.Location) error {
+	measurement := o.settings.Measurement
+	if measurement == "" {
+		measurement = "location"
+	}
+	line := influxLine(measurement, converter.DeviceID(location.SourceTopic), location.Source, location.Received)
+
+	query := url.Values{"org": {o.settings.Org}, "bucket": {o.settings.Bucket}, "precision": {"s"}}
+	endpoint := strings.TrimSuffix(o.settings.URL, "/") + "/api/v2/write?" + query.Encode()
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(line))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if o.settings.Token != "" {
+		req.Header.Set("Authorization", "Token "+o.settings.Token)
+	}
+	for key, value := range o.settings.Headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := influxClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("influxdb returned %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+func (o *influxOutput) Close() {}
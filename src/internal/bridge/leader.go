@@ -0,0 +1,245 @@
+package bridge
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+
+	"owntracks2ha/internal/config"
+)
+
+// leaderElection lets one of several bridges on the same brokers publish
+// while the others stand by. The leader keeps a retained claim on
+// leader_election_topic fresh; a standby takes over once no claim arrived
+// for leader_lease_seconds or the leader released it on shutdown. Claims are
+// timed on arrival, so the clocks of the instances need not agree. The
+// latest claim decides, which every instance receives in the same order from
+// the broker, so two instances claiming at once settle on the later one.
+type leaderElection struct {
+	id          string
+	topic       string
+	statusTopic string
+	lease       time.Duration
+	client      MQTT.Client
+
+	leader  atomic.Bool
+	started atomic.Bool
+
+	mu      sync.Mutex
+	holder  string    // instance of the latest claim, "" once released
+	seen    time.Time // arrival of the latest claim of another instance
+	renewed time.Time // last publish of our own claim
+}
+
+// leaderClaim is the payload of the claim topic.
+type leaderClaim struct {
+	Instance     string `json:"instance"`
+	LeaseSeconds int    `json:"lease_seconds"`
+}
+
+// isLeader reports whether this instance publishes: without leader election
+// it always does.
+func isLeader() bool {
+	e := running.election.Load()
+	return e == nil || e.leader.Load()
+}
+
+// startLeaderElection joins the election on client. It waits briefly for
+// the retained claim, so that the first instance leads before it subscribes
+// to the sources.
+func startLeaderElection(cfg *config.Config, client MQTT.Client) {
+	lease := time.Duration(cfg.LeaderLeaseSeconds) * time.Second
+	if lease <= 0 {
+		lease = 15 * time.Second
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "owntracks2ha"
+	}
+	e := &leaderElection{id: clientID(cfg.InstanceID, hostname), topic: cfg.LeaderElectionTopic, lease: lease, client: client}
+	// The status topic lives on the target broker; the LWT of a standby
+	// that went away must not leave it offline while the leader runs.
+	if client == running.clients.target() {
+		e.statusTopic = cfg.StatusTopic
+	}
+	running.election.Store(e)
+	leaderStatus.set("", 0)
+	slog.Info("Joining leader election", "instance", e.id, "topic", e.topic, "lease", lease)
+
+	e.subscribe()
+	time.Sleep(min(lease/4, 2*time.Second))
+	e.check()
+	if !e.leader.Load() {
+		e.mu.Lock()
+		holder := e.holder
+		e.mu.Unlock()
+		slog.Info("Standing by for the leader", "instance", e.id, "leader", holder)
+	}
+	e.started.Store(true)
+	go func() {
+		for range time.Tick(lease / 4) {
+			e.check()
+		}
+	}()
+}
+
+// resumeElection subscribes to the claim topic again after client
+// reconnected, as a clean session drops the subscriptions.
+func resumeElection(client MQTT.Client) {
+	if e := running.election.Load(); e != nil && e.client == client && !running.shuttingDown.Load() {
+		e.subscribe()
+	}
+}
+
+func (e *leaderElection) subscribe() {
+	token := e.client.Subscribe(e.topic, 1, e.receive)
+	if token.WaitTimeout(5*time.Second) && token.Error() != nil {
+		slog.Error("Failed to subscribe to the leader election topic", "topic", e.topic, "error", token.Error())
+	}
+	if e.statusTopic == "" {
+		return
+	}
+	token = e.client.Subscribe(e.statusTopic, 1, func(client MQTT.Client, msg MQTT.Message) {
+		if string(msg.Payload()) == statusOffline && e.leader.Load() && !running.shuttingDown.Load() {
+			go publishStatus(client, e.statusTopic, statusOnline)
+		}
+	})
+	if token.WaitTimeout(5*time.Second) && token.Error() != nil {
+		slog.Error("Failed to subscribe to the status topic", "topic", e.statusTopic, "error", token.Error())
+	}
+}
+
+// receive handles a claim, or an empty payload when the leader released
+// it.
+func (e *leaderElection) receive(_ MQTT.Client, msg MQTT.Message) {
+	if running.shuttingDown.Load() {
+		return
+	}
+	var claim leaderClaim
+	if len(msg.Payload()) > 0 {
+		if err := json.Unmarshal(msg.Payload(), &claim); err != nil {
+			slog.Warn("Ignoring invalid leader claim", "topic", msg.Topic(), "error", err)
+			return
+		}
+	}
+	e.mu.Lock()
+	e.holder = claim.Instance
+	if claim.Instance != e.id {
+		e.seen = time.Now()
+	}
+	e.mu.Unlock()
+
+	switch {
+	case claim.Instance == e.id:
+		e.setLeader(true)
+	case claim.Instance != "":
+		if e.leader.Load() {
+			slog.Warn("Another instance claimed the lead", "instance", claim.Instance)
+		}
+		e.setLeader(false)
+	default:
+		go e.check()
+	}
+}
+
+// check renews the claim of the leader and lets a standby take over a
+// released or expired one. A standby only leads at once when no other claim
+// arrived meanwhile; otherwise the echo of its claim decides. A leader that
+// cannot renew steps down once the lease ran out, as a standby may have taken
+// over by then.
+func (e *leaderElection) check() {
+	if running.shuttingDown.Load() {
+		return
+	}
+	e.mu.Lock()
+	holder, seen, renewed := e.holder, e.seen, e.renewed
+	e.mu.Unlock()
+
+	switch {
+	case e.leader.Load():
+		if !e.claim() && time.Since(renewed) > e.lease {
+			slog.Warn("Could not renew the leader claim, standing by", "instance", e.id)
+			e.setLeader(false)
+		}
+	case holder == "" || holder == e.id || time.Since(seen) > e.lease:
+		if holder != "" && holder != e.id {
+			slog.Warn("Leader claim expired, taking over", "previous", holder, "lease", e.lease)
+		}
+		start := time.Now()
+		if !e.claim() {
+			return
+		}
+		e.mu.Lock()
+		contested := e.holder != e.id && e.seen.After(start)
+		e.mu.Unlock()
+		if !contested {
+			e.setLeader(true)
+		}
+	}
+}
+
+// claim publishes the retained claim of this instance.
+func (e *leaderElection) claim() bool {
+	if !e.client.IsConnectionOpen() {
+		return false
+	}
+	payload, _ := json.Marshal(leaderClaim{Instance: e.id, LeaseSeconds: int(e.lease / time.Second)})
+	token := e.client.Publish(e.topic, 1, true, payload)
+	if !token.WaitTimeout(e.lease/4) || token.Error() != nil {
+		slog.Warn("Failed to publish the leader claim", "topic", e.topic, "error", token.Error())
+		return false
+	}
+	e.mu.Lock()
+	e.renewed = time.Now()
+	e.mu.Unlock()
+	return true
+}
+
+func (e *leaderElection) setLeader(leader bool) {
+	if e.leader.Swap(leader) == leader {
+		return
+	}
+	if !leader {
+		leaderStatus.set("", 0)
+		slog.Info("Standing by for the leader", "instance", e.id)
+		return
+	}
+	leaderStatus.set("", 1)
+	slog.Info("Leading, publishing locations", "instance", e.id)
+	// Run announces the bridge when the election settles at startup. A
+	// leader taking over later does it again, as its predecessor may not
+	// have announced every device.
+	if e.started.Load() {
+		go func() {
+			cfg := currentConfig()
+			if targetClient := running.clients.target(); targetClient != nil {
+				publishStatus(targetClient, cfg.StatusTopic, statusOnline)
+			}
+			if cfg.DiscoveryEnabled {
+				running.discoveryPublished.Clear()
+				publishDiscovery()
+			}
+		}()
+	}
+}
+
+// releaseLeadership clears the retained claim on shutdown, so that a
+// standby takes over without waiting for the lease to run out.
+func releaseLeadership() {
+	e := running.election.Load()
+	if e == nil || !e.leader.Swap(false) || !e.client.IsConnectionOpen() {
+		return
+	}
+	leaderStatus.set("", 0)
+	token := e.client.Publish(e.topic, 1, true, []byte{})
+	if !token.WaitTimeout(2*time.Second) || token.Error() != nil {
+		slog.Warn("Failed to release the leader claim", "topic", e.topic, "error", token.Error())
+		return
+	}
+	slog.Info("Released the leader claim", "topic", e.topic)
+}
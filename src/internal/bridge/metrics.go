@@ -0,0 +1,123 @@
+package bridge
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// metric is a Prometheus counter or gauge. A metric with several labels
+// lists them comma separated, and its label values are joined the same way.
+type metric struct {
+	name   string
+	help   string
+	kind   string
+	label  string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+var allMetrics []*metric
+
+func newMetric(name, kind, label, help string) *metric {
+	m := &metric{name: name, help: help, kind: kind, label: label, values: make(map[string]float64)}
+	allMetrics = append(allMetrics, m)
+	return m
+}
+
+var (
+	messagesReceived   = newMetric("owntracks2ha_messages_received_total", "counter", "", "Messages received from the source broker.")
+	messagesConverted  = newMetric("owntracks2ha_messages_converted_total", "counter", "", "Locations converted for publishing.")
+	messagesRejected   = newMetric("owntracks2ha_messages_rejected_total", "counter", "reason", "Messages dropped before publishing, by reason.")
+	messagesIgnored    = newMetric("owntracks2ha_messages_ignored_total", "counter", "type", "OwnTracks messages of types the bridge does not forward, by _type.")
+	publishes          = newMetric("owntracks2ha_publishes_total", "counter", "result", "Publishes to the target broker, by result.")
+	targetPublishes    = newMetric("owntracks2ha_target_publishes_total", "counter", "target,result", "Publishes to the brokers of the targets list, by target and result.")
+	outputSends        = newMetric("owntracks2ha_output_sends_total", "counter", "output,result", "Locations sent to the additional outputs, by output and result.")
+	notificationsSent  = newMetric("owntracks2ha_notifications_sent_total", "counter", "notification,result", "Zone change notifications sent, by notification and result.")
+	brokerConnected    = newMetric("owntracks2ha_broker_connected", "gauge", "broker", "Whether the broker connection is up (1) or down (0).")
+	activeBroker       = newMetric("owntracks2ha_active_broker", "gauge", "broker,url", "The broker of a failover list a connection uses (1).")
+	brokerFailovers    = newMetric("owntracks2ha_broker_failovers_total", "counter", "broker", "Switches to another broker of a failover list, by connection.")
+	leaderStatus       = newMetric("owntracks2ha_leader", "gauge", "", "Whether this instance leads (1) or stands by (0) with leader election.")
+	bufferedMessages   = newMetric("owntracks2ha_buffered_messages", "gauge", "", "Messages waiting in the target buffer.")
+	mappingMessages    = newMetric("owntracks2ha_mapping_messages_total", "counter", "topic", "Messages received per mapping filter.")
+	lastMessageSeconds = newMetric("owntracks2ha_last_message_timestamp_seconds", "gauge", "topic", "Unix time of the last message per mapping filter.")
+	idleTimeouts       = newMetric("owntracks2ha_idle_timeouts_total", "counter", "topic", "Idle timeouts per mapping filter.")
+)
+
+func (m *metric) inc(labelValue string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[labelValue]++
+}
+
+func (m *metric) set(labelValue string, v float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[labelValue] = v
+}
+
+func (m *metric) value(labelValue string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.values[labelValue]
+}
+
+// snapshot returns a copy of the values by label value.
+func (m *metric) snapshot() map[string]float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	values := make(map[string]float64, len(m.values))
+	for label, value := range m.values {
+		values[label] = value
+	}
+	return values
+}
+
+// write renders the metric in the Prometheus text exposition format.
+func (m *metric) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	labels := make([]string, 0, len(m.values))
+	for l := range m.values {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+	for _, l := range labels {
+		if m.label == "" {
+			fmt.Fprintf(w, "%s %v\n", m.name, m.values[l])
+		} else {
+			names, values := strings.Split(m.label, ","), strings.Split(l, ",")
+			pairs := make([]string, len(names))
+			for i, name := range names {
+				value := ""
+				if i < len(values) {
+					value = values[i]
+				}
+				pairs[i] = fmt.Sprintf("%s=%q", name, value)
+			}
+			fmt.Fprintf(w, "%s{%s} %v\n", m.name, strings.Join(pairs, ","), m.values[l])
+		}
+	}
+}
+
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		bufferedMessages.set("", float64(running.targetBuffer.len()))
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		for _, m := range allMetrics {
+			m.write(w)
+		}
+	})
+
+	slog.Info("Serving metrics", "address", addr, "path", "/metrics")
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		slog.Error("Metrics server failed", "error", err)
+	}
+}
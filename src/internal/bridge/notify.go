@@ -0,0 +1,198 @@
+package bridge
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+
+	"owntracks2ha/converter"
+	"owntracks2ha/internal/config"
+)
+
+// Default notification texts, e.g. "Anna arrived at Home".
+const (
+	defaultEnterMessage = "{{title .User}} arrived at {{title .Zone}}"
+	defaultLeaveMessage = "{{title .User}} left {{title .Zone}}"
+)
+
+// zoneEvent is what notification templates see.
+type zoneEvent struct {
+	Event       string // "enter" or "leave"
+	Zone        string
+	User        string
+	Device      string
+	DeviceID    string
+	SourceTopic string
+	Time        time.Time
+}
+
+var notifyClient = http.Client{Timeout: 10 * time.Second}
+
+// trackZone notes the zone of a location and notifies the zone changes since
+// the previous one. The first location of a device only sets its zone.
+func trackZone(cfg *config.Config, subTopic, zone string, at time.Time) {
+	previous, seen := running.deviceZones.Swap(subTopic, zone)
+	if !seen || previous == zone || len(cfg.Notifications) == 0 {
+		return
+	}
+	event := zoneEvent{SourceTopic: subTopic, DeviceID: converter.DeviceID(subTopic), Time: at}
+	if levels := strings.Split(subTopic, "/"); len(levels) >= 3 {
+		event.User, event.Device = levels[1], levels[2]
+	}
+	if previous != notHome {
+		event.Event, event.Zone = "leave", previous.(string)
+		notifyZoneEvent(cfg, event)
+	}
+	if zone != notHome {
+		event.Event, event.Zone = "enter", zone
+		notifyZoneEvent(cfg, event)
+	}
+}
+
+// notifyZoneEvent sends the event to every notification configured for its
+// zone, device and kind.
+func notifyZoneEvent(cfg *config.Config, event zoneEvent) {
+	slog.Info("Device changed zones", "topic", event.SourceTopic, "event", event.Event, "zone", event.Zone)
+	for i, n := range cfg.Notifications {
+		if len(n.Zones) > 0 && !containsString(n.Zones, event.Zone) ||
+			len(n.Events) > 0 && !containsString(n.Events, event.Event) {
+			continue
+		}
+		if len(n.Devices) > 0 && !slices.ContainsFunc(n.Devices, func(device string) bool { return deviceMatches(device, event.SourceTopic) }) {
+			continue
+		}
+		name := n.Name
+		if name == "" {
+			name = fmt.Sprintf("%s_%d", n.Type, i+1)
+		}
+		text, err := notificationText(n, event)
+		if err != nil {
+			slog.Error("Failed to render notification", "notification", name, "error", err)
+			continue
+		}
+		if running.dryRun() {
+			slog.Info("[DRY-RUN] Would send notification", "notification", name, "text", text)
+			continue
+		}
+		go func() {
+			if err := sendNotification(n, text); err != nil {
+				notificationsSent.inc(name + ",failure")
+				slog.Warn("Failed to send notification", "notification", name, "type", n.Type, "error", err)
+				return
+			}
+			notificationsSent.inc(name + ",success")
+			slog.Debug("Sent notification", "notification", name, "text", text)
+		}()
+	}
+}
+
+// notificationTemplate parses a message template once: title capitalizes
+// the first letter of a value.
+func notificationTemplate(text string) (*template.Template, error) {
+	if cached, ok := running.notificationTemplates.Load(text); ok {
+		return cached.(*template.Template), nil
+	}
+	t, err := template.New("message").Funcs(template.FuncMap{
+		"title": func(s string) string {
+			if s == "" {
+				return s
+			}
+			return strings.ToUpper(s[:1]) + s[1:]
+		},
+	}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid message template: %w", err)
+	}
+	running.notificationTemplates.Store(text, t)
+	return t, nil
+}
+
+func notificationText(n config.NotificationSettings, event zoneEvent) (string, error) {
+	text := n.EnterMessage
+	if text == "" {
+		text = defaultEnterMessage
+	}
+	if event.Event == "leave" {
+		text = n.LeaveMessage
+		if text == "" {
+			text = defaultLeaveMessage
+		}
+	}
+	t, err := notificationTemplate(text)
+	if err != nil {
+		return "", err
+	}
+	var out strings.Builder
+	if err := t.Execute(&out, event); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// sendNotification delivers text through the service of the notification.
+func sendNotification(n config.NotificationSettings, text string) error {
+	var (
+		req *http.Request
+		err error
+	)
+	switch n.Type {
+	case "ntfy":
+		req, err = http.NewRequest(http.MethodPost, n.URL, strings.NewReader(text))
+		if err == nil {
+			if n.Title != "" {
+				req.Header.Set("Title", n.Title)
+			}
+			if n.Token != "" {
+				req.Header.Set("Authorization", "Bearer "+n.Token)
+			}
+		}
+	case "gotify":
+		body, _ := json.Marshal(map[string]string{"title": n.Title, "message": text})
+		req, err = http.NewRequest(http.MethodPost, strings.TrimSuffix(n.URL, "/")+"/message", bytes.NewReader(body))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Gotify-Key", n.Token)
+		}
+	case "telegram":
+		base := n.URL
+		if base == "" {
+			base = "https://api.telegram.org"
+		}
+		body, _ := json.Marshal(map[string]string{"chat_id": n.ChatID, "text": text})
+		req, err = http.NewRequest(http.MethodPost, strings.TrimSuffix(base, "/")+"/bot"+n.Token+"/sendMessage", bytes.NewReader(body))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+	default:
+		return fmt.Errorf("unknown notification type %q", n.Type)
+	}
+	if err != nil {
+		return err
+	}
+
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		// The Telegram URL holds the bot token, which must not end up in
+		// the log.
+		var urlErr *url.Error
+		if n.Type == "telegram" && errors.As(err, &urlErr) {
+			return fmt.Errorf("request to Telegram failed: %w", urlErr.Err)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returned %s", n.Type, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package bridge
+
+import (
+	"log/slog"
+	"time"
+
+	"owntracks2ha/internal/config"
+)
+
+func recordOnce(cfg *config.Config, topic string) {
+	running.onceReceived.Add(1)
+	if filter, _, ok := cfg.MatchMapping(topic); ok {
+		running.onceMappings.Store(filter, true)
+	}
+}
+
+// onceDone reports whether run_mode once has received what it waits for:
+// once_message_count messages, or one message per mapping when that is 0.
+func onceDone(cfg *config.Config) bool {
+	if cfg.OnceMessageCount > 0 {
+		return running.onceReceived.Load() >= int64(cfg.OnceMessageCount)
+	}
+	for filter := range cfg.AllMappings() {
+		if _, seen := running.onceMappings.Load(filter); !seen {
+			return false
+		}
+	}
+	return running.onceReceived.Load() > 0
+}
+
+// waitOnce waits until onceDone or once_timeout_seconds pass and returns
+// the exit code: exitOK once something was received, exitFailure when
+// nothing arrived.
+func waitOnce(cfg *config.Config) int {
+	timeout := time.Duration(cfg.OnceTimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	if cfg.OnceMessageCount > 0 {
+		slog.Info("Run mode is 'once', waiting for messages", "count", cfg.OnceMessageCount, "timeout", timeout)
+	} else {
+		slog.Info("Run mode is 'once', waiting for a message per mapping", "mappings", len(cfg.AllMappings()), "timeout", timeout)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for !onceDone(cfg) {
+		if time.Now().After(deadline) {
+			received := running.onceReceived.Load()
+			if received == 0 {
+				slog.Error("No messages received before the timeout", "timeout", timeout)
+				return exitFailure
+			}
+			slog.Warn("Timed out before receiving every expected message", "received", received)
+			return exitOK
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	slog.Info("Received the expected messages, exiting", "received", running.onceReceived.Load())
+	return exitOK
+}
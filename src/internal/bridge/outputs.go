@@ -0,0 +1,201 @@
+package bridge
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+
+	"owntracks2ha/internal/config"
+	"owntracks2ha/internal/mqttclient"
+	"owntracks2ha/internal/plugin"
+)
+
+// The built-in outputs register like any other plugin.
+func init() {
+	plugin.RegisterOutput("mqtt", func(name string, settings config.OutputSettings) (plugin.Output, error) {
+		return newMQTTOutput(currentConfig(), name, settings)
+	})
+	plugin.RegisterOutput("webhook", func(name string, settings config.OutputSettings) (plugin.Output, error) {
+		return newWebhookOutput(name, settings)
+	})
+	plugin.RegisterOutput("influxdb", func(name string, settings config.OutputSettings) (plugin.Output, error) {
+		if settings.URL == "" {
+			return nil, errors.New("url is required for influxdb outputs")
+		}
+		return &influxOutput{settings: settings}, nil
+	})
+}
+
+// outputSink feeds one output from its own queue, so outputs neither wait
+// for each other nor hold up the primary publish, while every output still
+// receives the locations in order.
+type outputSink struct {
+	name     string
+	output   plugin.Output
+	queue    chan plugin.Location
+	mappings []string
+}
+
+// outputQueueSize bounds the locations waiting for one output.
+const outputQueueSize = 100
+
+// startOutputs creates the configured outputs. influxdb_url is kept as a
+// shorthand for an influxdb output.
+func startOutputs(cfg *config.Config) error {
+	settings := cfg.Outputs
+	if cfg.InfluxDBURL != "" {
+		settings = append(settings, config.OutputSettings{
+			Name:        "influxdb",
+			Type:        "influxdb",
+			URL:         cfg.InfluxDBURL,
+			Token:       cfg.InfluxDBToken,
+			Org:         cfg.InfluxDBOrg,
+			Bucket:      cfg.InfluxDBBucket,
+			Measurement: cfg.InfluxDBMeasurement,
+		})
+	}
+
+	for i, s := range settings {
+		if !s.OutputEnabled() {
+			continue
+		}
+		name := s.Name
+		if name == "" {
+			name = fmt.Sprintf("%s_%d", s.Type, i+1)
+		}
+		out, err := plugin.NewOutput(s.Type, name, s)
+		if err != nil {
+			return fmt.Errorf("output %s: %w", name, err)
+		}
+		sink := &outputSink{name: name, output: out, queue: make(chan plugin.Location, outputQueueSize), mappings: s.Mappings}
+		go sink.run()
+		running.addOutput(sink)
+		slog.Info("Sending locations to output", "output", name, "type", s.Type)
+	}
+	return nil
+}
+
+// sendOutputs queues a location for every output that takes its mapping. A
+// location is dropped for an output whose queue is full.
+func sendOutputs(location plugin.Location) {
+	var filter string
+	for _, sink := range running.outputList() {
+		if len(sink.mappings) > 0 {
+			if filter == "" {
+				filter, _, _ = currentConfig().MatchMapping(location.SourceTopic)
+			}
+			if !slices.Contains(sink.mappings, filter) {
+				continue
+			}
+		}
+		select {
+		case sink.queue <- location:
+		default:
+			outputSends.inc(sink.name + ",dropped")
+			slog.Warn("Output queue full, dropping location", "output", sink.name, "topic", location.SourceTopic)
+		}
+	}
+}
+
+func (s *outputSink) run() {
+	for location := range s.queue {
+		if running.dryRun() {
+			slog.Info("[DRY-RUN] Would send to output", "output", s.name, "topic", location.SourceTopic, "payload", string(location.Payload))
+			continue
+		}
+		if err := s.output.Send(location); err != nil {
+			outputSends.inc(s.name + ",failure")
+			slog.Warn("Failed to send location to output", "output", s.name, "topic", location.SourceTopic, "error", err)
+			continue
+		}
+		outputSends.inc(s.name + ",success")
+		slog.Debug("Sent location to output", "output", s.name, "topic", location.SourceTopic)
+	}
+}
+
+// closeOutputs disconnects the outputs on shutdown.
+func closeOutputs() {
+	for _, sink := range running.outputList() {
+		sink.output.Close()
+	}
+}
+
+// mqttOutput publishes locations to another broker.
+type mqttOutput struct {
+	settings config.OutputSettings
+	qos      byte
+	client   MQTT.Client
+}
+
+func newMQTTOutput(cfg *config.Config, name string, settings config.OutputSettings) (*mqttOutput, error) {
+	if settings.Broker == "" {
+		return nil, errors.New("broker is required for mqtt outputs")
+	}
+	useTLS := settings.TLS.TLSEnabled(cfg.UseTLS)
+	broker, err := mqttclient.BrokerURL(settings.Broker, settings.Port, useTLS, settings.Transport)
+	if err != nil {
+		return nil, err
+	}
+	user, pass, err := mqttclient.Credentials(settings.Auth, settings.User, settings.Pass)
+	if err != nil {
+		return nil, err
+	}
+	var tlsConfig *tls.Config
+	if useTLS || mqttclient.URLUsesTLS(broker) {
+		if tlsConfig, err = mqttclient.BuildTLSConfig(settings.TLS); err != nil {
+			return nil, err
+		}
+	}
+
+	qos := cfg.QoS
+	if settings.QoS != nil {
+		qos = *settings.QoS
+	}
+	opts := mqttclient.Options([]string{broker}, clientID("", "ot2ha_"+name), user, pass, tlsConfig, settings.ProtocolVersion)
+	mqttclient.ApplyConnectionSettings(opts, cfg)
+	opts.SetOnConnectHandler(func(MQTT.Client) {
+		brokerConnected.set(name, 1)
+	})
+	opts.SetConnectionLostHandler(func(_ MQTT.Client, err error) {
+		brokerConnected.set(name, 0)
+		slog.Warn("Output MQTT connection lost", "output", name, "error", err)
+	})
+	out := &mqttOutput{settings: settings, qos: byte(qos)}
+	if !running.dryRun() {
+		out.client = mqttclient.New(opts, settings.ProtocolVersion, 0)
+		// With connect retry enabled the client keeps trying in the
+		// background, so a down output broker does not stop the bridge.
+		out.client.Connect()
+	}
+	return out, nil
+}
+
+func (o *mqttOutput) Send(location plugin.Location) error {
+	topic := location.TargetTopic
+	if o.settings.Topic != "" {
+		_, captures, _ := currentConfig().MatchMapping(location.SourceTopic)
+		topic = config.ExpandTopic(o.settings.Topic, location.SourceTopic, captures)
+	}
+	token := mqttclient.Publish(o.client, mqttclient.Message{
+		Topic:       topic,
+		QoS:         o.qos,
+		Retained:    o.settings.Retain,
+		Payload:     location.Payload,
+		SourceTopic: location.SourceTopic,
+	})
+	if !token.WaitTimeout(10 * time.Second) {
+		return errors.New("timed out publishing")
+	}
+	return token.Error()
+}
+
+func (o *mqttOutput) Close() {
+	if o.client != nil {
+		o.client.Disconnect(250)
+	}
+}
@@ -0,0 +1,83 @@
+package bridge
+
+import (
+	"fmt"
+	"log/slog"
+
+	"owntracks2ha/converter"
+	"owntracks2ha/internal/config"
+	"owntracks2ha/internal/plugin"
+)
+
+type namedFilter struct {
+	name   string
+	filter plugin.Filter
+}
+
+// pluginName returns the configured name of an input or filter, or its type
+// and position.
+func pluginName(settings config.PluginSettings, i int) string {
+	if settings.Name != "" {
+		return settings.Name
+	}
+	return fmt.Sprintf("%s_%d", settings.Type, i+1)
+}
+
+// loadFilters creates the configured filters.
+func loadFilters(cfg *config.Config) error {
+	for i, s := range cfg.Filters {
+		if !s.PluginEnabled() {
+			continue
+		}
+		name := pluginName(s, i)
+		filter, err := plugin.NewFilter(s.Type, name, s)
+		if err != nil {
+			return fmt.Errorf("filter %s: %w", name, err)
+		}
+		running.addFilter(namedFilter{name: name, filter: filter})
+		slog.Info("Filtering locations", "filter", name, "type", s.Type)
+	}
+	return nil
+}
+
+// filterReason returns the rejection reason of the first filter that drops
+// the location, or "" when all keep it.
+func filterReason(subTopic string, location converter.Location) string {
+	for _, f := range running.filterList() {
+		if !f.filter.Keep(subTopic, location) {
+			return "filter_" + f.name
+		}
+	}
+	return ""
+}
+
+// startInputs starts the configured inputs. Their messages go through
+// messageHandler like messages from the source broker.
+func startInputs(cfg *config.Config) error {
+	deliver := func(topic string, payload []byte) {
+		messageHandler(nil, httpMessage{topic: topic, payload: payload})
+	}
+	for i, s := range cfg.Inputs {
+		if !s.PluginEnabled() {
+			continue
+		}
+		name := pluginName(s, i)
+		input, err := plugin.NewInput(s.Type, name, s)
+		if err != nil {
+			return fmt.Errorf("input %s: %w", name, err)
+		}
+		if err := input.Start(deliver); err != nil {
+			return fmt.Errorf("input %s: %w", name, err)
+		}
+		running.addInput(input)
+		slog.Info("Receiving messages from input", "input", name, "type", s.Type)
+	}
+	return nil
+}
+
+// closeInputs stops the inputs on shutdown.
+func closeInputs() {
+	for _, input := range running.inputList() {
+		input.Close()
+	}
+}
@@ -0,0 +1,57 @@
+package bridge
+
+import (
+	"sync"
+	"time"
+
+	"owntracks2ha/internal/config"
+)
+
+// tokenBucket holds the tokens left for one source topic. It refills at
+// rate_limit_per_minute up to rate_limit_burst tokens.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter caps how many messages per source topic are processed, so a
+// misbehaving phone cannot flood the target broker and Home Assistant.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// allow takes a token from the bucket of topic and reports whether the
+// message may be processed. It always allows messages when
+// rate_limit_per_minute is not set.
+func (l *rateLimiter) allow(cfg *config.Config, topic string, now time.Time) bool {
+	if cfg.RateLimitPerMinute <= 0 {
+		return true
+	}
+	burst := float64(cfg.RateLimitBurst)
+	if burst < 1 {
+		burst = 1
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.buckets == nil {
+		l.buckets = make(map[string]*tokenBucket)
+	}
+	bucket, ok := l.buckets[topic]
+	if !ok {
+		bucket = &tokenBucket{tokens: burst, last: now}
+		l.buckets[topic] = bucket
+	}
+
+	bucket.tokens += now.Sub(bucket.last).Minutes() * cfg.RateLimitPerMinute
+	if bucket.tokens > burst {
+		bucket.tokens = burst
+	}
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
@@ -0,0 +1,106 @@
+package bridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"owntracks2ha/internal/config"
+)
+
+// captureFile appends received messages to record_file in the format the
+// replay command reads, rotating it by size.
+type captureFile struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+func openCaptureFile(cfg *config.Config) (*captureFile, error) {
+	c := &captureFile{path: cfg.RecordFile, maxSize: 10 << 20, maxFiles: 3}
+	if cfg.RecordMaxSizeMB > 0 {
+		c.maxSize = int64(cfg.RecordMaxSizeMB) << 20
+	}
+	if cfg.RecordMaxFiles > 0 {
+		c.maxFiles = cfg.RecordMaxFiles
+	}
+	if err := c.open(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *captureFile) open() error {
+	f, err := os.OpenFile(c.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	c.file, c.size = f, info.Size()
+	return nil
+}
+
+// record appends one message. A failed write is logged and does not affect
+// the message.
+func (c *captureFile) record(topic string, payload []byte, received time.Time) {
+	rawPayload, _ := json.Marshal(string(payload))
+	line, err := json.Marshal(capturedMessage{Time: received, Topic: topic, Payload: rawPayload})
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file == nil {
+		return
+	}
+	if c.size > 0 && c.size+int64(len(line)) > c.maxSize {
+		if err := c.rotate(); err != nil {
+			slog.Warn("Failed to rotate the capture file", "file", c.path, "error", err)
+			if c.file == nil {
+				return
+			}
+		}
+	}
+	n, err := c.file.Write(line)
+	c.size += int64(n)
+	if err != nil {
+		slog.Warn("Failed to record message", "file", c.path, "topic", topic, "error", err)
+	}
+}
+
+// rotate renames the file to path.1, shifting older ones up to maxFiles, and
+// starts a new one.
+func (c *captureFile) rotate() error {
+	c.file.Close()
+	c.file = nil
+	os.Remove(fmt.Sprintf("%s.%d", c.path, c.maxFiles))
+	for i := c.maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", c.path, i), fmt.Sprintf("%s.%d", c.path, i+1))
+	}
+	if err := os.Rename(c.path, c.path+".1"); err != nil {
+		c.open()
+		return err
+	}
+	return c.open()
+}
+
+func (c *captureFile) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file != nil {
+		c.file.Close()
+		c.file = nil
+	}
+}
@@ -0,0 +1,165 @@
+package bridge
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"owntracks2ha/internal/config"
+)
+
+// capturedMessage is one line of a capture file: a message as it arrived
+// from the source broker. Payload is the raw payload as a string; a JSON
+// object is accepted too, for hand-written captures.
+type capturedMessage struct {
+	Time    time.Time       `json:"time"`
+	Topic   string          `json:"topic"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// replayMessage is a captured message fed through messageHandler. It is
+// processed as if it was received at the captured time, so the age, rate
+// and throttling checks behave as they did for the live traffic.
+type replayMessage struct {
+	httpMessage
+	received time.Time
+}
+
+// ReplayCommand runs "owntracks2ha replay", which feeds a capture file
+// through conversion and publishing instead of subscribing to the source
+// broker. It only returns on invalid flags; otherwise the bridge exits once
+// the file is replayed.
+func ReplayCommand(args []string, stderr io.Writer) int {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	configPath := flags.String("config", "config/config.yaml", "path to the config file (YAML, JSON or TOML)")
+	configFormat := flags.String("config-format", "", "config file format: yaml, json or toml (defaults to the file extension)")
+	file := flags.String("file", "", "capture file with one JSON message per line")
+	speed := flags.String("speed", "max", "replay speed relative to the captured timing, e.g. 1x or 10x; max replays without pauses")
+	debug := flags.Bool("debug", false, "enable debug logging (overrides the config file)")
+	dryRun := flags.Bool("dry-run", false, "convert and log messages without publishing them")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *file == "" {
+		fmt.Fprintln(stderr, "no capture file: pass -file")
+		return 2
+	}
+	factor, err := parseSpeed(*speed)
+	if err != nil {
+		fmt.Fprintf(stderr, "invalid -speed %q: %v\n", *speed, err)
+		return 2
+	}
+
+	Run(Options{
+		ConfigPath:   *configPath,
+		ConfigFormat: *configFormat,
+		Debug:        *debug,
+		DryRun:       *dryRun,
+		ReplayFile:   *file,
+		ReplaySpeed:  factor,
+	})
+	return 0
+}
+
+// parseSpeed parses a replay speed such as 10x or 0.5. max (or 0) replays
+// without pauses.
+func parseSpeed(s string) (float64, error) {
+	if s == "max" {
+		return 0, nil
+	}
+	factor, err := strconv.ParseFloat(strings.TrimSuffix(s, "x"), 64)
+	if err != nil {
+		return 0, err
+	}
+	if factor < 0 {
+		return 0, errors.New("speed must not be negative")
+	}
+	return factor, nil
+}
+
+// prepareReplay turns off everything of the configuration that is not
+// needed to replay a capture or would get in the way of a bridge that runs
+// at the same time: the source broker, listeners, inputs, the on-disk
+// queue, the history with its track export and Recorder store, zone
+// notifications, recording, the bridge status and a fixed target client ID.
+func prepareReplay(cfg *config.Config) {
+	cfg.SourceBroker = nil
+	cfg.HTTPListen = ""
+	cfg.MetricsListen = ""
+	cfg.HealthListen = ""
+	cfg.Inputs = nil
+	cfg.BufferFile = ""
+	cfg.History.SQLitePath = ""
+	cfg.History.APIListen = ""
+	cfg.History.ExportDir = ""
+	cfg.History.RecorderDir = ""
+	cfg.Notifications = nil
+	cfg.RecordFile = ""
+	cfg.StatusTopic = ""
+	cfg.TargetClientID = ""
+	cfg.RunMode = ""
+	cfg.IdleTimeoutSeconds = 0
+	cfg.ConfigWatchIntervalSeconds = 0
+}
+
+// replay feeds the messages of a capture file through messageHandler, in
+// order and pausing between them as captured divided by speed, and returns
+// the exit code.
+func replay(path string, speed float64) int {
+	f, err := os.Open(path)
+	if err != nil {
+		slog.Error("Failed to open the capture file", "file", path, "error", err)
+		return exitFailure
+	}
+	defer f.Close()
+
+	slog.Info("Replaying captured messages", "file", path, "speed", speed)
+	var replayed, skipped int
+	var previous time.Time
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var captured capturedMessage
+		if err := json.Unmarshal(scanner.Bytes(), &captured); err != nil || captured.Topic == "" {
+			if err == nil {
+				err = errors.New("no topic")
+			}
+			slog.Warn("Skipping invalid capture line", "file", path, "line", line, "error", err)
+			skipped++
+			continue
+		}
+		payload := []byte(captured.Payload)
+		var s string
+		if json.Unmarshal(captured.Payload, &s) == nil {
+			payload = []byte(s)
+		}
+
+		if speed > 0 && !previous.IsZero() && captured.Time.After(previous) {
+			time.Sleep(time.Duration(float64(captured.Time.Sub(previous)) / speed))
+		}
+		if !captured.Time.IsZero() {
+			previous = captured.Time
+		}
+		messageHandler(nil, replayMessage{httpMessage{topic: captured.Topic, payload: payload}, captured.Time})
+		replayed++
+	}
+	if err := scanner.Err(); err != nil {
+		slog.Error("Failed to read the capture file", "file", path, "error", err)
+		return exitFailure
+	}
+	slog.Info("Replayed captured messages", "file", path, "replayed", replayed, "skipped", skipped)
+	return exitOK
+}
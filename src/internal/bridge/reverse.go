@@ -0,0 +1,110 @@
+package bridge
+
+import (
+	"log/slog"
+	"sort"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+
+	"owntracks2ha/converter"
+	"owntracks2ha/internal/config"
+)
+
+// reverseListener subscribes the filters of reverse_mappings on the target
+// broker and forwards the requests it receives to the devices as OwnTracks
+// cmd messages on the source broker.
+type reverseListener struct {
+	client MQTT.Client
+}
+
+// startReverse subscribes to the reverse_mappings on client.
+func startReverse(client MQTT.Client) {
+	l := &reverseListener{client: client}
+	running.reverse.Store(l)
+	l.subscribe()
+}
+
+// resumeReverse subscribes to the reverse_mappings again after client
+// reconnected.
+func resumeReverse(client MQTT.Client) {
+	if l := running.reverse.Load(); l != nil && l.client == client && !running.shuttingDown.Load() {
+		l.subscribe()
+	}
+}
+
+func (l *reverseListener) subscribe() {
+	cfg := currentConfig()
+	filters := make([]string, 0, len(cfg.ReverseMappings))
+	for filter := range cfg.ReverseMappings {
+		filters = append(filters, filter)
+	}
+	sort.Strings(filters)
+	for _, filter := range filters {
+		token := l.client.Subscribe(filter, 1, func(_ MQTT.Client, msg MQTT.Message) {
+			go forwardCommand(msg.Topic(), msg.Payload())
+		})
+		if !token.WaitTimeout(5 * time.Second) {
+			slog.Warn("Timed out subscribing to a reverse mapping", "topic", filter)
+		} else if token.Error() != nil {
+			slog.Error("Failed to subscribe to a reverse mapping", "topic", filter, "error", token.Error())
+		} else {
+			slog.Info("Forwarding device commands", "topic", filter, "cmd_topic", cfg.ReverseMappings[filter])
+		}
+	}
+}
+
+// forwardCommand publishes a request received on a reverse mapping to the
+// cmd topic of its device.
+func forwardCommand(topic string, payload []byte) {
+	cfg := currentConfig()
+	if !isLeader() {
+		slog.Debug("Standing by, not forwarding command", "topic", topic)
+		return
+	}
+	cmdTopic, ok := reverseTopic(cfg, topic)
+	if !ok {
+		return
+	}
+	command, err := converter.BuildCommand(payload)
+	if err != nil {
+		slog.Warn("Ignoring invalid device command", "topic", topic, "error", err)
+		return
+	}
+	sourceClient := running.clients.source()
+	if sourceClient == nil {
+		slog.Error("Cannot forward device command without a source broker", "topic", topic, "cmd_topic", cmdTopic)
+		return
+	}
+	if running.dryRun() {
+		slog.Info("[DRY-RUN] Would send device command", "topic", cmdTopic, "payload", string(command))
+		return
+	}
+
+	// The phone may share the broker with the bridge's own output.
+	running.ownTopics.Store(cmdTopic, struct{}{})
+	token := sourceClient.Publish(cmdTopic, byte(cfg.QoS), false, command)
+	if !token.WaitTimeout(5 * time.Second) {
+		slog.Warn("Timed out sending device command", "topic", topic, "cmd_topic", cmdTopic)
+	} else if token.Error() != nil {
+		slog.Error("Failed to send device command", "topic", topic, "cmd_topic", cmdTopic, "error", token.Error())
+	} else {
+		slog.Info("Sent device command", "topic", topic, "cmd_topic", cmdTopic, "payload", string(command))
+	}
+}
+
+// reverseTopic returns the cmd topic of the reverse mapping that matches
+// topic. Filters are tried in sorted order, like the mappings.
+func reverseTopic(cfg *config.Config, topic string) (string, bool) {
+	filters := make([]string, 0, len(cfg.ReverseMappings))
+	for filter := range cfg.ReverseMappings {
+		filters = append(filters, filter)
+	}
+	sort.Strings(filters)
+	for _, filter := range filters {
+		if captures, ok := config.TopicMatch(filter, topic); ok {
+			return config.ExpandTopic(cfg.ReverseMappings[filter], topic, captures), true
+		}
+	}
+	return "", false
+}
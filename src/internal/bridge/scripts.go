@@ -0,0 +1,37 @@
+package bridge
+
+import (
+	"fmt"
+
+	"owntracks2ha/internal/config"
+	"owntracks2ha/internal/script"
+)
+
+// loadScripts compiles the scripts of all mappings. The scripts in use are
+// only replaced when all of them compile.
+func loadScripts(cfg *config.Config) error {
+	scripts := make(map[string]*script.Script)
+	for filter, mapping := range cfg.AllMappings() {
+		if mapping.Script == "" || scripts[mapping.Script] != nil {
+			continue
+		}
+		compiled, err := script.Load(mapping.Script)
+		if err != nil {
+			return fmt.Errorf("mapping %s: %w", filter, err)
+		}
+		scripts[mapping.Script] = compiled
+	}
+	running.mappingScripts.Store(&scripts)
+	return nil
+}
+
+// scriptFor returns the compiled script of a mapping, if it has one.
+func scriptFor(mapping config.Mapping) *script.Script {
+	if mapping.Script == "" {
+		return nil
+	}
+	if scripts := running.mappingScripts.Load(); scripts != nil {
+		return (*scripts)[mapping.Script]
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package bridge
+
+import (
+	"math"
+	"time"
+)
+
+// kalmanState is the smoothed position of one device. variance is the
+// uncertainty of the position in square meters.
+type kalmanState struct {
+	lat, lon float64
+	variance float64
+	fix      time.Time
+}
+
+// smoothPosition runs a location through the Kalman filter of subTopic and
+// returns the smoothed position. The reported accuracy weighs the new fix
+// against the current estimate, whose uncertainty grows by processNoise
+// meters per second since the previous fix, so a phone at rest settles
+// while real movement still comes through quickly.
+func smoothPosition(subTopic string, lat, lon float64, accuracy int, fix time.Time, processNoise float64) (float64, float64) {
+	measurementVariance := math.Max(float64(accuracy), 1)
+	measurementVariance *= measurementVariance
+
+	value, ok := running.smoothers.Load(subTopic)
+	if !ok {
+		running.smoothers.Store(subTopic, kalmanState{lat: lat, lon: lon, variance: measurementVariance, fix: fix})
+		return lat, lon
+	}
+	state := value.(kalmanState)
+	if elapsed := fix.Sub(state.fix).Seconds(); elapsed > 0 {
+		state.variance += elapsed * processNoise * processNoise
+		state.fix = fix
+	}
+
+	gain := state.variance / (state.variance + measurementVariance)
+	state.lat += gain * (lat - state.lat)
+	state.lon += gain * (lon - state.lon)
+	state.variance *= 1 - gain
+	running.smoothers.Store(subTopic, state)
+	return state.lat, state.lon
+}
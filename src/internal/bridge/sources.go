@@ -0,0 +1,110 @@
+package bridge
+
+import (
+	"crypto/tls"
+	"log/slog"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+
+	"owntracks2ha/internal/config"
+	"owntracks2ha/internal/mqttclient"
+)
+
+// sourceOptions builds the client options of a source from the sources
+// list. Its messages go to the same handler as those of source_broker.
+func sourceOptions(cfg *config.Config, source config.SourceSettings) (*MQTT.ClientOptions, error) {
+	useTLS := source.TLS.TLSEnabled(cfg.UseTLS)
+	broker, err := mqttclient.BrokerURL(source.Broker, source.Port, useTLS, source.Transport)
+	if err != nil {
+		return nil, err
+	}
+	user, pass, err := mqttclient.Credentials(source.Auth, source.User, source.Pass)
+	if err != nil {
+		return nil, err
+	}
+	var tlsConfig *tls.Config
+	if useTLS || mqttclient.URLUsesTLS(broker) {
+		if tlsConfig, err = mqttclient.BuildTLSConfig(source.TLS); err != nil {
+			return nil, err
+		}
+	}
+
+	name := source.Name
+	opts := mqttclient.Options([]string{broker}, clientID(source.ClientID, "ot2ha_source"), user, pass, tlsConfig, cfg.ProtocolVersion)
+	mqttclient.ApplyConnectionSettings(opts, cfg)
+	opts.SetCleanSession(cfg.CleanSessionEnabled())
+	opts.SetDefaultPublishHandler(messageHandler)
+	opts.SetOrderMatters(true)
+	// The connection is made in the background like those of the outputs,
+	// so the topics are subscribed from here, on every connect.
+	opts.SetOnConnectHandler(func(client MQTT.Client) {
+		brokerConnected.set(name, 1)
+		slog.Info("Connected to Source MQTT broker", "source", name, "broker", broker)
+		if !running.shuttingDown.Load() {
+			go subscribeSource(client, name)
+		}
+	})
+	opts.SetConnectionLostHandler(func(_ MQTT.Client, err error) {
+		brokerConnected.set(name, 0)
+		slog.Warn("Source MQTT connection lost", "source", name, "error", err)
+	})
+	return opts, nil
+}
+
+// connectSources connects to the brokers of the sources list. A source that
+// is down does not stop the bridge; its client keeps retrying.
+func connectSources(cfg *config.Config) error {
+	for _, source := range cfg.Sources {
+		opts, err := sourceOptions(cfg, source)
+		if err != nil {
+			return err
+		}
+		slog.Info("Connecting to Source MQTT broker", "source", source.Name, "broker", opts.Servers[0].String())
+		client := mqttclient.New(opts, cfg.ProtocolVersion, cfg.SessionExpirySeconds)
+		running.clients.addSource(source.Name, client)
+		client.Connect()
+	}
+	return nil
+}
+
+// subscribeSource subscribes to the topics of a source from the sources
+// list.
+func subscribeSource(client MQTT.Client, name string) {
+	cfg := currentConfig()
+	source, ok := cfg.Source(name)
+	if !ok {
+		return
+	}
+	for _, subTopic := range cfg.SourceSubscriptionTopics(source) {
+		subscribeWithRetry(client, subTopic)
+	}
+}
+
+// updateSubscriptions subscribes client to the topics in newTopics that are
+// new or whose QoS changed and unsubscribes it from those that were removed.
+// A changed shared_subscription_group moves all of them to the new group.
+func updateSubscriptions(client MQTT.Client, oldConfig, newConfig *config.Config, oldTopics, newTopics []string) {
+	regroup := oldConfig.SharedSubscriptionGroup != newConfig.SharedSubscriptionGroup
+	var removed []string
+	for _, topic := range oldTopics {
+		if regroup || !containsString(newTopics, topic) {
+			removed = append(removed, oldConfig.SubscriptionFilter(topic))
+		}
+	}
+	if len(removed) > 0 {
+		token := client.Unsubscribe(removed...)
+		token.Wait()
+		if token.Error() != nil {
+			slog.Error("Failed to unsubscribe from removed topics", "topics", removed, "error", token.Error())
+		} else {
+			slog.Info("Unsubscribed from removed topics", "topics", removed)
+		}
+	}
+
+	for _, topic := range newTopics {
+		// Subscribing again to an existing topic updates its QoS.
+		if regroup || !containsString(oldTopics, topic) || oldConfig.SubscriptionQoS(topic) != newConfig.SubscriptionQoS(topic) {
+			subscribeWithRetry(client, topic)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package bridge
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"owntracks2ha/internal/config"
+	"owntracks2ha/internal/history"
+	"owntracks2ha/internal/plugin"
+	"owntracks2ha/internal/script"
+)
+
+// Bridge is the runtime state of the bridge. Run fills it in while the HTTP
+// endpoints, the broker callbacks and the workers already run, so every
+// field is either safe for concurrent use on its own (atomics, sync.Map and
+// the types with their own lock) or guarded by mu and used through the
+// methods below.
+type Bridge struct {
+	config      atomic.Pointer[config.Config]
+	lastMessage atomic.Int64
+	clients     brokerClients
+
+	// ready is closed once the target is connected and the outputs are
+	// started. Messages delivered earlier, such as those a persistent
+	// session kept while the bridge was down, wait for it.
+	ready chan struct{}
+	// processingMu is held for reading while a message is handled, so a
+	// shutdown can wait for the messages in flight.
+	processingMu     sync.RWMutex
+	shuttingDown     atomic.Bool
+	shutdownOnce     sync.Once
+	sourceSubscribed atomic.Bool // later connects of the source are reconnects
+	// workers is started by Run; without it messages are processed by the
+	// caller.
+	workers atomic.Pointer[workerPool]
+
+	// election, commands and reverse are set by Run when
+	// leader_election_topic, command_topic and reverse_mappings are set.
+	election atomic.Pointer[leaderElection]
+	commands atomic.Pointer[commandListener]
+	reverse  atomic.Pointer[reverseListener]
+
+	// paused is set by the pause command: messages are still received but
+	// not forwarded until resume. pausedDevices holds the arguments of
+	// "pause <device>": source topics, mapping filters or device IDs such as
+	// anna_phone, whose locations are not forwarded until resumed with the
+	// same argument.
+	paused        atomic.Bool
+	pausedDevices sync.Map
+
+	// These map source topics to the forwardedLocation for the throttling,
+	// the availability last published, the location_name of the last
+	// location for zone notifications and the kalmanState of the smoothing.
+	lastForwarded      sync.Map
+	deviceAvailability sync.Map
+	deviceZones        sync.Map
+	smoothers          sync.Map
+
+	// lastFilterMessage maps mapping filters to when a message matching them
+	// last arrived, so a silent subscription shows up even while other
+	// devices keep sending.
+	lastFilterMessage sync.Map
+	// onceReceived and onceMappings count the messages received in run_mode
+	// once, in total and by the mapping they matched.
+	onceReceived  atomic.Int64
+	onceMappings  sync.Map
+	deviceLimiter rateLimiter
+
+	// ownTopics records every topic the bridge published to, so that a
+	// shared client ignores its own output when a mapping filter also
+	// matches it. discoveryPublished holds the discovery configs sent and
+	// retainedMessages the last retained target message per topic, which a
+	// target of the targets list is sent when it connects.
+	ownTopics          sync.Map
+	discoveryPublished sync.Map
+	retainedMessages   sync.Map
+	targetBuffer       messageBuffer
+	// publishErrors counts the consecutive publishes that failed for good.
+	publishErrors atomic.Int64
+
+	// knownZones holds the zones from the config and, with import_ha_zones,
+	// from Home Assistant; mappingScripts maps script paths to the compiled
+	// transform scripts of the current config.
+	knownZones            atomic.Pointer[[]zone]
+	mappingScripts        atomic.Pointer[map[string]*script.Script]
+	notificationTemplates sync.Map
+	reverseGeocoder       geocoder
+
+	mu           sync.RWMutex
+	configPath   string
+	configFormat string
+	debugFlag    bool
+	dryRunFlag   bool
+	inputs       []plugin.Input
+	filters      []namedFilter
+	outputs      []*outputSink
+	history      *history.Recorder
+	exporter     *history.Exporter
+	store        *history.Store
+	capture      *captureFile
+}
+
+func newBridge() *Bridge {
+	b := &Bridge{ready: make(chan struct{})}
+	b.reverseGeocoder.client.Timeout = 10 * time.Second
+	return b
+}
+
+// running is the bridge of this process. It is set before any goroutine
+// starts and only swapped by tests.
+var running = newBridge()
+
+// setOptions records the command-line settings the bridge runs with.
+func (b *Bridge) setOptions(opts Options) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.configPath, b.configFormat = opts.ConfigPath, opts.ConfigFormat
+	b.debugFlag, b.dryRunFlag = opts.Debug, opts.DryRun
+}
+
+// configFile returns the path and format of the config file.
+func (b *Bridge) configFile() (string, string) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.configPath, b.configFormat
+}
+
+// debug reports whether -debug was given.
+func (b *Bridge) debug() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.debugFlag
+}
+
+// dryRun reports whether messages are only logged instead of published.
+func (b *Bridge) dryRun() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.dryRunFlag
+}
+
+// setDryRun turns on dry-run mode, for run_mode dry-run.
+func (b *Bridge) setDryRun() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.dryRunFlag = true
+}
+
+func (b *Bridge) addInput(input plugin.Input) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.inputs = append(b.inputs, input)
+}
+
+// inputList returns the started inputs.
+func (b *Bridge) inputList() []plugin.Input {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return append([]plugin.Input(nil), b.inputs...)
+}
+
+func (b *Bridge) addFilter(filter namedFilter) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.filters = append(b.filters, filter)
+}
+
+// filterList returns the loaded filters in their configured order.
+func (b *Bridge) filterList() []namedFilter {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return append([]namedFilter(nil), b.filters...)
+}
+
+func (b *Bridge) addOutput(sink *outputSink) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.outputs = append(b.outputs, sink)
+}
+
+// outputList returns the started outputs.
+func (b *Bridge) outputList() []*outputSink {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return append([]*outputSink(nil), b.outputs...)
+}
+
+// setHistory records where locations are recorded to; each may be nil.
+func (b *Bridge) setHistory(recorder *history.Recorder, exporter *history.Exporter, store *history.Store) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.history, b.exporter, b.store = recorder, exporter, store
+}
+
+// locationHistory returns the history open when history.sqlite_path is
+// set, the track exporter of history.export_dir and the Recorder store of
+// history.recorder_dir, or nil for those that are not set.
+func (b *Bridge) locationHistory() (*history.Recorder, *history.Exporter, *history.Store) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.history, b.exporter, b.store
+}
+
+func (b *Bridge) setCapture(capture *captureFile) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.capture = capture
+}
+
+// messageCapture returns the capture file open when record_file is set, or
+// nil.
+func (b *Bridge) messageCapture() *captureFile {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.capture
+}
@@ -0,0 +1,280 @@
+package bridge
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+
+	"owntracks2ha/converter"
+	"owntracks2ha/internal/config"
+)
+
+// These tests exercise the state shared between the broker callbacks, the
+// workers and the watchdogs from many goroutines; run them with -race.
+
+type keepFilter bool
+
+func (k keepFilter) Keep(string, converter.Location) bool { return bool(k) }
+
+// useBridge makes b the running bridge for the duration of the test.
+func useBridge(t *testing.T, b *Bridge) {
+	previous := running
+	running = b
+	t.Cleanup(func() { running = previous })
+}
+
+// fakeClient is a broker connection that accepts every publish while it is
+// connected.
+type fakeClient struct {
+	connected atomic.Bool
+	mu        sync.Mutex
+	published map[string][]byte
+}
+
+func newFakeClient() *fakeClient {
+	c := &fakeClient{published: map[string][]byte{}}
+	c.connected.Store(true)
+	return c
+}
+
+func (c *fakeClient) IsConnected() bool      { return c.connected.Load() }
+func (c *fakeClient) IsConnectionOpen() bool { return c.connected.Load() }
+func (c *fakeClient) Connect() MQTT.Token    { c.connected.Store(true); return doneToken{} }
+func (c *fakeClient) Disconnect(uint)        { c.connected.Store(false) }
+
+func (c *fakeClient) Publish(topic string, _ byte, _ bool, payload interface{}) MQTT.Token {
+	if !c.connected.Load() {
+		return doneToken{errors.New("not connected")}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.published[topic] = payload.([]byte)
+	return doneToken{}
+}
+
+func (c *fakeClient) Subscribe(string, byte, MQTT.MessageHandler) MQTT.Token { return doneToken{} }
+func (c *fakeClient) SubscribeMultiple(map[string]byte, MQTT.MessageHandler) MQTT.Token {
+	return doneToken{}
+}
+func (c *fakeClient) Unsubscribe(...string) MQTT.Token        { return doneToken{} }
+func (c *fakeClient) AddRoute(string, MQTT.MessageHandler)    {}
+func (c *fakeClient) OptionsReader() MQTT.ClientOptionsReader { return MQTT.ClientOptionsReader{} }
+
+func (c *fakeClient) topics() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.published)
+}
+
+// doneToken is a finished MQTT.Token.
+type doneToken struct{ err error }
+
+func (t doneToken) Wait() bool                     { return true }
+func (t doneToken) WaitTimeout(time.Duration) bool { return true }
+func (t doneToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+func (t doneToken) Error() error { return t.err }
+
+const raceConfig = `
+log_level: error
+output: mqtt
+buffer_size: 100
+idle_timeout_seconds: 1
+idle_action: %s
+mappings:
+  "owntracks/+/+":
+    target: "ha/{user}/{device}"
+`
+
+// startTestBridge runs a bridge with a connected target and the config in
+// a file, as Run leaves it, and returns the file and the target.
+func startTestBridge(t *testing.T, idleAction string) (string, *fakeClient) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(raceConfig, idleAction)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.ReadFormat(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := configureLogging(cfg); err != nil {
+		t.Fatal(err)
+	}
+	b := newBridge()
+	b.setOptions(Options{ConfigPath: path})
+	b.config.Store(cfg)
+	target := newFakeClient()
+	b.clients.set(nil, target, false)
+	useBridge(t, b)
+	return path, target
+}
+
+// locationMessage returns a location of device recorded at tst.
+func locationMessage(device string, tst int64) MQTT.Message {
+	payload := fmt.Sprintf(`{"_type":"location","lat":52.%d,"lon":4.3,"acc":10,"tst":%d}`, tst%1000, tst)
+	return httpMessage{topic: "owntracks/anna/" + device, payload: []byte(payload)}
+}
+
+// runConcurrently runs every function rounds times, each on its own
+// goroutine, and waits for all of them.
+func runConcurrently(rounds int, fns ...func(i int)) {
+	var wg sync.WaitGroup
+	for _, fn := range fns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				fn(i)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestProcessMessageWithWatchdogs(t *testing.T) {
+	path, target := startTestBridge(t, "reconnect")
+	start := time.Now().Add(-time.Hour)
+
+	// The target drops its connection and is reconnected under the
+	// publishes, which buffer meanwhile.
+	runConcurrently(200,
+		func(i int) { processMessage(locationMessage("phone", 1700000000+int64(i))) },
+		func(i int) { processMessage(locationMessage("tablet", 1700000000+int64(i))) },
+		func(i int) {
+			if i%2 == 0 {
+				target.Disconnect(0)
+			} else {
+				reconnectClients()
+			}
+			time.Sleep(time.Millisecond)
+		},
+		func(int) { checkIdle(start) },
+		func(int) { checkHealth() },
+		func(int) { dumpState() },
+		func(int) { collectStats() },
+		func(int) { flushTargetBuffer() },
+		func(int) { reloadConfig(path, nil) },
+	)
+	target.Connect()
+	flushTargetBuffer()
+
+	if got := running.targetBuffer.len(); got != 0 {
+		t.Errorf("%d messages left in the buffer, want 0", got)
+	}
+	if got := target.topics(); got != 2 {
+		t.Errorf("published to %d topics, want 2", got)
+	}
+	state := dumpState()
+	for _, device := range []string{"owntracks/anna/phone", "owntracks/anna/tablet"} {
+		if got := state.Devices[device].Tst; got != 1700000199 {
+			t.Errorf("last tst of %s = %d, want 1700000199", device, got)
+		}
+	}
+}
+
+func TestReloadConfigWhileProcessing(t *testing.T) {
+	path, target := startTestBridge(t, "warn")
+	cfg := currentConfig()
+	// A reload of a broken file is refused and keeps the config.
+	broken := filepath.Join(filepath.Dir(path), "broken.yaml")
+	if err := os.WriteFile(broken, []byte("mappings: ["), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	runConcurrently(200,
+		func(i int) { processMessage(locationMessage("phone", 1700000000+int64(i))) },
+		func(int) { reloadConfig(path, nil) },
+		func(int) { reloadConfig(broken, nil) },
+		func(int) { checkIdle(time.Now()) },
+		func(int) { checkHealth() },
+	)
+
+	if currentConfig() == cfg {
+		t.Error("config was not reloaded")
+	}
+	if len(currentConfig().AllMappings()) != 1 {
+		t.Errorf("reloaded config has %d mappings, want 1", len(currentConfig().AllMappings()))
+	}
+	if got := target.topics(); got != 1 {
+		t.Errorf("published to %d topics, want 1", got)
+	}
+	if !checkHealth().Healthy {
+		t.Error("checkHealth() reports the bridge unhealthy")
+	}
+}
+
+func TestRecordMessageTimeConcurrent(t *testing.T) {
+	useBridge(t, newBridge())
+	cfg := &config.Config{Mappings: map[string]config.Mapping{"owntracks/+/+": {Target: "ha/{user}/{device}"}}}
+	running.config.Store(cfg)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				recordMessageTime(currentConfig(), "owntracks/anna/phone", start.Add(time.Duration(i)*time.Second))
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				// What the idle watchdog, the health check and a reload do.
+				running.lastMessage.Load()
+				running.lastFilterMessage.Load("owntracks/+/+")
+				running.config.Store(cfg)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if last := time.Unix(0, running.lastMessage.Load()); last.Before(start) {
+		t.Errorf("last message at %v, want at or after %v", last, start)
+	}
+	if _, ok := running.lastFilterMessage.Load("owntracks/+/+"); !ok {
+		t.Error("no last message recorded for the mapping filter")
+	}
+}
+
+func TestFilterReasonConcurrent(t *testing.T) {
+	useBridge(t, newBridge())
+	location := converter.Location{Lat: 52.1, Lon: 4.3}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				running.addFilter(namedFilter{name: "keep", filter: keepFilter(true)})
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if reason := filterReason("owntracks/anna/phone", location); reason != "" {
+					t.Errorf("filterReason() = %q, want no rejection", reason)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	running.addFilter(namedFilter{name: "drop", filter: keepFilter(false)})
+	if reason := filterReason("owntracks/anna/phone", location); reason != "filter_drop" {
+		t.Errorf("filterReason() = %q, want filter_drop", reason)
+	}
+}
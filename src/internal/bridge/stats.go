@@ -0,0 +1,95 @@
+package bridge
+
+import (
+	"encoding/json"
+	"log/slog"
+	"time"
+)
+
+// startedAt is when the bridge started, for the uptime in the statistics.
+var startedAt = time.Now()
+
+// bridgeStats is the retained document published on stats_topic. It holds
+// the counters of the metrics endpoint for brokers without Prometheus.
+type bridgeStats struct {
+	Version          string                  `json:"version"`
+	Started          time.Time               `json:"started"`
+	UptimeSeconds    int64                   `json:"uptime_seconds"`
+	MessagesReceived int64                   `json:"messages_received"`
+	Converted        int64                   `json:"messages_converted"`
+	Rejected         map[string]int64        `json:"messages_rejected"`
+	Publishes        map[string]int64        `json:"publishes"`
+	Buffered         int                     `json:"buffered_messages"`
+	LastMessage      *time.Time              `json:"last_message,omitempty"`
+	Mappings         map[string]mappingStats `json:"mappings"`
+}
+
+// mappingStats are the statistics of one mapping filter.
+type mappingStats struct {
+	Messages    int64      `json:"messages"`
+	LastMessage *time.Time `json:"last_message,omitempty"`
+}
+
+func collectStats() bridgeStats {
+	now := time.Now()
+	stats := bridgeStats{
+		Version:          version,
+		Started:          startedAt.UTC().Truncate(time.Second),
+		UptimeSeconds:    int64(now.Sub(startedAt).Seconds()),
+		MessagesReceived: int64(messagesReceived.value("")),
+		Converted:        int64(messagesConverted.value("")),
+		Rejected:         counts(messagesRejected),
+		Publishes:        counts(publishes),
+		Buffered:         running.targetBuffer.len(),
+		Mappings:         map[string]mappingStats{},
+	}
+	if nanos := running.lastMessage.Load(); nanos > 0 {
+		last := time.Unix(0, nanos).UTC().Truncate(time.Second)
+		stats.LastMessage = &last
+	}
+	for filter := range currentConfig().AllMappings() {
+		mapping := mappingStats{Messages: int64(mappingMessages.value(filter))}
+		if seconds := lastMessageSeconds.value(filter); seconds > 0 {
+			last := time.Unix(int64(seconds), 0).UTC()
+			mapping.LastMessage = &last
+		}
+		stats.Mappings[filter] = mapping
+	}
+	return stats
+}
+
+func counts(m *metric) map[string]int64 {
+	values := m.snapshot()
+	result := make(map[string]int64, len(values))
+	for label, value := range values {
+		result[label] = int64(value)
+	}
+	return result
+}
+
+// publishStats publishes the statistics to stats_topic on the target broker
+// every stats_interval_seconds. It follows reloads of both settings; a
+// standby leaves it to the leader.
+func publishStats() {
+	for {
+		cfg := currentConfig()
+		interval := time.Duration(cfg.StatsIntervalSeconds) * time.Second
+		if interval <= 0 {
+			interval = time.Minute
+		}
+		client := running.clients.target()
+		if cfg.StatsTopic != "" && client != nil && client.IsConnectionOpen() && isLeader() && !running.shuttingDown.Load() {
+			payload, err := json.Marshal(collectStats())
+			if err != nil {
+				slog.Error("Error encoding statistics", "error", err)
+			} else if token := client.Publish(cfg.StatsTopic, byte(cfg.QoS), true, payload); !token.WaitTimeout(5 * time.Second) {
+				slog.Warn("Timed out publishing statistics", "topic", cfg.StatsTopic)
+			} else if token.Error() != nil {
+				slog.Error("Failed to publish statistics", "topic", cfg.StatsTopic, "error", token.Error())
+			} else {
+				slog.Debug("Published statistics", "topic", cfg.StatsTopic)
+			}
+		}
+		time.Sleep(interval)
+	}
+}
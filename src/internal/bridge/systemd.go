@@ -0,0 +1,57 @@
+package bridge
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends a state to the systemd service manager over NOTIFY_SOCKET.
+// It does nothing when the bridge was not started by systemd with
+// Type=notify.
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	// A leading @ names a socket in the abstract namespace.
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		slog.Warn("Failed to notify systemd", "state", state, "error", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		slog.Warn("Failed to notify systemd", "state", state, "error", err)
+	}
+}
+
+// watchdogInterval returns how often systemd expects a WATCHDOG=1 ping: half
+// of WatchdogSec, as sd_watchdog_enabled recommends.
+func watchdogInterval() (time.Duration, bool) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, false
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, false
+	}
+	return time.Duration(usec) * time.Microsecond / 2, true
+}
+
+// runWatchdog pings the systemd watchdog for as long as the bridge is alive,
+// so systemd restarts a bridge whose message processing has hung.
+func runWatchdog(interval time.Duration) {
+	for range time.Tick(interval) {
+		if workers := running.workers.Load(); workers != nil && workers.stalled(interval) {
+			slog.Error("Message workers made no progress, skipping the watchdog ping")
+			continue
+		}
+		sdNotify("WATCHDOG=1")
+	}
+}
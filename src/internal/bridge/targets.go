@@ -0,0 +1,183 @@
+package bridge
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+
+	"owntracks2ha/internal/config"
+	"owntracks2ha/internal/mqttclient"
+)
+
+// connectTargets connects to the brokers of the targets list. Like the
+// outputs they connect in the background, so a target that is down does not
+// hold up the bridge or target_broker.
+func connectTargets(cfg *config.Config) error {
+	for _, target := range cfg.Targets {
+		opts, err := targetOptions(cfg, target)
+		if err != nil {
+			return err
+		}
+		slog.Info("Connecting to Target MQTT broker", "target", target.Name, "broker", opts.Servers[0].String())
+		client := mqttclient.New(opts, cfg.ProtocolVersion, cfg.SessionExpirySeconds)
+		running.clients.addTarget(target.Name, client)
+		client.Connect()
+	}
+	return nil
+}
+
+// targetOptions builds the client options of a target from the targets
+// list.
+func targetOptions(cfg *config.Config, target config.TargetSettings) (*MQTT.ClientOptions, error) {
+	useTLS := target.TLS.TLSEnabled(cfg.UseTLS)
+	broker, err := mqttclient.BrokerURL(target.Broker, target.Port, useTLS, target.Transport)
+	if err != nil {
+		return nil, err
+	}
+	user, pass, err := mqttclient.Credentials(target.Auth, target.User, target.Pass)
+	if err != nil {
+		return nil, err
+	}
+	var tlsConfig *tls.Config
+	if useTLS || mqttclient.URLUsesTLS(broker) {
+		if tlsConfig, err = mqttclient.BuildTLSConfig(target.TLS); err != nil {
+			return nil, err
+		}
+	}
+
+	name := target.Name
+	opts := mqttclient.Options([]string{broker}, clientID(target.ClientID, "ot2ha_target"), user, pass, tlsConfig, cfg.ProtocolVersion)
+	mqttclient.ApplyConnectionSettings(opts, cfg)
+	if cfg.StatusTopic != "" {
+		opts.SetWill(target.RewriteTopic(cfg.StatusTopic), statusOffline, byte(cfg.QoS), true)
+	}
+	opts.SetOnConnectHandler(func(client MQTT.Client) {
+		brokerConnected.set(name, 1)
+		slog.Info("Connected to Target MQTT broker", "target", name, "broker", broker)
+		if cfg := currentConfig(); cfg.StatusTopic != "" {
+			if settings, ok := cfg.Target(name); ok {
+				go publishStatus(client, settings.RewriteTopic(cfg.StatusTopic), statusOnline)
+			}
+		}
+		go publishRetained(namedClient{name, client})
+	})
+	opts.SetConnectionLostHandler(func(_ MQTT.Client, err error) {
+		brokerConnected.set(name, 0)
+		slog.Warn("Target MQTT connection lost", "target", name, "error", err)
+	})
+	return opts, nil
+}
+
+// publishExtraTargets publishes a target message to the targets list. It
+// does not wait for the brokers; failures are logged and counted.
+func publishExtraTargets(cfg *config.Config, msg pendingMessage) {
+	targets := running.clients.extraTargets()
+	if len(targets) == 0 {
+		return
+	}
+	if msg.retained {
+		running.retainedMessages.Store(msg.topic, msg)
+	}
+	for _, target := range targets {
+		// A retained message is sent once the target connects.
+		if msg.retained && !target.client.IsConnectionOpen() {
+			continue
+		}
+		publishToTarget(cfg, target, msg)
+	}
+}
+
+// publishRetained sends the retained target messages to a target that
+// connected.
+func publishRetained(target namedClient) {
+	cfg := currentConfig()
+	running.retainedMessages.Range(func(_, value any) bool {
+		publishToTarget(cfg, target, value.(pendingMessage))
+		return true
+	})
+}
+
+// publishToTarget publishes msg to a target of the targets list, with the
+// topic rewritten and QoS and retain overridden as configured.
+func publishToTarget(cfg *config.Config, target namedClient, msg pendingMessage) {
+	settings, ok := cfg.Target(target.name)
+	if !ok {
+		return
+	}
+	out := mqttclient.Message{
+		Topic:                settings.RewriteTopic(msg.topic),
+		QoS:                  msg.qos,
+		Retained:             msg.retained,
+		Payload:              msg.payload,
+		MessageExpirySeconds: cfg.MessageExpirySeconds,
+		SourceTopic:          msg.sourceTopic,
+	}
+	if settings.QoS != nil {
+		out.QoS = byte(*settings.QoS)
+	}
+	if isDiscoveryTopic(cfg, msg.topic) {
+		out.Payload = rewriteDiscoveryTopics(settings, msg.payload)
+	} else if settings.Retain != nil {
+		out.Retained = *settings.Retain
+	}
+
+	token := mqttclient.Publish(target.client, out)
+	go func() {
+		switch {
+		case !token.WaitTimeout(10 * time.Second):
+			targetPublishes.inc(target.name + ",failure")
+			slog.Warn("Timed out publishing to target", "target", target.name, "topic", out.Topic)
+		case token.Error() != nil:
+			targetPublishes.inc(target.name + ",failure")
+			slog.Warn("Failed to publish to target", "target", target.name, "topic", out.Topic, "error", token.Error())
+		default:
+			targetPublishes.inc(target.name + ",success")
+		}
+	}()
+}
+
+// isDiscoveryTopic reports whether topic is that of a Home Assistant
+// discovery config.
+func isDiscoveryTopic(cfg *config.Config, topic string) bool {
+	prefix := cfg.DiscoveryPrefix
+	if prefix == "" {
+		prefix = "homeassistant"
+	}
+	return strings.HasPrefix(topic, prefix+"/") && strings.HasSuffix(topic, "/config")
+}
+
+// rewriteDiscoveryTopics rewrites the topics a discovery config names, such
+// as state_topic and the availability topics, for a target of the targets
+// list, so its Home Assistant follows the rewritten topics.
+func rewriteDiscoveryTopics(target config.TargetSettings, payload []byte) []byte {
+	if len(target.TopicPrefixes) == 0 {
+		return payload
+	}
+	var discovery map[string]interface{}
+	if err := json.Unmarshal(payload, &discovery); err != nil {
+		return payload
+	}
+	for key, value := range discovery {
+		if topic, ok := value.(string); ok && strings.HasSuffix(key, "_topic") {
+			discovery[key] = target.RewriteTopic(topic)
+		}
+	}
+	if availability, ok := discovery["availability"].([]interface{}); ok {
+		for _, entry := range availability {
+			if entry, ok := entry.(map[string]interface{}); ok {
+				if topic, ok := entry["topic"].(string); ok {
+					entry["topic"] = target.RewriteTopic(topic)
+				}
+			}
+		}
+	}
+	rewritten, err := json.Marshal(discovery)
+	if err != nil {
+		return payload
+	}
+	return rewritten
+}
@@ -0,0 +1,197 @@
+package bridge
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strconv"
+
+	"owntracks2ha/internal/config"
+	"owntracks2ha/internal/mqttclient"
+	"owntracks2ha/internal/plugin"
+	"owntracks2ha/internal/script"
+)
+
+// ValidateCommand runs "owntracks2ha validate", which parses a config file
+// and reports every problem found without connecting to a broker. It
+// returns 1 when the config has errors; warnings alone pass.
+func ValidateCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	configPath := flags.String("config", "config/config.yaml", "path to the config file (YAML, JSON or TOML)")
+	configFormat := flags.String("config-format", "", "config file format: yaml, json or toml (defaults to the file extension)")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg, err := config.ReadFormat(*configPath, *configFormat)
+	if err != nil {
+		fmt.Fprintf(stdout, "%s: error: %v\n", *configPath, err)
+		return 1
+	}
+	problems := append(cfg.Validate(), validateSettings(cfg)...)
+
+	locator := config.NewLocator(*configPath, *configFormat)
+	files := make([]string, len(problems))
+	lines := make([]int, len(problems))
+	for i, problem := range problems {
+		files[i], lines[i] = locator.Find(problem.Path)
+	}
+	order := make([]int, len(problems))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		if files[order[a]] != files[order[b]] {
+			return files[order[a]] < files[order[b]]
+		}
+		return lines[order[a]] < lines[order[b]]
+	})
+
+	var errors, warnings int
+	for _, i := range order {
+		problem, location := problems[i], files[i]
+		if lines[i] > 0 {
+			location += ":" + strconv.Itoa(lines[i])
+		}
+		severity := "error"
+		if problem.Warning {
+			severity = "warning"
+			warnings++
+		} else {
+			errors++
+		}
+		fmt.Fprintf(stdout, "%s: %s: %s: %s\n", location, severity, problem.Setting(), problem.Message)
+	}
+	if errors > 0 {
+		fmt.Fprintf(stdout, "%s: %d error(s), %d warning(s)\n", *configPath, errors, warnings)
+		return 1
+	}
+	fmt.Fprintf(stdout, "%s: OK (%d warning(s))\n", *configPath, warnings)
+	return 0
+}
+
+// validateSettings checks the settings Run needs beyond config.Validate:
+// the brokers, TLS files, logging, transform scripts and plugin types.
+func validateSettings(cfg *config.Config) []config.Problem {
+	var problems []config.Problem
+	fail := func(err error, path ...string) {
+		problems = append(problems, config.Problem{Path: path, Message: err.Error()})
+	}
+
+	if len(cfg.SourceBroker) == 0 && len(cfg.Sources) == 0 && cfg.HTTPListen == "" {
+		fail(fmt.Errorf("source_broker or sources is required unless http_listen is set"), "source_broker")
+	}
+	if len(cfg.SourceBroker) > 0 {
+		useTLS := cfg.SourceTLS.TLSEnabled(cfg.UseTLS)
+		brokers, err := mqttclient.BrokerURLs(cfg.SourceBroker, cfg.SourcePort, useTLS, cfg.SourceTransport)
+		if _, _, err := mqttclient.Credentials(cfg.SourceAuth, cfg.SourceUser, cfg.SourcePass); err != nil {
+			fail(err, "source_auth")
+		}
+		if err != nil {
+			fail(err, "source_transport")
+		} else if useTLS || slices.ContainsFunc(brokers, mqttclient.URLUsesTLS) {
+			if _, err := mqttclient.BuildTLSConfig(cfg.SourceTLS); err != nil {
+				fail(err, "source_tls")
+			}
+		}
+	}
+	switch {
+	case cfg.Output == "ha_rest":
+		if cfg.HAURL == "" {
+			fail(fmt.Errorf("ha_url is required with output ha_rest"), "ha_url")
+		}
+	case len(cfg.TargetBroker) == 0 && cfg.SingleBroker && len(cfg.SourceBroker) > 0:
+	case len(cfg.TargetBroker) == 0:
+		fail(fmt.Errorf("target_broker is required unless output is ha_rest or single_broker is set"), "target_broker")
+	default:
+		useTLS := cfg.TargetTLS.TLSEnabled(cfg.UseTLS)
+		brokers, err := mqttclient.BrokerURLs(cfg.TargetBroker, cfg.TargetPort, useTLS, cfg.TargetTransport)
+		if _, _, err := mqttclient.Credentials(cfg.TargetAuth, cfg.TargetUser, cfg.TargetPass); err != nil {
+			fail(err, "target_auth")
+		}
+		if err != nil {
+			fail(err, "target_transport")
+		} else if useTLS || slices.ContainsFunc(brokers, mqttclient.URLUsesTLS) {
+			if _, err := mqttclient.BuildTLSConfig(cfg.TargetTLS); err != nil {
+				fail(err, "target_tls")
+			}
+		}
+	}
+
+	if err := configureLogging(cfg); err != nil {
+		setting := "log_level"
+		if cfg.LogFormat != "" && cfg.LogFormat != "text" && cfg.LogFormat != "json" {
+			setting = "log_format"
+		}
+		fail(err, setting)
+	}
+	checkScripts := func(mappings map[string]config.Mapping, path ...string) {
+		for filter, mapping := range mappings {
+			if mapping.Script != "" {
+				if _, err := script.Load(mapping.Script); err != nil {
+					fail(err, append(path, filter, "script")...)
+				}
+			}
+		}
+	}
+	checkScripts(cfg.Mappings, "mappings")
+	for i, source := range cfg.Sources {
+		index := strconv.Itoa(i)
+		if source.Broker != "" {
+			if _, err := sourceOptions(cfg, source); err != nil {
+				fail(err, "sources", index)
+			}
+		}
+		checkScripts(source.Mappings, "sources", index, "mappings")
+	}
+	for i, target := range cfg.Targets {
+		if target.Broker != "" {
+			if _, err := targetOptions(cfg, target); err != nil {
+				fail(err, "targets", strconv.Itoa(i))
+			}
+		}
+	}
+
+	for i, output := range cfg.Outputs {
+		if output.Type != "" {
+			if err := plugin.CheckOutputType(output.Type); err != nil {
+				fail(err, "outputs", strconv.Itoa(i), "type")
+			}
+		}
+		if output.Type == "mqtt" {
+			if _, _, err := mqttclient.Credentials(output.Auth, output.User, output.Pass); err != nil {
+				fail(err, "outputs", strconv.Itoa(i), "auth")
+			}
+		}
+		if output.Type == "webhook" {
+			if _, err := webhookTemplate(output.Body); err != nil {
+				fail(err, "outputs", strconv.Itoa(i), "body")
+			}
+		}
+	}
+	for i, n := range cfg.Notifications {
+		for key, text := range map[string]string{"enter_message": n.EnterMessage, "leave_message": n.LeaveMessage} {
+			if _, err := notificationTemplate(text); text != "" && err != nil {
+				fail(err, "notifications", strconv.Itoa(i), key)
+			}
+		}
+	}
+	for i, input := range cfg.Inputs {
+		if input.Type != "" {
+			if err := plugin.CheckInputType(input.Type); err != nil {
+				fail(err, "inputs", strconv.Itoa(i), "type")
+			}
+		}
+	}
+	for i, filter := range cfg.Filters {
+		if filter.Type != "" {
+			if err := plugin.CheckFilterType(filter.Type); err != nil {
+				fail(err, "filters", strconv.Itoa(i), "type")
+			}
+		}
+	}
+	return problems
+}
@@ -0,0 +1,165 @@
+package bridge
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"owntracks2ha/converter"
+	"owntracks2ha/internal/config"
+	"owntracks2ha/internal/plugin"
+)
+
+var webhookClient = http.Client{Timeout: 10 * time.Second}
+
+// webhookOutput sends locations to a URL: the converted JSON payload, or the
+// body template rendered from it.
+type webhookOutput struct {
+	name     string
+	settings config.OutputSettings
+	method   string
+	body     *template.Template
+}
+
+// webhookData is what body templates see, e.g. {{.Payload.latitude}} or
+// {{.Device}}.
+type webhookData struct {
+	Topic       string
+	SourceTopic string
+	User        string
+	Device      string
+	Payload     map[string]interface{}
+	Message     converter.Location
+	Received    time.Time
+}
+
+// webhookTemplate parses a body template; json renders a value as JSON.
+func webhookTemplate(body string) (*template.Template, error) {
+	if body == "" {
+		return nil, nil
+	}
+	t, err := template.New("body").Option("missingkey=zero").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			data, err := json.Marshal(v)
+			return string(data), err
+		},
+	}).Parse(body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid body template: %w", err)
+	}
+	return t, nil
+}
+
+func newWebhookOutput(name string, settings config.OutputSettings) (*webhookOutput, error) {
+	if settings.URL == "" {
+		return nil, errors.New("url is required for webhook outputs")
+	}
+	body, err := webhookTemplate(settings.Body)
+	if err != nil {
+		return nil, err
+	}
+	method := strings.ToUpper(settings.Method)
+	if method == "" {
+		method = http.MethodPost
+	}
+	return &webhookOutput{name: name, settings: settings, method: method, body: body}, nil
+}
+
+// Send delivers a location, retrying failed requests up to retries times
+// with the backoff of publish retries. Client errors other than 429 are not
+// retried, as the same request would fail again.
+func (o *webhookOutput) Send(location plugin.Location) error {
+	body, err := o.render(location)
+	if err != nil {
+		return err
+	}
+	_, captures, _ := currentConfig().MatchMapping(location.SourceTopic)
+	url := config.ExpandTopic(o.settings.URL, location.SourceTopic, captures)
+	headers := make(map[string]string, len(o.settings.Headers))
+	for key, value := range o.settings.Headers {
+		headers[key] = config.ExpandTopic(value, location.SourceTopic, captures)
+	}
+
+	backoff := time.Duration(o.settings.RetryBackoffMs) * time.Millisecond
+	if backoff <= 0 {
+		backoff = 500 * time.Millisecond
+	}
+	for attempt := 0; ; attempt++ {
+		retry, err := o.request(url, headers, body, location.SourceTopic)
+		if err == nil || !retry || attempt >= o.settings.Retries || running.shuttingDown.Load() {
+			return err
+		}
+		delay := retryDelay(backoff, attempt)
+		slog.Warn("Webhook request failed, retrying", "output", o.name, "topic", location.SourceTopic, "attempt", attempt+1, "retry_in", delay, "error", err)
+		time.Sleep(delay)
+	}
+}
+
+// render returns the request body of a location.
+func (o *webhookOutput) render(location plugin.Location) ([]byte, error) {
+	if o.body == nil {
+		return location.Payload, nil
+	}
+	data := webhookData{
+		Topic:       location.TargetTopic,
+		SourceTopic: location.SourceTopic,
+		Message:     location.Source,
+		Received:    location.Received,
+	}
+	if levels := strings.Split(location.SourceTopic, "/"); len(levels) >= 3 {
+		data.User, data.Device = levels[1], levels[2]
+	}
+	if err := json.Unmarshal(location.Payload, &data.Payload); err != nil {
+		return nil, fmt.Errorf("decoding payload for the body template: %w", err)
+	}
+	var body bytes.Buffer
+	if err := o.body.Execute(&body, data); err != nil {
+		return nil, fmt.Errorf("rendering body template: %w", err)
+	}
+	return body.Bytes(), nil
+}
+
+// request sends one request and reports whether a failure is worth
+// retrying.
+func (o *webhookOutput) request(url string, headers map[string]string, body []byte, sourceTopic string) (bool, error) {
+	req, err := http.NewRequest(o.method, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	if o.body == nil {
+		req.Header.Set("Content-Type", "application/json")
+	} else {
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	req.Header.Set("X-OwnTracks-Topic", sourceTopic)
+	switch {
+	case o.settings.Token != "":
+		req.Header.Set("Authorization", "Bearer "+o.settings.Token)
+	case o.settings.User != "":
+		req.SetBasicAuth(o.settings.User, o.settings.Pass)
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return false, nil
+}
+
+func (o *webhookOutput) Close() {}
@@ -0,0 +1,81 @@
+package bridge
+
+import (
+	"hash/fnv"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// workerPool processes messages on a fixed number of goroutines. Messages of
+// one source topic always go to the same worker, so each device is handled
+// in order while a slow publish for one device does not hold up the others.
+type workerPool struct {
+	queues  []chan MQTT.Message
+	pending sync.WaitGroup
+	// lastProcessed is when a worker last finished a message, in Unix
+	// nanoseconds.
+	lastProcessed atomic.Int64
+}
+
+func newWorkerPool(workers, queueSize int, process func(MQTT.Message)) *workerPool {
+	if workers <= 0 {
+		workers = 4
+	}
+	if queueSize <= 0 {
+		queueSize = 100
+	}
+	p := &workerPool{queues: make([]chan MQTT.Message, workers)}
+	p.lastProcessed.Store(time.Now().UnixNano())
+	for i := range p.queues {
+		queue := make(chan MQTT.Message, queueSize)
+		p.queues[i] = queue
+		go func() {
+			for msg := range queue {
+				process(msg)
+				p.lastProcessed.Store(time.Now().UnixNano())
+				p.pending.Done()
+			}
+		}()
+	}
+	return p
+}
+
+// submit queues msg on the worker of its topic. It never blocks the MQTT
+// client: when the queue is full the message is dropped.
+func (p *workerPool) submit(msg MQTT.Message) {
+	h := fnv.New32a()
+	h.Write([]byte(msg.Topic()))
+	queue := p.queues[h.Sum32()%uint32(len(p.queues))]
+
+	p.pending.Add(1)
+	select {
+	case queue <- msg:
+	default:
+		p.pending.Done()
+		messagesRejected.inc("queue_full")
+		slog.Warn("Worker queue full, dropping message", "topic", msg.Topic(), "worker_queue_size", cap(queue))
+	}
+}
+
+// wait returns once every queued message has been processed.
+func (p *workerPool) wait() {
+	p.pending.Wait()
+}
+
+// stalled reports whether messages are queued but no worker finished one
+// within window.
+func (p *workerPool) stalled(window time.Duration) bool {
+	if time.Since(time.Unix(0, p.lastProcessed.Load())) < window {
+		return false
+	}
+	for _, queue := range p.queues {
+		if len(queue) > 0 {
+			return true
+		}
+	}
+	return false
+}
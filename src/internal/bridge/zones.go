@@ -0,0 +1,236 @@
+package bridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"owntracks2ha/converter"
+	"owntracks2ha/internal/config"
+)
+
+// zone is a circular area a location can be in.
+type zone struct {
+	name     string
+	lat, lon float64
+	radius   float64
+}
+
+// notHome is the location_name of a device outside every zone, as Home
+// Assistant calls it.
+const notHome = "not_home"
+
+// defaultZoneRadius applies to configured zones without a radius.
+const defaultZoneRadius = 100
+
+// zonesEnabled reports whether the bridge resolves zones itself.
+func zonesEnabled(cfg *config.Config) bool {
+	return len(cfg.Zones) > 0 || cfg.ImportHAZones
+}
+
+// locationNameEnabled reports whether locations get a location_name, from
+// the zones or from the regions or WiFi networks the phone reports.
+func locationNameEnabled(cfg *config.Config) bool {
+	return zonesEnabled(cfg) || len(cfg.RegionZones) > 0 || len(cfg.WiFiZones) > 0
+}
+
+// loadZones builds the zone list from the config and, when import_ha_zones
+// is set, the zones defined in Home Assistant. A failed import keeps the
+// configured zones.
+func loadZones(cfg *config.Config) {
+	var zones []zone
+	for _, z := range cfg.Zones {
+		radius := z.Radius
+		if radius <= 0 {
+			radius = defaultZoneRadius
+		}
+		zones = append(zones, zone{name: z.Name, lat: z.Latitude, lon: z.Longitude, radius: radius})
+	}
+	if cfg.ImportHAZones {
+		imported, err := fetchHomeAssistantZones(cfg)
+		if err != nil {
+			slog.Error("Failed to import zones from Home Assistant", "error", err)
+		} else {
+			zones = append(zones, imported...)
+			slog.Info("Imported zones from Home Assistant", "zones", len(imported))
+		}
+	}
+	running.knownZones.Store(&zones)
+}
+
+// zoneAt returns the name of the zone a position is in. Of overlapping zones
+// the smallest wins, as in Home Assistant.
+func zoneAt(lat, lon float64) (string, bool) {
+	zones := running.knownZones.Load()
+	if zones == nil {
+		return "", false
+	}
+	var best *zone
+	for i, z := range *zones {
+		if distanceMeters(lat, lon, z.lat, z.lon) > z.radius {
+			continue
+		}
+		if best == nil || z.radius < best.radius {
+			best = &(*zones)[i]
+		}
+	}
+	if best == nil {
+		return "", false
+	}
+	return best.name, true
+}
+
+// regionZone returns the zone of the first region_zones entry whose region
+// the phone reports being in, so the order of region_zones is the priority
+// of overlapping regions.
+func regionZone(cfg *config.Config, inRegions []string) (string, bool) {
+	for _, rz := range cfg.RegionZones {
+		if containsString(inRegions, rz.Region) {
+			return rz.Zone, true
+		}
+	}
+	return "", false
+}
+
+// wifiZone returns the zone of the first wifi_zones entry for the WiFi
+// network the phone is connected to. BSSIDs are compared ignoring case, as
+// phones differ in how they write them.
+func wifiZone(cfg *config.Config, source converter.Location) (string, bool) {
+	if source.BSSID == "" && source.SSID == "" {
+		return "", false
+	}
+	for _, wz := range cfg.WiFiZones {
+		if wz.BSSID != "" && strings.EqualFold(wz.BSSID, source.BSSID) || wz.BSSID == "" && wz.SSID == source.SSID {
+			return wz.Zone, true
+		}
+	}
+	return "", false
+}
+
+// geofenceRule returns the first geofence rule of the mapping the location
+// falls under.
+func geofenceRule(cfg *config.Config, mapping config.Mapping, source converter.Location) (config.GeofenceRule, bool) {
+	for _, rule := range mapping.Geofence {
+		var inside bool
+		if rule.Zone != "" {
+			inside = inNamedZone(cfg, rule.Zone, source)
+		} else {
+			inside = inPolygon(rule.Polygon, source.Lat, source.Lon)
+		}
+		if inside != rule.Outside {
+			return rule, true
+		}
+	}
+	return config.GeofenceRule{}, false
+}
+
+// inNamedZone reports whether a location is within a zone of that name, or
+// lists a region or WiFi network that region_zones or wifi_zones map to it.
+func inNamedZone(cfg *config.Config, name string, source converter.Location) bool {
+	for _, rz := range cfg.RegionZones {
+		if rz.Zone == name && containsString(source.InRegions, rz.Region) {
+			return true
+		}
+	}
+	if zone, ok := wifiZone(cfg, source); ok && zone == name {
+		return true
+	}
+	if zones := running.knownZones.Load(); zones != nil && zonesEnabled(cfg) {
+		for _, z := range *zones {
+			if z.name == name && distanceMeters(source.Lat, source.Lon, z.lat, z.lon) <= z.radius {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// inPolygon reports whether a point is inside a polygon of [latitude,
+// longitude] corners, by counting the edges a ray from it crosses.
+func inPolygon(polygon [][2]float64, lat, lon float64) bool {
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		a, b := polygon[i], polygon[j]
+		if (a[0] > lat) != (b[0] > lat) && lon < (b[1]-a[1])*(lat-a[0])/(b[0]-a[0])+a[1] {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// homeLocation returns the home_latitude and home_longitude setting, or the
+// center of the zone named "home" when they are not set.
+func homeLocation(cfg *config.Config) (lat, lon float64, ok bool) {
+	if cfg.HomeLatitude != 0 || cfg.HomeLongitude != 0 {
+		return cfg.HomeLatitude, cfg.HomeLongitude, true
+	}
+	if zones := running.knownZones.Load(); zones != nil && zonesEnabled(cfg) {
+		for _, z := range *zones {
+			if z.name == "home" {
+				return z.lat, z.lon, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// haState is an entity state returned by the Home Assistant REST API.
+type haState struct {
+	EntityID   string `json:"entity_id"`
+	Attributes struct {
+		FriendlyName string  `json:"friendly_name"`
+		Latitude     float64 `json:"latitude"`
+		Longitude    float64 `json:"longitude"`
+		Radius       float64 `json:"radius"`
+		Passive      bool    `json:"passive"`
+	} `json:"attributes"`
+}
+
+// fetchHomeAssistantZones reads the zone entities from Home Assistant.
+// Passive zones are skipped since they never become a device state, and the
+// home zone is named "home" like the state Home Assistant gives it.
+func fetchHomeAssistantZones(cfg *config.Config) ([]zone, error) {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(cfg.HAURL, "/")+"/api/states", nil)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.HAToken != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.HAToken)
+	}
+
+	resp, err := homeAssistantClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		io.Copy(io.Discard, resp.Body)
+		return nil, fmt.Errorf("home assistant returned %s", resp.Status)
+	}
+
+	var states []haState
+	if err := json.NewDecoder(resp.Body).Decode(&states); err != nil {
+		return nil, err
+	}
+	var zones []zone
+	for _, state := range states {
+		id, ok := strings.CutPrefix(state.EntityID, "zone.")
+		if !ok || state.Attributes.Passive {
+			continue
+		}
+		name := state.Attributes.FriendlyName
+		if id == "home" || name == "" {
+			name = id
+		}
+		zones = append(zones, zone{
+			name:   name,
+			lat:    state.Attributes.Latitude,
+			lon:    state.Attributes.Longitude,
+			radius: state.Attributes.Radius,
+		})
+	}
+	return zones, nil
+}
@@ -0,0 +1,171 @@
+package config
+
+import (
+	_ "embed"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// exampleConfig is the commented example config written by "config init",
+// a copy of config/config.yaml at the repository root: go:embed cannot reach
+// outside the module, so edit that file and run go generate.
+// TestExampleConfigInSync fails when the two differ.
+//
+//go:generate cp ../../../config/config.yaml example.yaml
+//go:embed example.yaml
+var exampleConfig []byte
+
+// masked replaces secrets in "config show".
+const masked = "********"
+
+// Command runs "owntracks2ha config", whose subcommands write an example
+// config (init) or print the effective configuration (show).
+func Command(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprintln(stderr, "usage: owntracks2ha config init|show [-config config/config.yaml]")
+		return 2
+	}
+	switch args[0] {
+	case "init":
+		return initCommand(args[1:], stdout, stderr)
+	case "show":
+		return showCommand(args[1:], stdout, stderr)
+	}
+	fmt.Fprintf(stderr, "unknown config command %q (expected init or show)\n", args[0])
+	return 2
+}
+
+// initCommand writes the example config to -config, or to stdout for -.
+func initCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("config init", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	configPath := flags.String("config", "config/config.yaml", "where to write the example config, - for stdout")
+	force := flags.Bool("force", false, "overwrite an existing file")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if *configPath == "-" {
+		stdout.Write(exampleConfig)
+		return 0
+	}
+	if _, err := os.Stat(*configPath); err == nil && !*force {
+		fmt.Fprintf(stderr, "%s already exists; pass -force to overwrite it\n", *configPath)
+		return 1
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if err := os.MkdirAll(filepath.Dir(*configPath), 0o755); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if err := os.WriteFile(*configPath, exampleConfig, 0o600); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	fmt.Fprintf(stdout, "Wrote the example config to %s\n", *configPath)
+	return 0
+}
+
+// showCommand prints the configuration the bridge would run with: the
+// config file with its includes, environment overrides and defaults
+// applied and secrets masked.
+func showCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("config show", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	configPath := flags.String("config", "config/config.yaml", "path to the config file (YAML, JSON or TOML)")
+	configFormat := flags.String("config-format", "", "config file format: yaml, json or toml (defaults to the file extension)")
+	showSecrets := flags.Bool("show-secrets", false, "print passwords, tokens and keys instead of masking them")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg, err := ReadFormat(*configPath, *configFormat)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	var node yaml.Node
+	if err := node.Encode(cfg); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	prepareShow(&node, reflect.ValueOf(cfg), !*showSecrets)
+	encoder := yaml.NewEncoder(stdout)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&node); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// prepareShow adjusts an encoded value v for printing: unset lists, which
+// select the default, show as null rather than as empty lists, and with
+// mask the settings tagged secret are masked. Secrets that are maps, such
+// as encryption_keys, keep their keys.
+func prepareShow(node *yaml.Node, v reflect.Value, mask bool) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+	switch {
+	case v.Kind() == reflect.Slice && v.IsNil():
+		*node = yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}
+	case node.Kind == yaml.SequenceNode && v.Kind() == reflect.Slice:
+		for i, child := range node.Content {
+			if i < v.Len() {
+				prepareShow(child, v.Index(i), mask)
+			}
+		}
+	case node.Kind == yaml.MappingNode && v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if value := v.MapIndex(reflect.ValueOf(node.Content[i].Value).Convert(v.Type().Key())); value.IsValid() {
+				prepareShow(node.Content[i+1], value, mask)
+			}
+		}
+	case node.Kind == yaml.MappingNode && v.Kind() == reflect.Struct:
+		fields := map[string]int{}
+		for i := 0; i < v.NumField(); i++ {
+			if name := strings.Split(v.Type().Field(i).Tag.Get("yaml"), ",")[0]; name != "" && name != "-" {
+				fields[name] = i
+			}
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			field, ok := fields[node.Content[i].Value]
+			if !ok {
+				continue
+			}
+			if mask && v.Type().Field(field).Tag.Get("secret") == "true" {
+				maskValue(node.Content[i+1])
+				continue
+			}
+			prepareShow(node.Content[i+1], v.Field(field), mask)
+		}
+	}
+}
+
+func maskValue(node *yaml.Node) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if node.Value != "" {
+			node.Value, node.Tag, node.Style = masked, "!!str", 0
+		}
+	case yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			maskValue(node.Content[i])
+		}
+	}
+}
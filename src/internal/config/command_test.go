@@ -0,0 +1,17 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestExampleConfigInSync(t *testing.T) {
+	root, err := os.ReadFile("../../../config/config.yaml")
+	if err != nil {
+		t.Skipf("config/config.yaml not found: %v", err)
+	}
+	if !bytes.Equal(root, exampleConfig) {
+		t.Error("internal/config/example.yaml differs from config/config.yaml; edit config/config.yaml and run go generate ./internal/config")
+	}
+}
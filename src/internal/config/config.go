@@ -0,0 +1,794 @@
+// Package config holds the owntracks2ha configuration: the YAML file
+// layout, OT2HA_* environment overrides and the mapping lookups.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+type Config struct {
+	SourceBroker               Brokers            `yaml:"source_broker"`
+	SourcePort                 int                `yaml:"source_port"`
+	SourceUser                 string             `yaml:"source_user"`
+	SourcePass                 string             `yaml:"source_pass" secret:"true"`
+	SourceAuth                 string             `yaml:"source_auth"`
+	TargetBroker               Brokers            `yaml:"target_broker"`
+	TargetPort                 int                `yaml:"target_port"`
+	TargetUser                 string             `yaml:"target_user"`
+	TargetPass                 string             `yaml:"target_pass" secret:"true"`
+	TargetAuth                 string             `yaml:"target_auth"`
+	UseTLS                     bool               `yaml:"use_tls"`
+	SourceTransport            string             `yaml:"source_transport"`
+	TargetTransport            string             `yaml:"target_transport"`
+	SourceClientID             string             `yaml:"source_client_id"`
+	TargetClientID             string             `yaml:"target_client_id"`
+	CleanSession               *bool              `yaml:"clean_session"`
+	SharedSubscriptionGroup    string             `yaml:"shared_subscription_group"`
+	LeaderElectionTopic        string             `yaml:"leader_election_topic"`
+	LeaderLeaseSeconds         int                `yaml:"leader_lease_seconds"`
+	InstanceID                 string             `yaml:"instance_id"`
+	Output                     string             `yaml:"output"`
+	HAURL                      string             `yaml:"ha_url"`
+	HAToken                    string             `yaml:"ha_token" secret:"true"`
+	HAWebhookID                string             `yaml:"ha_webhook_id"`
+	SingleBroker               bool               `yaml:"single_broker"`
+	HTTPListen                 string             `yaml:"http_listen"`
+	HTTPPath                   string             `yaml:"http_path"`
+	HTTPGetPath                string             `yaml:"http_get_path"`
+	HTTPUser                   string             `yaml:"http_user"`
+	HTTPPass                   string             `yaml:"http_pass" secret:"true"`
+	RunMode                    string             `yaml:"run_mode"`
+	OnceMessageCount           int                `yaml:"once_message_count"`
+	OnceTimeoutSeconds         int                `yaml:"once_timeout_seconds"`
+	QoS                        int                `yaml:"qos"`
+	ProtocolVersion            int                `yaml:"protocol_version"`
+	SessionExpirySeconds       int                `yaml:"session_expiry_seconds"`
+	MessageExpirySeconds       int                `yaml:"message_expiry_seconds"`
+	KeepAliveSeconds           int                `yaml:"keepalive_seconds"`
+	ConnectTimeoutSeconds      int                `yaml:"connect_timeout_seconds"`
+	MaxReconnectSeconds        int                `yaml:"max_reconnect_interval_seconds"`
+	WriteTimeoutSeconds        int                `yaml:"write_timeout_seconds"`
+	Debug                      bool               `yaml:"debug"`
+	LogFormat                  string             `yaml:"log_format"`
+	LogLevel                   string             `yaml:"log_level"`
+	Mappings                   map[string]Mapping `yaml:"mappings"`
+	ExitOnIdle                 bool               `yaml:"exit_on_idle"`
+	IdleTimeoutSeconds         int                `yaml:"idle_timeout_seconds"`
+	IdleAction                 string             `yaml:"idle_action"`
+	DiscoveryEnabled           bool               `yaml:"discovery_enabled"`
+	DiscoveryPrefix            string             `yaml:"discovery_prefix"`
+	RequestLocationTopic       string             `yaml:"request_location_topic"`
+	PassthroughFields          []string           `yaml:"passthrough_fields"`
+	EncryptionKey              string             `yaml:"encryption_key" secret:"true"`
+	EncryptionKeys             map[string]string  `yaml:"encryption_keys" secret:"true"`
+	SourceTLS                  TLSSettings        `yaml:"source_tls"`
+	TargetTLS                  TLSSettings        `yaml:"target_tls"`
+	TransitionTopic            string             `yaml:"transition_topic"`
+	ZonesTopic                 string             `yaml:"zones_topic"`
+	CardTopic                  string             `yaml:"card_topic"`
+	BeaconTopic                string             `yaml:"beacon_topic"`
+	Beacons                    []BeaconRoom       `yaml:"beacons"`
+	BatteryTopic               string             `yaml:"battery_topic"`
+	AvailabilityTopic          string             `yaml:"availability_topic"`
+	BufferSize                 int                `yaml:"buffer_size"`
+	BufferOverflow             string             `yaml:"buffer_overflow"`
+	BufferFile                 string             `yaml:"buffer_file"`
+	RecordFile                 string             `yaml:"record_file"`
+	RecordMaxSizeMB            int                `yaml:"record_max_size_mb"`
+	RecordMaxFiles             int                `yaml:"record_max_files"`
+	PublishRetries             int                `yaml:"publish_retries"`
+	PublishRetryBackoffMs      int                `yaml:"publish_retry_backoff_ms"`
+	PublishErrorThreshold      int                `yaml:"exit_on_publish_error_threshold"`
+	MetricsListen              string             `yaml:"metrics_listen"`
+	HealthListen               string             `yaml:"health_listen"`
+	DrainTimeoutSeconds        int                `yaml:"drain_timeout_seconds"`
+	ConfigWatchIntervalSeconds int                `yaml:"config_watch_interval_seconds"`
+	AllowNullIsland            bool               `yaml:"allow_null_island"`
+	MaxGPSAccuracy             int                `yaml:"max_gps_accuracy"`
+	MaxGPSAccuracyOverrides    map[string]int     `yaml:"max_gps_accuracy_overrides"`
+	GPSAccuracyAction          string             `yaml:"gps_accuracy_action"`
+	ConnectionRules            []ConnectionRule   `yaml:"connection_rules"`
+	MaxAgeSeconds              int                `yaml:"max_age_seconds"`
+	StaleAction                string             `yaml:"stale_action"`
+	MaxSpeedKmh                float64            `yaml:"max_speed_kmh"`
+	DropDuplicates             *bool              `yaml:"drop_duplicates"`
+	Smoothing                  bool               `yaml:"smoothing"`
+	SmoothingProcessNoise      float64            `yaml:"smoothing_process_noise"`
+	RateLimitPerMinute         float64            `yaml:"rate_limit_per_minute"`
+	RateLimitBurst             int                `yaml:"rate_limit_burst"`
+	Units                      string             `yaml:"units"`
+	PressureUnit               string             `yaml:"pressure_unit"`
+	SeaLevelPressureHPa        float64            `yaml:"sea_level_pressure_hpa"`
+	CoordinatePrecision        int                `yaml:"coordinate_precision"`
+	Workers                    int                `yaml:"workers"`
+	WorkerQueueSize            int                `yaml:"worker_queue_size"`
+	StatusTopic                string             `yaml:"status_topic"`
+	StatsTopic                 string             `yaml:"stats_topic"`
+	StatsIntervalSeconds       int                `yaml:"stats_interval_seconds"`
+	CommandTopic               string             `yaml:"command_topic"`
+	CommandToken               string             `yaml:"command_token" secret:"true"`
+	ReverseMappings            map[string]string  `yaml:"reverse_mappings"`
+	PauseAvailability          string             `yaml:"pause_availability"`
+	DeadLetterTopic            string             `yaml:"dead_letter_topic"`
+	GeocoderURL                string             `yaml:"geocoder_url"`
+	GeocoderProvider           string             `yaml:"geocoder_provider"`
+	GeocoderCacheFile          string             `yaml:"geocoder_cache_file"`
+	GeocoderIntervalSeconds    int                `yaml:"geocoder_interval_seconds"`
+	GeocoderLanguage           string             `yaml:"geocoder_language"`
+	InfluxDBURL                string             `yaml:"influxdb_url"`
+	InfluxDBToken              string             `yaml:"influxdb_token" secret:"true"`
+	InfluxDBOrg                string             `yaml:"influxdb_org"`
+	InfluxDBBucket             string             `yaml:"influxdb_bucket"`
+	InfluxDBMeasurement        string             `yaml:"influxdb_measurement"`
+	History                    HistorySettings    `yaml:"history"`
+	Vault                      VaultSettings      `yaml:"vault"`
+	Sources                    []SourceSettings   `yaml:"sources"`
+	Targets                    []TargetSettings   `yaml:"targets"`
+	Outputs                    []OutputSettings   `yaml:"outputs"`
+	Inputs                     []PluginSettings   `yaml:"inputs"`
+	Filters                    []PluginSettings   `yaml:"filters"`
+	Zones                      []ZoneSettings     `yaml:"zones"`
+	ImportHAZones              bool               `yaml:"import_ha_zones"`
+	RegionZones                []RegionZone       `yaml:"region_zones"`
+	WiFiZones                  []WiFiZone         `yaml:"wifi_zones"`
+	HomeLatitude               float64            `yaml:"home_latitude"`
+	HomeLongitude              float64            `yaml:"home_longitude"`
+
+	// Notifications are sent when a device enters or leaves a zone.
+	Notifications []NotificationSettings `yaml:"notifications"`
+}
+
+// Brokers is a broker setting: a host or URL, or a list of them for
+// failover. The client tries them in order on every (re)connect and uses the
+// first that accepts the connection.
+type Brokers []string
+
+// UnmarshalYAML accepts a single broker as well as a list.
+func (b *Brokers) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var broker string
+	if err := unmarshal(&broker); err == nil {
+		*b = nil
+		if broker != "" {
+			*b = Brokers{broker}
+		}
+		return nil
+	}
+	var brokers []string
+	if err := unmarshal(&brokers); err != nil {
+		return err
+	}
+	*b = brokers
+	return nil
+}
+
+// MarshalYAML writes a single broker as a plain string.
+func (b Brokers) MarshalYAML() (interface{}, error) {
+	if len(b) == 1 {
+		return b[0], nil
+	}
+	return []string(b), nil
+}
+
+// hasHost reports whether one of the brokers is a host rather than a URL,
+// so it connects on the port setting.
+func (b Brokers) hasHost() bool {
+	for _, broker := range b {
+		if !strings.Contains(broker, "://") {
+			return true
+		}
+	}
+	return false
+}
+
+// Mapping describes how messages from one source topic (or topic filter) are
+// forwarded. In YAML it is either just the target topic or a block with
+// per-mapping delivery options, filters and field overrides.
+type Mapping struct {
+	Target              string            `yaml:"target" json:"target"`
+	QoS                 *int              `yaml:"qos" json:"qos"`
+	Retain              bool              `yaml:"retain" json:"retain"`
+	EncryptionKey       string            `yaml:"encryption_key" json:"encryption_key" secret:"true"`
+	MaxGPSAccuracy      *int              `yaml:"max_gps_accuracy" json:"max_gps_accuracy"`
+	MinDistanceM        float64           `yaml:"min_distance_m" json:"min_distance_m"`
+	MinIntervalS        int               `yaml:"min_interval_s" json:"min_interval_s"`
+	QuietHours          []QuietHours      `yaml:"quiet_hours" json:"quiet_hours"`
+	Geofence            []GeofenceRule    `yaml:"geofence" json:"geofence"`
+	TriggerRules        []TriggerRule     `yaml:"trigger_rules" json:"trigger_rules"`
+	PassthroughFields   []string          `yaml:"passthrough_fields" json:"passthrough_fields"`
+	CoordinatePrecision *int              `yaml:"coordinate_precision" json:"coordinate_precision"`
+	RenameFields        map[string]string `yaml:"rename_fields" json:"rename_fields"`
+	DropFields          []string          `yaml:"drop_fields" json:"drop_fields"`
+	// StaticAttributes are added to every location of the mapping.
+	StaticAttributes map[string]interface{} `yaml:"static_attributes" json:"static_attributes"`
+	// Script is a Starlark transform script the payload is passed through.
+	Script string `yaml:"script" json:"script"`
+	// OutputStyle is "json" (the default), publishing the payload to the
+	// target, or "state_attributes", publishing location_name to
+	// <target>/state and the payload to <target>/attributes.
+	OutputStyle string `yaml:"output_style" json:"output_style"`
+	// Passthrough forwards the messages of the mapping unchanged to the
+	// target, without decrypting or converting them, e.g. for OwnTracks cmd
+	// topics or topics that are not OwnTracks at all.
+	Passthrough bool `yaml:"passthrough" json:"passthrough"`
+}
+
+// TriggerRule decides by why the phone published a location, its OwnTracks
+// trigger (t) given as the letter or its name, what a mapping does with it:
+// Action forward skips quiet_hours and throttling, drop drops it, and
+// without an action MinIntervalS replaces the min_interval_s of the mapping.
+type TriggerRule struct {
+	Triggers     []string `yaml:"triggers" json:"triggers"`
+	Action       string   `yaml:"action" json:"action"`
+	MinIntervalS int      `yaml:"min_interval_s" json:"min_interval_s"`
+}
+
+// GeofenceRule decides by its position what a mapping does with a location:
+// inside the zone or polygon (or outside, with outside set) it drops, forwards
+// or blurs it. Polygons list [latitude, longitude] corners.
+type GeofenceRule struct {
+	Zone      string       `yaml:"zone" json:"zone"`
+	Polygon   [][2]float64 `yaml:"polygon" json:"polygon"`
+	Outside   bool         `yaml:"outside" json:"outside"`
+	Action    string       `yaml:"action" json:"action"`
+	Precision *int         `yaml:"precision" json:"precision"`
+}
+
+// BlurPrecision returns the coordinate decimals of the blur action, 2
+// (about a kilometer) unless precision is set.
+func (r GeofenceRule) BlurPrecision() int {
+	if r.Precision != nil {
+		return *r.Precision
+	}
+	return 2
+}
+
+// UnmarshalYAML accepts both the plain target topic string and the full
+// mapping block.
+func (m *Mapping) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var target string
+	if err := unmarshal(&target); err == nil {
+		*m = Mapping{Target: target}
+		return nil
+	}
+	type plain Mapping
+	return unmarshal((*plain)(m))
+}
+
+// UnmarshalJSON mirrors UnmarshalYAML for mappings set through OT2HA_MAPPINGS.
+func (m *Mapping) UnmarshalJSON(data []byte) error {
+	var target string
+	if err := json.Unmarshal(data, &target); err == nil {
+		*m = Mapping{Target: target}
+		return nil
+	}
+	type plain Mapping
+	return json.Unmarshal(data, (*plain)(m))
+}
+
+// PublishQoS returns the QoS to publish with, falling back to the global
+// setting.
+func (m Mapping) PublishQoS(fallback int) byte {
+	if m.QoS != nil {
+		return byte(*m.QoS)
+	}
+	return byte(fallback)
+}
+
+// TLSSettings configures TLS for a single broker connection.
+type TLSSettings struct {
+	Enabled            *bool  `yaml:"enabled" json:"enabled"`
+	CAFile             string `yaml:"ca_file" json:"ca_file"`
+	CertFile           string `yaml:"cert_file" json:"cert_file"`
+	KeyFile            string `yaml:"key_file" json:"key_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify" json:"insecure_skip_verify"`
+
+	// MinVersion is the oldest TLS version accepted, "1.2" or "1.3"
+	// (default). CipherSuites restricts the TLS 1.2 cipher suites by their
+	// Go names; TLS 1.3 suites are not configurable.
+	MinVersion   string   `yaml:"min_version" json:"min_version"`
+	CipherSuites []string `yaml:"cipher_suites" json:"cipher_suites"`
+
+	// ServerName is the name sent for SNI and checked against the broker
+	// certificate, for brokers reached by an IP address or an internal name.
+	// ALPN lists the protocols offered during the handshake, such as
+	// x-amzn-mqtt-ca for AWS IoT on port 443.
+	ServerName string   `yaml:"server_name" json:"server_name"`
+	ALPN       []string `yaml:"alpn" json:"alpn"`
+}
+
+// TLSEnabled reports whether TLS is used for a broker, falling back to the
+// global use_tls setting when the broker block does not set enabled.
+func (t TLSSettings) TLSEnabled(fallback bool) bool {
+	if t.Enabled != nil {
+		return *t.Enabled
+	}
+	return fallback
+}
+
+// DropDuplicatesEnabled reports whether locations repeating the last one
+// forwarded for their device are dropped, which they are unless
+// drop_duplicates is false.
+func (c *Config) DropDuplicatesEnabled() bool {
+	return c.DropDuplicates == nil || *c.DropDuplicates
+}
+
+// CleanSessionEnabled reports whether the source connection starts a fresh
+// session, which it does unless clean_session is false.
+func (c *Config) CleanSessionEnabled() bool {
+	return c.CleanSession == nil || *c.CleanSession
+}
+
+// SourceSettings configures a further source broker, such as a cloud broker
+// next to a local one. Its messages go through the same conversion and
+// publishing as those of source_broker. Mappings are the topics subscribed
+// on this broker; without them it subscribes to the top-level mappings.
+type SourceSettings struct {
+	// Name identifies the source in logs and metrics and defaults to the
+	// broker host.
+	Name      string             `yaml:"name" json:"name"`
+	Broker    string             `yaml:"broker" json:"broker"`
+	Port      int                `yaml:"port" json:"port"`
+	User      string             `yaml:"user" json:"user"`
+	Pass      string             `yaml:"pass" json:"pass" secret:"true"`
+	Auth      string             `yaml:"auth" json:"auth"`
+	Transport string             `yaml:"transport" json:"transport"`
+	ClientID  string             `yaml:"client_id" json:"client_id"`
+	TLS       TLSSettings        `yaml:"tls" json:"tls"`
+	Mappings  map[string]Mapping `yaml:"mappings" json:"mappings"`
+}
+
+// TargetSettings configures a further target broker, such as the broker of
+// a test Home Assistant next to production. Everything published to
+// target_broker, discovery configs and the bridge status included, is
+// published to it as well.
+type TargetSettings struct {
+	// Name identifies the target in logs and metrics and defaults to the
+	// broker host.
+	Name      string      `yaml:"name" json:"name"`
+	Broker    string      `yaml:"broker" json:"broker"`
+	Port      int         `yaml:"port" json:"port"`
+	User      string      `yaml:"user" json:"user"`
+	Pass      string      `yaml:"pass" json:"pass" secret:"true"`
+	Auth      string      `yaml:"auth" json:"auth"`
+	Transport string      `yaml:"transport" json:"transport"`
+	ClientID  string      `yaml:"client_id" json:"client_id"`
+	TLS       TLSSettings `yaml:"tls" json:"tls"`
+
+	// TopicPrefixes rewrites the topics published: the longest key a topic
+	// starts with is replaced by its value, so {"": "test/"} moves every
+	// topic below test/. The topics named in discovery configs are rewritten
+	// alike.
+	TopicPrefixes map[string]string `yaml:"topic_prefixes" json:"topic_prefixes"`
+	// QoS and Retain override those of the publishes. Discovery configs and
+	// the bridge status stay retained.
+	QoS    *int  `yaml:"qos" json:"qos"`
+	Retain *bool `yaml:"retain" json:"retain"`
+}
+
+// RewriteTopic returns topic with its prefix rewritten by TopicPrefixes.
+func (t TargetSettings) RewriteTopic(topic string) string {
+	match, found := "", false
+	for prefix := range t.TopicPrefixes {
+		if strings.HasPrefix(topic, prefix) && (!found || len(prefix) > len(match)) {
+			match, found = prefix, true
+		}
+	}
+	if !found {
+		return topic
+	}
+	return t.TopicPrefixes[match] + strings.TrimPrefix(topic, match)
+}
+
+// OutputSettings configures an additional sink every converted location is
+// sent to, next to the target broker or Home Assistant. Type is mqtt (another
+// broker), webhook (an HTTP POST of the converted payload) or influxdb.
+type OutputSettings struct {
+	Name    string `yaml:"name" json:"name"`
+	Type    string `yaml:"type" json:"type"`
+	Enabled *bool  `yaml:"enabled" json:"enabled"`
+
+	// Topic, QoS and Retain apply to mqtt outputs. Topic takes the same
+	// placeholders as mapping targets and defaults to the mapping target.
+	Topic           string      `yaml:"topic" json:"topic"`
+	QoS             *int        `yaml:"qos" json:"qos"`
+	Retain          bool        `yaml:"retain" json:"retain"`
+	Broker          string      `yaml:"broker" json:"broker"`
+	Port            int         `yaml:"port" json:"port"`
+	User            string      `yaml:"user" json:"user"`
+	Pass            string      `yaml:"pass" json:"pass" secret:"true"`
+	Auth            string      `yaml:"auth" json:"auth"`
+	Transport       string      `yaml:"transport" json:"transport"`
+	ProtocolVersion int         `yaml:"protocol_version" json:"protocol_version"`
+	TLS             TLSSettings `yaml:"tls" json:"tls"`
+
+	// URL and Headers apply to webhook and influxdb outputs; Token, Org,
+	// Bucket and Measurement to influxdb.
+	URL         string            `yaml:"url" json:"url"`
+	Headers     map[string]string `yaml:"headers" json:"headers" secret:"true"`
+	Token       string            `yaml:"token" json:"token" secret:"true"`
+	Org         string            `yaml:"org" json:"org"`
+	Bucket      string            `yaml:"bucket" json:"bucket"`
+	Measurement string            `yaml:"measurement" json:"measurement"`
+
+	// Method, Body, Retries and RetryBackoffMs apply to webhook outputs,
+	// which also send User and Pass as basic auth and Token as a bearer
+	// token. Body is a text/template rendered from the converted payload.
+	Method         string `yaml:"method" json:"method"`
+	Body           string `yaml:"body" json:"body"`
+	Retries        int    `yaml:"retries" json:"retries"`
+	RetryBackoffMs int    `yaml:"retry_backoff_ms" json:"retry_backoff_ms"`
+
+	// Mappings limits the output to the locations of these mapping filters.
+	Mappings []string `yaml:"mappings" json:"mappings"`
+
+	// Options holds the settings of output types added as plugins.
+	Options map[string]interface{} `yaml:"options" json:"options"`
+}
+
+// OutputEnabled reports whether the output is used; outputs are enabled
+// unless they set enabled: false.
+func (o OutputSettings) OutputEnabled() bool {
+	return o.Enabled == nil || *o.Enabled
+}
+
+// PluginSettings configures an input or filter. Type selects the registered
+// implementation and Options holds its settings.
+type PluginSettings struct {
+	Name    string                 `yaml:"name" json:"name"`
+	Type    string                 `yaml:"type" json:"type"`
+	Enabled *bool                  `yaml:"enabled" json:"enabled"`
+	Options map[string]interface{} `yaml:"options" json:"options"`
+}
+
+// PluginEnabled reports whether the input or filter is used; they are
+// enabled unless they set enabled: false.
+func (p PluginSettings) PluginEnabled() bool {
+	return p.Enabled == nil || *p.Enabled
+}
+
+// StringOption returns option key as a string, or fallback when it is not
+// set.
+func (p PluginSettings) StringOption(key, fallback string) string {
+	value, ok := p.Options[key]
+	if !ok || value == nil {
+		return fallback
+	}
+	return fmt.Sprint(value)
+}
+
+// IntOption returns option key as an integer, or fallback when it is not
+// set.
+func (p PluginSettings) IntOption(key string, fallback int) (int, error) {
+	value, ok := p.Options[key]
+	if !ok || value == nil {
+		return fallback, nil
+	}
+	switch v := value.(type) {
+	case int:
+		return v, nil
+	case int64:
+		return int(v), nil
+	case float64:
+		if v == float64(int(v)) {
+			return int(v), nil
+		}
+	case string:
+		if n, err := strconv.Atoi(v); err == nil {
+			return n, nil
+		}
+	}
+	return 0, fmt.Errorf("option %s: %v is not a whole number", key, value)
+}
+
+// ConnectionRule drops (Action drop) or flags (Action flag) the locations
+// sent over a connection type, the OwnTracks conn of w, o or m, whose
+// accuracy is worse than AccuracyAbove meters, such as cell tower fixes over
+// mobile data.
+type ConnectionRule struct {
+	Conn          string `yaml:"conn" json:"conn"`
+	AccuracyAbove int    `yaml:"accuracy_above" json:"accuracy_above"`
+	Action        string `yaml:"action" json:"action"`
+}
+
+// WiFiZone maps the WiFi network a phone is connected to, by its access
+// point (BSSID) or, without one, its name (SSID), to the Home Assistant zone
+// used as location_name.
+type WiFiZone struct {
+	BSSID string `yaml:"bssid" json:"bssid"`
+	SSID  string `yaml:"ssid" json:"ssid"`
+	Zone  string `yaml:"zone" json:"zone"`
+}
+
+// BeaconRoom maps an iBeacon, by its UUID and optionally its major and
+// minor, to the room its presence is published for.
+type BeaconRoom struct {
+	UUID  string `yaml:"uuid" json:"uuid"`
+	Major *int   `yaml:"major" json:"major"`
+	Minor *int   `yaml:"minor" json:"minor"`
+	Room  string `yaml:"room" json:"room"`
+}
+
+// Matches reports whether the room is the one of a beacon.
+func (b BeaconRoom) Matches(uuid string, major, minor int) bool {
+	return strings.EqualFold(b.UUID, uuid) &&
+		(b.Major == nil || *b.Major == major) &&
+		(b.Minor == nil || *b.Minor == minor)
+}
+
+// RegionZone maps an OwnTracks region, as listed in inregions, to the Home
+// Assistant zone name used as location_name.
+type RegionZone struct {
+	Region string `yaml:"region" json:"region"`
+	Zone   string `yaml:"zone" json:"zone"`
+}
+
+// ZoneSettings defines a zone the bridge resolves locations to. Radius is in
+// meters.
+type ZoneSettings struct {
+	Name      string  `yaml:"name" json:"name"`
+	Latitude  float64 `yaml:"latitude" json:"latitude"`
+	Longitude float64 `yaml:"longitude" json:"longitude"`
+	Radius    float64 `yaml:"radius" json:"radius"`
+}
+
+// NotificationSettings configures a push notification for the zone changes
+// the bridge detects with zones, region_zones or wifi_zones. Type is ntfy
+// (URL is the topic URL), gotify (URL is the server) or telegram (Token is
+// the bot token, ChatID the chat to write to). Zones, Devices and Events
+// ("enter", "leave") limit it; every change is sent when they are empty.
+type NotificationSettings struct {
+	Name         string   `yaml:"name" json:"name"`
+	Type         string   `yaml:"type" json:"type"`
+	URL          string   `yaml:"url" json:"url"`
+	Token        string   `yaml:"token" json:"token" secret:"true"`
+	ChatID       string   `yaml:"chat_id" json:"chat_id"`
+	Title        string   `yaml:"title" json:"title"`
+	Zones        []string `yaml:"zones" json:"zones"`
+	Devices      []string `yaml:"devices" json:"devices"`
+	Events       []string `yaml:"events" json:"events"`
+	EnterMessage string   `yaml:"enter_message" json:"enter_message"`
+	LeaveMessage string   `yaml:"leave_message" json:"leave_message"`
+}
+
+// HistorySettings configures the local location history.
+type HistorySettings struct {
+	SQLitePath string `yaml:"sqlite_path"`
+	// ExportDir receives daily GPX (ExportFormat gpx, the default) or
+	// GeoJSON track files per device of the forwarded locations.
+	ExportDir    string `yaml:"export_dir"`
+	ExportFormat string `yaml:"export_format"`
+	// RecorderDir receives the forwarded locations in the store layout of
+	// OwnTracks Recorder, and APIListen serves the Recorder HTTP API from
+	// the database at SQLitePath, so Recorder tools and frontends keep
+	// working.
+	RecorderDir string `yaml:"recorder_dir"`
+	APIListen   string `yaml:"api_listen"`
+}
+
+// Read parses the config file and applies OT2HA_* environment overrides on
+// top. A missing file is fine when the configuration comes entirely from the
+// environment. The format follows the file extension, see ReadFormat.
+func Read(filename string) (*Config, error) {
+	return ReadFormat(filename, "")
+}
+
+// ReadFormat is Read for a config file in format (yaml, json or toml); an
+// empty format is taken from the extension, .json or .toml, and is YAML
+// otherwise. The files the config file includes, or the files of a config
+// directory, are merged into one configuration.
+func ReadFormat(filename, format string) (*Config, error) {
+	format, err := FileFormat(filename, format)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	_, err = os.Stat(filename)
+	switch {
+	case errors.Is(err, fs.ErrNotExist) && hasEnvOverrides():
+		slog.Info("Config file not found, using environment variables only", "file", filename)
+	case err != nil:
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	default:
+		docs, err := readDocuments(filename, format)
+		if err != nil {
+			return nil, err
+		}
+		root, err := mergeDocuments(docs)
+		if err != nil {
+			return nil, err
+		}
+		if err := resolveSecretTags(root); err != nil {
+			return nil, err
+		}
+		if err := resolveSecretFileKeys(root, reflect.TypeOf(cfg)); err != nil {
+			return nil, err
+		}
+		if err := resolveVaultTags(root); err != nil {
+			return nil, err
+		}
+		if len(root.Content) > 0 {
+			if err := root.Decode(cfg); err != nil {
+				return nil, fmt.Errorf("failed to parse config file: %w", err)
+			}
+		}
+	}
+
+	if err := applyEnvOverrides(reflect.ValueOf(cfg).Elem(), envPrefix); err != nil {
+		return nil, err
+	}
+	cfg.applyDefaults()
+	return cfg, nil
+}
+
+// applyDefaults fills in settings left unset whose zero value is not the
+// default.
+func (c *Config) applyDefaults() {
+	if c.RunMode == "" {
+		c.RunMode = "daemon"
+	}
+	if c.SourcePort == 0 && c.SourceBroker.hasHost() {
+		c.SourcePort = DefaultPort(c.SourceTransport, c.SourceTLS.TLSEnabled(c.UseTLS))
+	}
+	if c.TargetPort == 0 && c.TargetBroker.hasHost() {
+		c.TargetPort = DefaultPort(c.TargetTransport, c.TargetTLS.TLSEnabled(c.UseTLS))
+	}
+	for i, source := range c.Sources {
+		if source.Name == "" {
+			c.Sources[i].Name = brokerHost(source.Broker)
+		}
+		if source.Port == 0 && source.Broker != "" && !strings.Contains(source.Broker, "://") {
+			c.Sources[i].Port = DefaultPort(source.Transport, source.TLS.TLSEnabled(c.UseTLS))
+		}
+	}
+	for i, target := range c.Targets {
+		if target.Name == "" {
+			c.Targets[i].Name = brokerHost(target.Broker)
+		}
+		if target.Port == 0 && target.Broker != "" && !strings.Contains(target.Broker, "://") {
+			c.Targets[i].Port = DefaultPort(target.Transport, target.TLS.TLSEnabled(c.UseTLS))
+		}
+	}
+	for i, output := range c.Outputs {
+		if output.Type == "mqtt" && output.Port == 0 && output.Broker != "" && !strings.Contains(output.Broker, "://") {
+			c.Outputs[i].Port = DefaultPort(output.Transport, output.TLS.TLSEnabled(c.UseTLS))
+		}
+	}
+}
+
+// brokerHost returns the host of a broker setting, which is either a host or
+// a URL such as wss://mqtt.example.com/mqtt.
+func brokerHost(broker string) string {
+	if _, host, ok := strings.Cut(broker, "://"); ok {
+		host, _, _ = strings.Cut(host, "/")
+		return host
+	}
+	return broker
+}
+
+// DefaultPort returns the standard port of a broker transport: 1883 for
+// MQTT, 8883 with TLS and 80 or 443 for websockets.
+func DefaultPort(transport string, useTLS bool) int {
+	switch transport {
+	case "ssl", "tls", "mqtts":
+		return 8883
+	case "ws":
+		if useTLS {
+			return 443
+		}
+		return 80
+	case "wss":
+		return 443
+	}
+	if useTLS {
+		return 8883
+	}
+	return 1883
+}
+
+// envPrefix is prepended to the upper-cased YAML key to form the environment
+// variable name, e.g. source_broker is read from OT2HA_SOURCE_BROKER and
+// source_tls.ca_file from OT2HA_SOURCE_TLS_CA_FILE.
+const envPrefix = "OT2HA_"
+
+func hasEnvOverrides() bool {
+	for _, env := range os.Environ() {
+		if strings.HasPrefix(env, envPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyEnvOverrides walks the YAML fields of v and replaces every field that
+// has a matching environment variable.
+func applyEnvOverrides(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		key := prefix + strings.ToUpper(name)
+
+		if field.Type.Kind() == reflect.Struct {
+			if err := applyEnvOverrides(v.Field(i), key+"_"); err != nil {
+				return err
+			}
+			continue
+		}
+
+		raw, ok := os.LookupEnv(key)
+		if path, isFile := os.LookupEnv(key + "_FILE"); !ok && isFile && field.Type.Kind() == reflect.String {
+			secret, err := readSecretFile(path)
+			if err != nil {
+				return fmt.Errorf("%s_FILE: %w", key, err)
+			}
+			raw, ok = secret, true
+		}
+		if !ok {
+			continue
+		}
+		if err := setFromEnv(v.Field(i), raw); err != nil {
+			return fmt.Errorf("invalid value for %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// setFromEnv parses an environment value into a config field. Scalars use
+// their usual string form, string lists may be comma separated and anything
+// else (such as mappings) is JSON encoded.
+func setFromEnv(field reflect.Value, raw string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case reflect.Ptr:
+		value := reflect.New(field.Type().Elem())
+		if err := setFromEnv(value.Elem(), raw); err != nil {
+			return err
+		}
+		field.Set(value)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(strings.TrimSpace(raw), "[") {
+			var items []string
+			for _, item := range strings.Split(raw, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			field.Set(reflect.ValueOf(items))
+			return nil
+		}
+		return json.Unmarshal([]byte(raw), field.Addr().Interface())
+	default:
+		return json.Unmarshal([]byte(raw), field.Addr().Interface())
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// FileFormat returns the format of a config file: format when set, otherwise
+// the one its extension names. Files without a known extension are YAML.
+func FileFormat(filename, format string) (string, error) {
+	switch strings.ToLower(format) {
+	case "yaml", "yml":
+		return "yaml", nil
+	case "json":
+		return "json", nil
+	case "toml":
+		return "toml", nil
+	case "":
+	default:
+		return "", fmt.Errorf("unknown config format %q (expected yaml, json or toml)", format)
+	}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		return "json", nil
+	case ".toml":
+		return "toml", nil
+	}
+	return "yaml", nil
+}
+
+// parseDocument parses a config file into a YAML document node, which the
+// secret resolution and decoding work on whatever the format. JSON is valid
+// YAML and keeps its line numbers; TOML is decoded and converted, so its
+// settings take the same keys as in YAML, but tags such as !secret_file are
+// not available.
+func parseDocument(data []byte, format string) (*yaml.Node, error) {
+	root := &yaml.Node{}
+	if format != "toml" {
+		if err := yaml.Unmarshal(data, root); err != nil {
+			return nil, err
+		}
+		return root, nil
+	}
+
+	var settings map[string]interface{}
+	if _, err := toml.Decode(string(data), &settings); err != nil {
+		return nil, err
+	}
+	if len(settings) == 0 {
+		return root, nil
+	}
+	var mapping yaml.Node
+	if err := mapping.Encode(settings); err != nil {
+		return nil, err
+	}
+	root.Kind = yaml.DocumentNode
+	root.Content = []*yaml.Node{&mapping}
+	return root, nil
+}
@@ -0,0 +1,287 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// includeKey lists further config files, as glob patterns relative to the
+// main config file, whose settings are merged into it.
+const includeKey = "include"
+
+// document is one parsed file of a configuration.
+type document struct {
+	file string
+	root *yaml.Node
+}
+
+// Files returns the files a configuration is read from: the config file and
+// the files it includes, or the config files of a config directory.
+func Files(filename, format string) ([]string, error) {
+	docs, err := readDocuments(filename, format)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, len(docs))
+	for i, doc := range docs {
+		files[i] = doc.file
+	}
+	return files, nil
+}
+
+// readDocuments parses the files of a configuration. filename is either a
+// config file, read in format, or a directory whose .yaml, .yml, .json and
+// .toml files are read in name order, each in the format of its extension.
+func readDocuments(filename, format string) ([]document, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	if info.IsDir() {
+		entries, err := os.ReadDir(filename)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config directory: %w", err)
+		}
+		var docs []document
+		for _, entry := range entries {
+			switch strings.ToLower(filepath.Ext(entry.Name())) {
+			case ".yaml", ".yml", ".json", ".toml":
+			default:
+				continue
+			}
+			if entry.IsDir() {
+				continue
+			}
+			doc, err := readDocument(filepath.Join(filename, entry.Name()), "")
+			if err != nil {
+				return nil, err
+			}
+			if mappingValue(doc.root, includeKey) != nil {
+				return nil, fmt.Errorf("%s: include is not supported in a config directory", doc.file)
+			}
+			docs = append(docs, doc)
+		}
+		return docs, nil
+	}
+
+	main, err := readDocument(filename, format)
+	if err != nil {
+		return nil, err
+	}
+	docs := []document{main}
+	patterns, err := includePatterns(main)
+	if err != nil {
+		return nil, err
+	}
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(filename), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid include pattern %q: %w", filename, pattern, err)
+		}
+		if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			return nil, fmt.Errorf("%s: included file %s does not exist", filename, pattern)
+		}
+		sort.Strings(matches)
+		for _, match := range matches {
+			doc, err := readDocument(match, "")
+			if err != nil {
+				return nil, err
+			}
+			if mappingValue(doc.root, includeKey) != nil {
+				return nil, fmt.Errorf("%s: include is only read from the main config file", doc.file)
+			}
+			docs = append(docs, doc)
+		}
+	}
+	return docs, nil
+}
+
+// readDocument parses one config file, decrypting it first when it is SOPS
+// encrypted.
+func readDocument(filename, format string) (document, error) {
+	format, err := FileFormat(filename, format)
+	if err != nil {
+		return document{}, err
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return document{}, fmt.Errorf("failed to read config file: %w", err)
+	}
+	root, err := parseDocument(data, format)
+	if err != nil {
+		return document{}, fmt.Errorf("failed to parse config file %s: %w", filename, err)
+	}
+	if format != "toml" && isSOPSEncrypted(root) {
+		if data, err = decryptSOPS(filename, format); err != nil {
+			return document{}, err
+		}
+		if root, err = parseDocument(data, format); err != nil {
+			return document{}, fmt.Errorf("failed to parse decrypted config file %s: %w", filename, err)
+		}
+	}
+	return document{file: filename, root: root}, nil
+}
+
+// includePatterns returns the include patterns of the main config file and
+// removes the include key, which is not a setting of its own.
+func includePatterns(doc document) ([]string, error) {
+	node := doc.root
+	if len(node.Content) == 0 || node.Content[0].Kind != yaml.MappingNode {
+		return nil, nil
+	}
+	node = node.Content[0]
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value != includeKey {
+			continue
+		}
+		var patterns []string
+		value := node.Content[i+1]
+		if value.Kind == yaml.ScalarNode {
+			patterns = []string{value.Value}
+		} else if err := value.Decode(&patterns); err != nil {
+			return nil, fmt.Errorf("%s: line %d: include must be a file pattern or a list of them", doc.file, value.Line)
+		}
+		node.Content = append(node.Content[:i], node.Content[i+2:]...)
+		return patterns, nil
+	}
+	return nil, nil
+}
+
+// mergeDocuments merges the settings of all documents into one document.
+// Sections such as mappings combine; the same setting in two files is an
+// error naming both.
+func mergeDocuments(docs []document) (*yaml.Node, error) {
+	if len(docs) == 1 {
+		return docs[0].root, nil
+	}
+	merged := &yaml.Node{Kind: yaml.DocumentNode}
+	origins := map[*yaml.Node]string{}
+	var record func(node *yaml.Node, file string)
+	record = func(node *yaml.Node, file string) {
+		for i, child := range node.Content {
+			if node.Kind == yaml.MappingNode && i%2 == 0 {
+				origins[child] = file
+			}
+			record(child, file)
+		}
+	}
+	for _, doc := range docs {
+		if len(doc.root.Content) == 0 {
+			continue
+		}
+		content := doc.root.Content[0]
+		if content.Kind != yaml.MappingNode {
+			return nil, fmt.Errorf("%s: line %d: expected a mapping of settings", doc.file, content.Line)
+		}
+		record(content, doc.file)
+		if len(merged.Content) == 0 {
+			merged.Content = []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}
+		}
+		if err := mergeMapping(merged.Content[0], content, doc.file, origins, nil); err != nil {
+			return nil, err
+		}
+	}
+	return merged, nil
+}
+
+// mergeMapping adds the settings of src to dst. origins holds the file each
+// key node comes from.
+func mergeMapping(dst, src *yaml.Node, file string, origins map[*yaml.Node]string, path []string) error {
+	for i := 0; i+1 < len(src.Content); i += 2 {
+		key, value := src.Content[i], src.Content[i+1]
+		var existingKey, existing *yaml.Node
+		for j := 0; j+1 < len(dst.Content); j += 2 {
+			if dst.Content[j].Value == key.Value {
+				existingKey, existing = dst.Content[j], dst.Content[j+1]
+				break
+			}
+		}
+		keyPath := append(append([]string(nil), path...), key.Value)
+		switch {
+		case existing == nil:
+			dst.Content = append(dst.Content, key, value)
+		case existing.Kind == yaml.MappingNode && value.Kind == yaml.MappingNode:
+			if err := mergeMapping(existing, value, file, origins, keyPath); err != nil {
+				return err
+			}
+		default:
+			return errors.New(conflict(keyPath, origins[existingKey], existingKey.Line, file, key.Line))
+		}
+	}
+	return nil
+}
+
+func conflict(path []string, firstFile string, firstLine int, secondFile string, secondLine int) string {
+	at := func(file string, line int) string {
+		if line == 0 {
+			return file
+		}
+		return fmt.Sprintf("%s line %d", file, line)
+	}
+	return fmt.Sprintf("conflicting config files: %s is set in both %s and %s",
+		Problem{Path: path}.Setting(), at(firstFile, firstLine), at(secondFile, secondLine))
+}
+
+// Locator finds the file and line of settings in the files of a
+// configuration, for messages about them.
+type Locator struct {
+	filename string
+	docs     []document
+}
+
+// NewLocator reads the files of a configuration for Find. A configuration
+// that cannot be read yields a locator without line numbers.
+func NewLocator(filename, format string) *Locator {
+	docs, _ := readDocuments(filename, format)
+	return &Locator{filename: filename, docs: docs}
+}
+
+// Find returns the file and line of the setting at path, or of the closest
+// enclosing setting found. The line is 0 when it is not known, as for TOML
+// files.
+func (l *Locator) Find(path []string) (string, int) {
+	file, line, depth := l.filename, 0, 0
+	for _, doc := range l.docs {
+		if len(doc.root.Content) == 0 {
+			continue
+		}
+		found, foundLine := 0, 0
+		node := doc.root.Content[0]
+		for _, part := range path {
+			var next *yaml.Node
+			switch node.Kind {
+			case yaml.MappingNode:
+				for i := 0; i+1 < len(node.Content); i += 2 {
+					if node.Content[i].Value == part {
+						foundLine, next = node.Content[i].Line, node.Content[i+1]
+						break
+					}
+				}
+			case yaml.SequenceNode:
+				if i, err := strconv.Atoi(part); err == nil && i < len(node.Content) {
+					next = node.Content[i]
+					foundLine = next.Line
+				}
+			}
+			if next == nil {
+				break
+			}
+			node = next
+			found++
+		}
+		if found > depth {
+			file, line, depth = doc.file, foundLine, found
+		}
+	}
+	return file, line
+}
@@ -0,0 +1,132 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// QuietHours is a daily window of a mapping, such as 22:00 to 07:00, during
+// which its locations are not forwarded, or only one every min_interval_s.
+// From and To are local times in Timezone (the system's when empty); a window
+// ending before it starts runs past midnight, and one ending when it starts
+// is rejected. Days lists the days the window starts on, all when empty.
+type QuietHours struct {
+	From         string   `yaml:"from" json:"from"`
+	To           string   `yaml:"to" json:"to"`
+	Days         []string `yaml:"days" json:"days"`
+	Timezone     string   `yaml:"timezone" json:"timezone"`
+	MinIntervalS int      `yaml:"min_interval_s" json:"min_interval_s"`
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseClock returns the minutes after midnight of a HH:MM time.
+func parseClock(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q (expected HH:MM)", clock)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// parseWeekday accepts day names such as mon or Monday.
+func parseWeekday(day string) (time.Weekday, bool) {
+	day = strings.ToLower(day)
+	if len(day) < 3 {
+		return 0, false
+	}
+	weekday, ok := weekdays[day[:3]]
+	return weekday, ok && strings.HasPrefix(strings.ToLower(weekday.String()), day)
+}
+
+var locations sync.Map
+
+func loadLocation(name string) (*time.Location, error) {
+	if cached, ok := locations.Load(name); ok {
+		return cached.(*time.Location), nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locations.Store(name, loc)
+	return loc, nil
+}
+
+// check returns the first problem with the window.
+func (q QuietHours) check() error {
+	from, err := parseClock(q.From)
+	if err != nil {
+		return fmt.Errorf("from: %w", err)
+	}
+	to, err := parseClock(q.To)
+	if err != nil {
+		return fmt.Errorf("to: %w", err)
+	}
+	if from == to {
+		return fmt.Errorf("to: same time as from (%s)", q.To)
+	}
+	for _, day := range q.Days {
+		if _, ok := parseWeekday(day); !ok {
+			return fmt.Errorf("days: invalid day %q (expected mon, tue, ... sun)", day)
+		}
+	}
+	if _, err := loadLocation(q.Timezone); err != nil {
+		return fmt.Errorf("timezone: %w", err)
+	}
+	if q.MinIntervalS < 0 {
+		return fmt.Errorf("min_interval_s: negative interval %d", q.MinIntervalS)
+	}
+	return nil
+}
+
+// Contains reports whether t falls within the window. Windows that fail to
+// validate never do.
+func (q QuietHours) Contains(t time.Time) bool {
+	from, errFrom := parseClock(q.From)
+	to, errTo := parseClock(q.To)
+	loc, errLoc := loadLocation(q.Timezone)
+	if errFrom != nil || errTo != nil || errLoc != nil || from == to {
+		return false
+	}
+	local := t.In(loc)
+	minute := local.Hour()*60 + local.Minute()
+	start := local
+	switch {
+	case from < to:
+		if minute < from || minute >= to {
+			return false
+		}
+	case from > to:
+		if minute < to {
+			start = local.AddDate(0, 0, -1)
+		} else if minute < from {
+			return false
+		}
+	}
+	if len(q.Days) == 0 {
+		return true
+	}
+	for _, day := range q.Days {
+		if weekday, ok := parseWeekday(day); ok && weekday == start.Weekday() {
+			return true
+		}
+	}
+	return false
+}
+
+// QuietHoursAt returns the first quiet_hours window of the mapping that t
+// falls within.
+func (m Mapping) QuietHoursAt(t time.Time) (QuietHours, bool) {
+	for _, quiet := range m.QuietHours {
+		if quiet.Contains(t) {
+			return quiet, true
+		}
+	}
+	return QuietHours{}, false
+}
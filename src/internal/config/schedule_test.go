@@ -0,0 +1,50 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuietHoursContains(t *testing.T) {
+	// 2023-11-17 is a Friday.
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2023, 11, day, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name  string
+		quiet QuietHours
+		t     time.Time
+		want  bool
+	}{
+		{"inside", QuietHours{From: "09:00", To: "17:00", Timezone: "UTC"}, at(17, 12, 0), true},
+		{"at the start", QuietHours{From: "09:00", To: "17:00", Timezone: "UTC"}, at(17, 9, 0), true},
+		{"at the end", QuietHours{From: "09:00", To: "17:00", Timezone: "UTC"}, at(17, 17, 0), false},
+		{"before", QuietHours{From: "09:00", To: "17:00", Timezone: "UTC"}, at(17, 8, 59), false},
+		{"past midnight, evening", QuietHours{From: "22:00", To: "07:00", Timezone: "UTC"}, at(17, 23, 0), true},
+		{"past midnight, morning", QuietHours{From: "22:00", To: "07:00", Timezone: "UTC"}, at(18, 6, 59), true},
+		{"past midnight, day", QuietHours{From: "22:00", To: "07:00", Timezone: "UTC"}, at(18, 7, 0), false},
+		{"on a listed day", QuietHours{From: "09:00", To: "17:00", Days: []string{"fri"}, Timezone: "UTC"}, at(17, 12, 0), true},
+		{"on another day", QuietHours{From: "09:00", To: "17:00", Days: []string{"fri"}, Timezone: "UTC"}, at(18, 12, 0), false},
+		{"started the day before", QuietHours{From: "22:00", To: "07:00", Days: []string{"friday"}, Timezone: "UTC"}, at(18, 3, 0), true},
+		{"started on an unlisted day", QuietHours{From: "22:00", To: "07:00", Days: []string{"fri"}, Timezone: "UTC"}, at(17, 3, 0), false},
+		{"in its timezone", QuietHours{From: "22:00", To: "07:00", Timezone: "Europe/Berlin"}, at(17, 21, 30), true},
+		{"equal from and to", QuietHours{From: "07:00", To: "07:00", Timezone: "UTC"}, at(17, 12, 0), false},
+		{"invalid time", QuietHours{From: "25:00", To: "07:00", Timezone: "UTC"}, at(17, 23, 0), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.quiet.Contains(tt.t); got != tt.want {
+				t.Errorf("Contains(%v) = %v, want %v", tt.t, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuietHoursCheck(t *testing.T) {
+	if err := (QuietHours{From: "22:00", To: "07:00"}).check(); err != nil {
+		t.Errorf("check() = %v, want nil", err)
+	}
+	if err := (QuietHours{From: "07:00", To: "07:00"}).check(); err == nil {
+		t.Error("check() of equal from and to returned no error")
+	}
+}
@@ -0,0 +1,119 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// secretFileTag marks a YAML value that is read from the file it names,
+// e.g. source_pass: !secret_file /run/secrets/source_pass.
+const secretFileTag = "!secret_file"
+
+// readSecretFile returns the contents of a secret file without the trailing
+// newline editors and "docker secret create" leave.
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file: %w", err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// setSecret replaces the value of a scalar node by a secret. The tag is
+// resolved again, so a secret works for numeric settings such as ports, but
+// a secret that reads as null stays the string it is.
+func setSecret(node *yaml.Node, secret string) {
+	node.Tag, node.Value, node.Style = "", secret, 0
+	switch secret {
+	case "", "~", "null", "Null", "NULL":
+		node.Tag = "!!str"
+	}
+}
+
+// resolveSecretTags replaces every !secret_file value below node by the
+// contents of its file.
+func resolveSecretTags(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode && node.Tag == secretFileTag {
+		secret, err := readSecretFile(node.Value)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", node.Line, err)
+		}
+		setSecret(node, secret)
+		return nil
+	}
+	for _, child := range node.Content {
+		if err := resolveSecretTags(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveSecretFileKeys replaces every <key>_file setting of a mapping node
+// decoded into t, where <key> is a string setting, by <key> set to the
+// contents of the file. Settings that are files themselves, such as
+// buffer_file, are left alone.
+func resolveSecretFileKeys(node *yaml.Node, t reflect.Type) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case node.Kind == yaml.DocumentNode:
+		for _, child := range node.Content {
+			if err := resolveSecretFileKeys(child, t); err != nil {
+				return err
+			}
+		}
+	case node.Kind == yaml.SequenceNode && t.Kind() == reflect.Slice:
+		for _, child := range node.Content {
+			if err := resolveSecretFileKeys(child, t.Elem()); err != nil {
+				return err
+			}
+		}
+	case node.Kind == yaml.MappingNode && t.Kind() == reflect.Map:
+		for i := 1; i < len(node.Content); i += 2 {
+			if err := resolveSecretFileKeys(node.Content[i], t.Elem()); err != nil {
+				return err
+			}
+		}
+	case node.Kind == yaml.MappingNode && t.Kind() == reflect.Struct:
+		fields := map[string]reflect.Type{}
+		for i := 0; i < t.NumField(); i++ {
+			if name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]; name != "" && name != "-" {
+				fields[name] = t.Field(i).Type
+			}
+		}
+		keys := map[string]bool{}
+		for i := 0; i < len(node.Content); i += 2 {
+			keys[node.Content[i].Value] = true
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if fieldType, ok := fields[key.Value]; ok {
+				if err := resolveSecretFileKeys(value, fieldType); err != nil {
+					return err
+				}
+				continue
+			}
+			name, isFile := strings.CutSuffix(key.Value, "_file")
+			if fieldType, ok := fields[name]; !isFile || !ok || fieldType.Kind() != reflect.String {
+				continue
+			}
+			if keys[name] {
+				return fmt.Errorf("line %d: set either %s or %s", key.Line, name, key.Value)
+			}
+			secret, err := readSecretFile(value.Value)
+			if err != nil {
+				return fmt.Errorf("line %d: %s: %w", value.Line, key.Value, err)
+			}
+			key.Value = name
+			*value = yaml.Node{Kind: yaml.ScalarNode, Line: value.Line, Column: value.Column}
+			setSecret(value, secret)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+
+	"gopkg.in/yaml.v3"
+)
+
+// isSOPSEncrypted reports whether a config document was encrypted with SOPS,
+// which adds its metadata under a top-level sops key.
+func isSOPSEncrypted(root *yaml.Node) bool {
+	node := mappingValue(root, "sops")
+	return node != nil && node.Kind == yaml.MappingNode
+}
+
+// decryptSOPS decrypts a SOPS encrypted YAML or JSON config file with the
+// sops command, which finds the keys (age, PGP or a cloud KMS) through its
+// usual environment, e.g. SOPS_AGE_KEY_FILE.
+func decryptSOPS(filename, format string) ([]byte, error) {
+	cmd := exec.Command("sops", "--decrypt", "--input-type", format, "--output-type", format, filename)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if errors.Is(err, exec.ErrNotFound) {
+		return nil, errors.New("the config file is SOPS encrypted but the sops command is not installed")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt the SOPS encrypted config file: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return out, nil
+}
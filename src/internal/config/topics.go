@@ -0,0 +1,319 @@
+package config
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// IsWildcardTopic reports whether topic is a filter with + or # wildcards.
+func IsWildcardTopic(topic string) bool {
+	return strings.ContainsAny(topic, "+#")
+}
+
+// TopicMatch reports whether topic matches the MQTT subscription filter and
+// returns the topic levels captured by its + and # wildcards.
+func TopicMatch(filter, topic string) ([]string, bool) {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	var captures []string
+
+	for i, level := range filterLevels {
+		if level == "#" {
+			return append(captures, strings.Join(topicLevels[i:], "/")), true
+		}
+		if i >= len(topicLevels) {
+			return nil, false
+		}
+		if level == "+" {
+			captures = append(captures, topicLevels[i])
+			continue
+		}
+		if level != topicLevels[i] {
+			return nil, false
+		}
+	}
+	if len(filterLevels) != len(topicLevels) {
+		return nil, false
+	}
+	return captures, true
+}
+
+// ExpandTopic fills the placeholders of a target topic template from the
+// received topic. {user} and {device} are the second and third levels of an
+// OwnTracks topic, {topic} is the whole topic and {1}, {2}, ... are the
+// levels captured by the wildcards of the matched mapping.
+func ExpandTopic(template, topic string, captures []string) string {
+	if !strings.Contains(template, "{") {
+		return template
+	}
+
+	levels := strings.Split(topic, "/")
+	level := func(i int) string {
+		if i < len(levels) {
+			return levels[i]
+		}
+		return ""
+	}
+
+	replacements := []string{"{topic}", topic, "{user}", level(1), "{device}", level(2)}
+	for i, capture := range captures {
+		replacements = append(replacements, fmt.Sprintf("{%d}", i+1), capture)
+	}
+	return strings.NewReplacer(replacements...).Replace(template)
+}
+
+// MatchMapping returns the mapping key that applies to a received source
+// topic together with the levels captured by its wildcards. An exact mapping
+// wins over wildcard mappings, which are tried in sorted order so overlapping
+// rules resolve deterministically.
+func (c *Config) MatchMapping(topic string) (string, []string, bool) {
+	mappings := c.AllMappings()
+	if _, exists := mappings[topic]; exists {
+		return topic, nil, true
+	}
+
+	filters := make([]string, 0, len(mappings))
+	for filter := range mappings {
+		if IsWildcardTopic(filter) {
+			filters = append(filters, filter)
+		}
+	}
+	sort.Strings(filters)
+
+	for _, filter := range filters {
+		if captures, ok := TopicMatch(filter, topic); ok {
+			return filter, captures, true
+		}
+	}
+	return "", nil, false
+}
+
+// OwnTracksSubtopics are the topics OwnTracks publishes below its base
+// device topic.
+var OwnTracksSubtopics = []string{"/event", "/waypoint", "/waypoints", "/info", "/beacon"}
+
+// MappingTopic returns the device base topic a received topic belongs to, so
+// that messages on OwnTracks subtopics such as <base>/event resolve through
+// the mapping of <base>.
+func (c *Config) MappingTopic(topic string) string {
+	if _, _, ok := c.MatchMapping(topic); ok {
+		return topic
+	}
+	for _, suffix := range OwnTracksSubtopics {
+		if base := strings.TrimSuffix(topic, suffix); base != topic {
+			if _, _, ok := c.MatchMapping(base); ok {
+				return base
+			}
+		}
+	}
+	return topic
+}
+
+// ResolveMapping returns the target topic for a received source topic.
+func (c *Config) ResolveMapping(topic string) (string, bool) {
+	filter, captures, ok := c.MatchMapping(topic)
+	if !ok {
+		return "", false
+	}
+	return ExpandTopic(c.AllMappings()[filter].Target, topic, captures), true
+}
+
+// MappingFor returns the mapping that applies to a received source topic.
+func (c *Config) MappingFor(topic string) (Mapping, bool) {
+	filter, _, ok := c.MatchMapping(topic)
+	if !ok {
+		return Mapping{}, false
+	}
+	return c.AllMappings()[filter], true
+}
+
+// EncryptionKeyFor returns the OwnTracks payload encryption key for a source
+// topic, preferring a per-mapping key over the global one.
+func (c *Config) EncryptionKeyFor(topic string) string {
+	if filter, _, ok := c.MatchMapping(c.MappingTopic(topic)); ok {
+		if key := c.AllMappings()[filter].EncryptionKey; key != "" {
+			return key
+		}
+		if key, exists := c.EncryptionKeys[filter]; exists {
+			return key
+		}
+	}
+	return c.EncryptionKey
+}
+
+// MaxGPSAccuracyFor returns the accuracy threshold in meters for a source
+// topic, preferring a per-mapping override over the global value. Zero means
+// no limit.
+func (c *Config) MaxGPSAccuracyFor(topic string) int {
+	if filter, _, ok := c.MatchMapping(topic); ok {
+		if limit := c.AllMappings()[filter].MaxGPSAccuracy; limit != nil {
+			return *limit
+		}
+		if limit, exists := c.MaxGPSAccuracyOverrides[filter]; exists {
+			return limit
+		}
+	}
+	return c.MaxGPSAccuracy
+}
+
+// PassthroughFieldsFor returns the OwnTracks fields passed through for a
+// mapping, falling back to the global setting. nil means the converter
+// defaults.
+func (c *Config) PassthroughFieldsFor(mapping Mapping) []string {
+	if mapping.PassthroughFields != nil {
+		return mapping.PassthroughFields
+	}
+	return c.PassthroughFields
+}
+
+// CoordinatePrecisionFor returns the decimal places forwarded coordinates
+// are rounded to for a mapping, falling back to the global setting. Zero
+// means no rounding.
+func (c *Config) CoordinatePrecisionFor(mapping Mapping) int {
+	if mapping.CoordinatePrecision != nil {
+		return *mapping.CoordinatePrecision
+	}
+	return c.CoordinatePrecision
+}
+
+// AllMappings returns the top-level mappings together with those of the
+// sources, which all feed the same pipeline: a topic is handled by the
+// mapping that matches it whichever broker it arrived from. A filter mapped
+// twice keeps its first mapping; Validate reports it.
+func (c *Config) AllMappings() map[string]Mapping {
+	merged, copied := c.Mappings, false
+	for _, source := range c.Sources {
+		for filter, mapping := range source.Mappings {
+			if _, exists := merged[filter]; exists {
+				continue
+			}
+			if !copied {
+				merged, copied = maps.Clone(c.Mappings), true
+				if merged == nil {
+					merged = map[string]Mapping{}
+				}
+			}
+			merged[filter] = mapping
+		}
+	}
+	return merged
+}
+
+// SubscriptionTopics lists every topic filter the bridge subscribes to on
+// source_broker: the keys of the top-level mappings plus the OwnTracks event
+// and waypoint subtopics when transitions or zones are forwarded.
+func (c *Config) SubscriptionTopics() []string {
+	return c.subscriptionTopics(c.Mappings)
+}
+
+// SourceSubscriptionTopics is SubscriptionTopics for one of the sources,
+// from its own mappings or, when it has none, the top-level ones.
+func (c *Config) SourceSubscriptionTopics(source SourceSettings) []string {
+	if len(source.Mappings) == 0 {
+		return c.SubscriptionTopics()
+	}
+	return c.subscriptionTopics(source.Mappings)
+}
+
+// Source returns the source with the given name, if there is one.
+func (c *Config) Source(name string) (SourceSettings, bool) {
+	for _, source := range c.Sources {
+		if source.Name == name {
+			return source, true
+		}
+	}
+	return SourceSettings{}, false
+}
+
+// Target returns the target with the given name, if there is one.
+func (c *Config) Target(name string) (TargetSettings, bool) {
+	for _, target := range c.Targets {
+		if target.Name == name {
+			return target, true
+		}
+	}
+	return TargetSettings{}, false
+}
+
+func (c *Config) subscriptionTopics(mappings map[string]Mapping) []string {
+	topics := make([]string, 0, len(mappings))
+	for subTopic := range mappings {
+		topics = append(topics, subTopic)
+		if strings.HasSuffix(subTopic, "#") {
+			continue
+		}
+		if c.TransitionTopic != "" {
+			topics = append(topics, subTopic+"/event")
+		}
+		if c.ZonesTopic != "" {
+			topics = append(topics, subTopic+"/waypoint", subTopic+"/waypoints")
+		}
+		if c.CardTopic != "" {
+			topics = append(topics, subTopic+"/info")
+		}
+		if c.BeaconTopic != "" {
+			topics = append(topics, subTopic+"/beacon")
+		}
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// SubscriptionQoS returns the QoS to subscribe to a filter with: the QoS of
+// its mapping, or of the base mapping for OwnTracks subtopics.
+func (c *Config) SubscriptionQoS(subTopic string) byte {
+	mappings := c.AllMappings()
+	if mapping, exists := mappings[subTopic]; exists {
+		return mapping.PublishQoS(c.QoS)
+	}
+	for _, suffix := range OwnTracksSubtopics {
+		if mapping, exists := mappings[strings.TrimSuffix(subTopic, suffix)]; exists {
+			return mapping.PublishQoS(c.QoS)
+		}
+	}
+	return byte(c.QoS)
+}
+
+// SubscriptionFilter returns the filter to subscribe to a topic with. With
+// shared_subscription_group set it is a shared subscription, so the broker
+// hands each message to only one of the bridges in the group.
+func (c *Config) SubscriptionFilter(subTopic string) string {
+	if c.SharedSubscriptionGroup == "" {
+		return subTopic
+	}
+	return "$share/" + c.SharedSubscriptionGroup + "/" + subTopic
+}
+
+var topicPlaceholder = regexp.MustCompile(`\{[^}]+\}`)
+
+// OverlappingOutputs returns the output topic templates whose topics would
+// also match one of the subscribed filters, which loops when source and
+// target are the same broker.
+func (c *Config) OverlappingOutputs() []string {
+	outputs := []string{c.TransitionTopic, c.ZonesTopic + "/zone", c.CardTopic, c.CardTopic + "/face", c.BeaconTopic, c.BatteryTopic, c.StatusTopic, c.StatsTopic}
+	if c.CommandTopic != "" {
+		outputs = append(outputs, c.CommandTopic+"/response")
+	}
+	for _, mapping := range c.AllMappings() {
+		outputs = append(outputs, mapping.Target)
+	}
+
+	var overlapping []string
+	for _, output := range outputs {
+		if output == "" || output == "/zone" || output == "/face" {
+			continue
+		}
+		sample := topicPlaceholder.ReplaceAllString(output, "x")
+		for _, filter := range c.SubscriptionTopics() {
+			if _, ok := TopicMatch(filter, sample); ok {
+				overlapping = append(overlapping, output)
+				break
+			}
+		}
+	}
+	sort.Strings(overlapping)
+	return overlapping
+}
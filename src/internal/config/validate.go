@@ -0,0 +1,525 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Problem is an issue Validate found in a configuration. Path locates the
+// setting, e.g. ["mappings", "owntracks/+/+", "qos"] or ["outputs", "0"].
+// Warnings are settings that work but probably not as intended.
+type Problem struct {
+	Path    []string
+	Message string
+	Warning bool
+}
+
+// Setting returns the dotted path of the setting, e.g. outputs[0].qos.
+func (p Problem) Setting() string {
+	var b strings.Builder
+	for i, part := range p.Path {
+		switch {
+		case isIndex(part):
+			fmt.Fprintf(&b, "[%s]", part)
+		case i > 0 && p.Path[i-1] == "mappings":
+			fmt.Fprintf(&b, "[%q]", part)
+		default:
+			if i > 0 {
+				b.WriteByte('.')
+			}
+			b.WriteString(part)
+		}
+	}
+	return b.String()
+}
+
+func isIndex(s string) bool {
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
+
+// Validate checks the settings that can be checked without connecting
+// anywhere: the choices of enumerated settings, QoS values, the syntax of
+// mapping filters and targets and mappings that overlap.
+func (c *Config) Validate() []Problem {
+	var problems []Problem
+	fail := func(message string, path ...string) {
+		problems = append(problems, Problem{Path: path, Message: message})
+	}
+	warn := func(message string, path ...string) {
+		problems = append(problems, Problem{Path: path, Message: message, Warning: true})
+	}
+	choice := func(key, value string, fatal bool, choices ...string) {
+		if value == "" || slices.Contains(choices, value) {
+			return
+		}
+		message := fmt.Sprintf("invalid %s %q (expected %s)", key, value, listChoices(choices))
+		if fatal {
+			fail(message, key)
+		} else {
+			warn(message, key)
+		}
+	}
+	qos := func(value int, path ...string) {
+		if value < 0 || value > 2 {
+			fail(fmt.Sprintf("invalid QoS %d (expected 0, 1 or 2)", value), path...)
+		}
+	}
+
+	choice("output", c.Output, true, "mqtt", "ha_rest")
+	choice("units", c.Units, true, "metric", "imperial")
+	choice("pressure_unit", c.PressureUnit, false, "hPa", "kPa", "inHg", "mmHg")
+	if c.SeaLevelPressureHPa < 0 {
+		fail("sea_level_pressure_hpa must not be negative", "sea_level_pressure_hpa")
+	}
+	choice("idle_action", c.IdleAction, true, "exit", "reconnect", "warn")
+	choice("run_mode", c.RunMode, false, "daemon", "once", "dry-run")
+	choice("buffer_overflow", c.BufferOverflow, false, "drop_oldest", "drop_newest")
+	choice("gps_accuracy_action", c.GPSAccuracyAction, false, "drop", "flag")
+	choice("stale_action", c.StaleAction, false, "drop", "flag")
+	qos(c.QoS, "qos")
+	if !slices.Contains([]int{0, 3, 4, 5}, c.ProtocolVersion) {
+		fail(fmt.Sprintf("invalid protocol_version %d (expected 3, 4 or 5)", c.ProtocolVersion), "protocol_version")
+	}
+	for _, broker := range []string{"source", "target"} {
+		user, pass, auth := c.SourceUser, c.SourcePass, c.SourceAuth
+		if broker == "target" {
+			user, pass, auth = c.TargetUser, c.TargetPass, c.TargetAuth
+		}
+		if user == "" && pass != "" && auth == "" && c.ProtocolVersion != 5 {
+			warn("MQTT 3.1.1 cannot send a password without a username, so it is not sent; use protocol_version 5 or "+broker+"_auth token", broker+"_pass")
+		}
+	}
+
+	if strings.ContainsAny(c.SharedSubscriptionGroup, "/+#") {
+		fail(fmt.Sprintf("shared_subscription_group %q must not contain /, + or #", c.SharedSubscriptionGroup), "shared_subscription_group")
+	}
+
+	if IsWildcardTopic(c.StatsTopic) {
+		fail(fmt.Sprintf("stats_topic %q contains a wildcard", c.StatsTopic), "stats_topic")
+	}
+	if IsWildcardTopic(c.CommandTopic) {
+		fail(fmt.Sprintf("command_topic %q contains a wildcard", c.CommandTopic), "command_topic")
+	}
+	reverseFilters := make([]string, 0, len(c.ReverseMappings))
+	for filter := range c.ReverseMappings {
+		reverseFilters = append(reverseFilters, filter)
+	}
+	sort.Strings(reverseFilters)
+	for _, filter := range reverseFilters {
+		target := c.ReverseMappings[filter]
+		if err := checkFilter(filter); err != nil {
+			fail(err.Error(), "reverse_mappings", filter)
+		}
+		switch {
+		case target == "":
+			fail("no cmd topic", "reverse_mappings", filter)
+		case IsWildcardTopic(target):
+			fail(fmt.Sprintf("cmd topic %q contains a wildcard; use {1}, {2}... for the levels + and # match", target), "reverse_mappings", filter)
+		default:
+			for _, placeholder := range unknownPlaceholders(target, wildcardCount(filter)) {
+				warn(fmt.Sprintf("cmd topic placeholder %s is not filled from filter %q", placeholder, filter), "reverse_mappings", filter)
+			}
+		}
+	}
+	if c.RequestLocationTopic != "" {
+		sample := topicPlaceholder.ReplaceAllString(c.RequestLocationTopic, "x")
+		switch {
+		case IsWildcardTopic(c.RequestLocationTopic):
+			fail(fmt.Sprintf("request_location_topic %q contains a wildcard", c.RequestLocationTopic), "request_location_topic")
+		case !slices.ContainsFunc(reverseFilters, func(filter string) bool { _, ok := TopicMatch(filter, sample); return ok }):
+			warn("no reverse_mappings filter matches request_location_topic, so its buttons send nothing", "request_location_topic")
+		}
+		if !c.DiscoveryEnabled {
+			warn("request_location_topic buttons are announced through discovery, which is disabled", "request_location_topic")
+		}
+	}
+	for i, rule := range c.ConnectionRules {
+		index := strconv.Itoa(i)
+		if rule.Conn != "w" && rule.Conn != "o" && rule.Conn != "m" {
+			fail(fmt.Sprintf("invalid conn %q (expected w, o or m)", rule.Conn), "connection_rules", index, "conn")
+		}
+		if rule.AccuracyAbove < 0 {
+			fail(fmt.Sprintf("negative accuracy_above %d", rule.AccuracyAbove), "connection_rules", index, "accuracy_above")
+		}
+		if rule.Action != "drop" && rule.Action != "flag" {
+			fail(fmt.Sprintf("invalid action %q (expected drop or flag)", rule.Action), "connection_rules", index, "action")
+		}
+	}
+	for i, wz := range c.WiFiZones {
+		index := strconv.Itoa(i)
+		if wz.BSSID == "" && wz.SSID == "" {
+			fail("set bssid or ssid", "wifi_zones", index)
+		}
+		if wz.Zone == "" {
+			fail("no zone", "wifi_zones", index, "zone")
+		}
+	}
+	for i, beacon := range c.Beacons {
+		index := strconv.Itoa(i)
+		if beacon.UUID == "" {
+			fail("no uuid", "beacons", index, "uuid")
+		}
+		if beacon.Room == "" || strings.ContainsAny(beacon.Room, "/+#") {
+			fail(fmt.Sprintf("invalid room %q: it must be one topic level", beacon.Room), "beacons", index, "room")
+		}
+	}
+	switch {
+	case c.BeaconTopic != "" && len(c.Beacons) == 0:
+		warn("beacon_topic is unused without beacons", "beacon_topic")
+	case c.BeaconTopic == "" && len(c.Beacons) > 0:
+		warn("beacons are ignored without beacon_topic", "beacons")
+	case c.BeaconTopic != "" && !strings.Contains(c.BeaconTopic, "{room}"):
+		warn("beacon_topic has no {room}, so all rooms share one topic", "beacon_topic")
+	}
+	if len(c.ReverseMappings) > 0 && c.Output == "ha_rest" {
+		fail("reverse_mappings subscribe on the target broker, which output ha_rest does not use", "reverse_mappings")
+	}
+	if IsWildcardTopic(c.LeaderElectionTopic) {
+		fail(fmt.Sprintf("leader_election_topic %q contains a wildcard", c.LeaderElectionTopic), "leader_election_topic")
+	}
+	if c.HTTPPass != "" && c.HTTPUser == "" {
+		fail("http_pass is set without http_user, which basic auth needs", "http_pass")
+	}
+	if c.HTTPGetPath != "" {
+		if c.HTTPListen == "" {
+			warn("http_get_path is unused without http_listen", "http_get_path")
+		}
+		if c.HTTPGetPath == c.HTTPPath || (c.HTTPPath == "" && c.HTTPGetPath == "/pub") {
+			fail(fmt.Sprintf("http_get_path %q is also http_path", c.HTTPGetPath), "http_get_path")
+		}
+	}
+	if c.LeaderLeaseSeconds < 0 {
+		fail("leader_lease_seconds must not be negative", "leader_lease_seconds")
+	}
+	if c.LeaderElectionTopic != "" && c.SharedSubscriptionGroup != "" {
+		warn("a standby drops the messages the shared subscription hands it; use either leader election or a shared subscription", "shared_subscription_group")
+	}
+
+	tlsSettings := func(settings TLSSettings, path ...string) {
+		if len(settings.CipherSuites) > 0 && settings.MinVersion != "1.2" {
+			warn("cipher_suites only apply to TLS 1.2 and are unused unless min_version is 1.2", append(path, "cipher_suites")...)
+		}
+		if _, _, err := net.SplitHostPort(settings.ServerName); err == nil || strings.Contains(settings.ServerName, "://") {
+			fail(fmt.Sprintf("server_name %q must be a host name without scheme or port", settings.ServerName), append(path, "server_name")...)
+		}
+		if slices.Contains(settings.ALPN, "") {
+			fail("empty ALPN protocol", append(path, "alpn")...)
+		}
+	}
+	tlsSettings(c.SourceTLS, "source_tls")
+	tlsSettings(c.TargetTLS, "target_tls")
+
+	if len(c.AllMappings()) == 0 {
+		fail("no mappings: no topics would be subscribed and nothing forwarded", "mappings")
+	}
+	type wildcard struct {
+		filter string
+		path   []string
+	}
+	var wildcards []wildcard
+	checkMappings := func(mappings map[string]Mapping, path ...string) {
+		filters := make([]string, 0, len(mappings))
+		for filter := range mappings {
+			filters = append(filters, filter)
+		}
+		sort.Strings(filters)
+		for _, filter := range filters {
+			mapping := mappings[filter]
+			at := func(keys ...string) []string {
+				return append(append(append([]string(nil), path...), filter), keys...)
+			}
+			if err := checkFilter(filter); err != nil {
+				fail(err.Error(), at()...)
+			} else if IsWildcardTopic(filter) && !slices.ContainsFunc(wildcards, func(w wildcard) bool { return w.filter == filter }) {
+				wildcards = append(wildcards, wildcard{filter, at()})
+			}
+			switch {
+			case mapping.Target == "":
+				fail("no target topic", at()...)
+			case IsWildcardTopic(mapping.Target):
+				fail(fmt.Sprintf("target %q contains a wildcard; use {1}, {2}... for the levels + and # match", mapping.Target), at("target")...)
+			default:
+				for _, placeholder := range unknownPlaceholders(mapping.Target, wildcardCount(filter)) {
+					warn(fmt.Sprintf("target placeholder %s is not filled from filter %q", placeholder, filter), at("target")...)
+				}
+			}
+			if mapping.QoS != nil {
+				qos(*mapping.QoS, at("qos")...)
+			}
+			if style := mapping.OutputStyle; style != "" && style != "json" && style != "state_attributes" {
+				fail(fmt.Sprintf("invalid output_style %q (expected json or state_attributes)", style), at("output_style")...)
+			}
+			if mapping.Passthrough && (mapping.Script != "" || mapping.EncryptionKey != "" || mapping.OutputStyle != "" ||
+				len(mapping.Geofence) > 0 || len(mapping.QuietHours) > 0) {
+				warn("passthrough forwards payloads unchanged, so script, encryption_key, output_style, geofence and quiet_hours are unused", at("passthrough")...)
+			}
+			for i, quiet := range mapping.QuietHours {
+				if err := quiet.check(); err != nil {
+					fail(err.Error(), at("quiet_hours", strconv.Itoa(i))...)
+				}
+			}
+			for i, rule := range mapping.TriggerRules {
+				path := at("trigger_rules", strconv.Itoa(i))
+				if len(rule.Triggers) == 0 {
+					fail("no triggers", path...)
+				}
+				for _, trigger := range rule.Triggers {
+					if !slices.Contains(triggers, trigger) {
+						fail(fmt.Sprintf("unknown trigger %q (expected %s)", trigger, listChoices(triggers)), append(path, "triggers")...)
+					}
+				}
+				if rule.Action != "" && rule.Action != "forward" && rule.Action != "drop" {
+					fail(fmt.Sprintf("invalid action %q (expected forward or drop)", rule.Action), append(path, "action")...)
+				}
+				if rule.MinIntervalS < 0 {
+					fail(fmt.Sprintf("negative min_interval_s %d", rule.MinIntervalS), append(path, "min_interval_s")...)
+				}
+			}
+			for i, rule := range mapping.Geofence {
+				path := at("geofence", strconv.Itoa(i))
+				switch {
+				case (rule.Zone == "") == (len(rule.Polygon) == 0):
+					fail("set either zone or polygon", path...)
+				case rule.Zone != "" && !c.ImportHAZones && !c.zoneDefined(rule.Zone):
+					warn(fmt.Sprintf("zone %q is not defined in zones, region_zones or wifi_zones", rule.Zone), append(path, "zone")...)
+				case len(rule.Polygon) > 0 && len(rule.Polygon) < 3:
+					fail("a polygon needs at least 3 corners", append(path, "polygon")...)
+				}
+				if rule.Action != "drop" && rule.Action != "forward" && rule.Action != "blur" {
+					fail(fmt.Sprintf("invalid action %q (expected drop, forward or blur)", rule.Action), append(path, "action")...)
+				}
+				if precision := rule.BlurPrecision(); precision < 0 || precision > 6 {
+					fail(fmt.Sprintf("invalid precision %d (expected 0 to 6 decimals)", precision), append(path, "precision")...)
+				}
+			}
+		}
+	}
+	checkMappings(c.Mappings, "mappings")
+	if len(c.SourceBroker) > 0 && len(c.Mappings) == 0 && len(c.Sources) > 0 {
+		warn("source_broker has no mappings to subscribe to; mappings of sources are only subscribed on their own broker", "mappings")
+	}
+
+	names := map[string]bool{"source": true, "target": true}
+	mappedIn := map[string]string{}
+	for filter := range c.Mappings {
+		mappedIn[filter] = "mappings"
+	}
+	for i, source := range c.Sources {
+		index := strconv.Itoa(i)
+		if source.Broker == "" {
+			fail("source without a broker", "sources", index, "broker")
+		}
+		if names[source.Name] {
+			fail(fmt.Sprintf("source name %q is already used; set a different name", source.Name), "sources", index, "name")
+		}
+		names[source.Name] = true
+		if source.User == "" && source.Pass != "" && source.Auth == "" && c.ProtocolVersion != 5 {
+			warn("MQTT 3.1.1 cannot send a password without a username, so it is not sent; use protocol_version 5 or auth token", "sources", index, "pass")
+		}
+		if !c.CleanSessionEnabled() && source.ClientID == "" {
+			fail("clean_session false needs a client_id to resume the session with", "sources", index, "client_id")
+		}
+		tlsSettings(source.TLS, "sources", index, "tls")
+		checkMappings(source.Mappings, "sources", index, "mappings")
+		filters := make([]string, 0, len(source.Mappings))
+		for filter := range source.Mappings {
+			filters = append(filters, filter)
+		}
+		sort.Strings(filters)
+		for _, filter := range filters {
+			if first, exists := mappedIn[filter]; exists {
+				fail(fmt.Sprintf("already mapped in %s, whose mapping is used for all sources", first), "sources", index, "mappings", filter)
+				continue
+			}
+			mappedIn[filter] = Problem{Path: []string{"sources", index, "mappings"}}.Setting()
+		}
+	}
+
+	for i, target := range c.Targets {
+		index := strconv.Itoa(i)
+		if target.Broker == "" {
+			fail("target without a broker", "targets", index, "broker")
+		}
+		if names[target.Name] {
+			fail(fmt.Sprintf("target name %q is already used; set a different name", target.Name), "targets", index, "name")
+		}
+		names[target.Name] = true
+		if target.User == "" && target.Pass != "" && target.Auth == "" && c.ProtocolVersion != 5 {
+			warn("MQTT 3.1.1 cannot send a password without a username, so it is not sent; use protocol_version 5 or auth token", "targets", index, "pass")
+		}
+		if target.QoS != nil {
+			qos(*target.QoS, "targets", index, "qos")
+		}
+		tlsSettings(target.TLS, "targets", index, "tls")
+		for prefix, replacement := range target.TopicPrefixes {
+			if IsWildcardTopic(prefix) || IsWildcardTopic(replacement) {
+				fail(fmt.Sprintf("topic prefix %q: %q contains a wildcard", prefix, replacement), "targets", index, "topic_prefixes")
+			}
+		}
+	}
+
+	// An exact mapping overriding a wildcard one is deliberate; two
+	// wildcard mappings matching the same topic usually are not.
+	sort.SliceStable(wildcards, func(i, j int) bool { return wildcards[i].filter < wildcards[j].filter })
+	for i, first := range wildcards {
+		for _, other := range wildcards[i+1:] {
+			if filtersOverlap(first.filter, other.filter) {
+				warn(fmt.Sprintf("overlaps mapping %q; a topic matching both uses %q, which sorts first", other.filter, first.filter), first.path...)
+			}
+		}
+	}
+
+	for i, output := range c.Outputs {
+		index := strconv.Itoa(i)
+		if output.Type == "" {
+			fail("output without a type", "outputs", index)
+		}
+		if output.QoS != nil {
+			qos(*output.QoS, "outputs", index, "qos")
+		}
+		tlsSettings(output.TLS, "outputs", index, "tls")
+		if !slices.Contains([]int{0, 3, 4, 5}, output.ProtocolVersion) {
+			fail(fmt.Sprintf("invalid protocol_version %d (expected 3, 4 or 5)", output.ProtocolVersion), "outputs", index, "protocol_version")
+		}
+		if output.Retries < 0 {
+			fail(fmt.Sprintf("negative retries %d", output.Retries), "outputs", index, "retries")
+		}
+		for _, filter := range output.Mappings {
+			if _, ok := c.AllMappings()[filter]; !ok {
+				fail(fmt.Sprintf("mapping %q is not configured", filter), "outputs", index, "mappings")
+			}
+		}
+	}
+	if format := c.History.ExportFormat; format != "" && format != "gpx" && format != "geojson" {
+		fail(fmt.Sprintf("invalid export_format %q (expected gpx or geojson)", format), "history", "export_format")
+	}
+	if c.History.APIListen != "" && c.History.SQLitePath == "" {
+		fail("api_listen serves the history database, so sqlite_path must be set", "history", "api_listen")
+	}
+	if len(c.Notifications) > 0 && len(c.Zones) == 0 && !c.ImportHAZones && len(c.RegionZones) == 0 && len(c.WiFiZones) == 0 {
+		warn("no zones, region_zones or wifi_zones are set, so no zone changes are detected to notify", "notifications")
+	}
+	for i, n := range c.Notifications {
+		index := strconv.Itoa(i)
+		switch n.Type {
+		case "ntfy", "gotify":
+			if n.URL == "" {
+				fail(fmt.Sprintf("url is required for %s notifications", n.Type), "notifications", index, "url")
+			}
+			if n.Type == "gotify" && n.Token == "" {
+				fail("token (the application token) is required for gotify notifications", "notifications", index, "token")
+			}
+		case "telegram":
+			if n.Token == "" {
+				fail("token (the bot token) is required for telegram notifications", "notifications", index, "token")
+			}
+			if n.ChatID == "" {
+				fail("chat_id is required for telegram notifications", "notifications", index, "chat_id")
+			}
+		default:
+			fail(fmt.Sprintf("invalid type %q (expected ntfy, telegram or gotify)", n.Type), "notifications", index, "type")
+		}
+		for _, event := range n.Events {
+			if event != "enter" && event != "leave" {
+				fail(fmt.Sprintf("invalid event %q (expected enter or leave)", event), "notifications", index, "events")
+			}
+		}
+		for _, zone := range n.Zones {
+			if !c.ImportHAZones && zone != "home" && !c.zoneDefined(zone) {
+				warn(fmt.Sprintf("zone %q is not defined in zones, region_zones or wifi_zones", zone), "notifications", index, "zones")
+			}
+		}
+	}
+	for kind, list := range map[string][]PluginSettings{"inputs": c.Inputs, "filters": c.Filters} {
+		for i, settings := range list {
+			if settings.Type == "" {
+				fail(strings.TrimSuffix(kind, "s")+" without a type", kind, strconv.Itoa(i))
+			}
+		}
+	}
+	return problems
+}
+
+// zoneDefined reports whether zones, region_zones or wifi_zones name a zone.
+func (c *Config) zoneDefined(name string) bool {
+	return slices.ContainsFunc(c.Zones, func(z ZoneSettings) bool { return z.Name == name }) ||
+		slices.ContainsFunc(c.RegionZones, func(rz RegionZone) bool { return rz.Zone == name }) ||
+		slices.ContainsFunc(c.WiFiZones, func(wz WiFiZone) bool { return wz.Zone == name })
+}
+
+// triggers are the OwnTracks triggers trigger_rules take, as letters and
+// names.
+var triggers = []string{"p", "c", "C", "b", "r", "u", "t", "v", "ping", "region", "beacon", "report", "manual", "timer", "visit"}
+
+func listChoices(choices []string) string {
+	if len(choices) == 1 {
+		return choices[0]
+	}
+	return strings.Join(choices[:len(choices)-1], ", ") + " or " + choices[len(choices)-1]
+}
+
+// checkFilter reports MQTT filter syntax errors: # must be the last level
+// and + and # must fill a whole level.
+func checkFilter(filter string) error {
+	if filter == "" {
+		return fmt.Errorf("empty topic filter")
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		switch {
+		case level == "#" && i != len(levels)-1:
+			return fmt.Errorf("invalid topic filter %q: # must be the last level", filter)
+		case level != "+" && level != "#" && strings.ContainsAny(level, "+#"):
+			return fmt.Errorf("invalid topic filter %q: + and # must fill a whole level", filter)
+		}
+	}
+	return nil
+}
+
+func wildcardCount(filter string) int {
+	count := 0
+	for _, level := range strings.Split(filter, "/") {
+		if level == "+" || level == "#" {
+			count++
+		}
+	}
+	return count
+}
+
+// unknownPlaceholders returns the placeholders of a target that ExpandTopic
+// leaves empty or does not know.
+func unknownPlaceholders(target string, wildcards int) []string {
+	var unknown []string
+	for _, placeholder := range topicPlaceholder.FindAllString(target, -1) {
+		name := strings.Trim(placeholder, "{}")
+		if name == "user" || name == "device" || name == "topic" {
+			continue
+		}
+		if n, err := strconv.Atoi(name); err == nil && n >= 1 && n <= wildcards {
+			continue
+		}
+		unknown = append(unknown, placeholder)
+	}
+	return unknown
+}
+
+// filtersOverlap reports whether some topic matches both filters.
+func filtersOverlap(a, b string) bool {
+	la, lb := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; ; i++ {
+		if i < len(la) && la[i] == "#" || i < len(lb) && lb[i] == "#" {
+			return true
+		}
+		if i == len(la) || i == len(lb) {
+			return len(la) == len(lb)
+		}
+		if la[i] != "+" && lb[i] != "+" && la[i] != lb[i] {
+			return false
+		}
+	}
+}
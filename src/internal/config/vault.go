@@ -0,0 +1,195 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// vaultTag marks a YAML value that is read from HashiCorp Vault, e.g.
+// source_pass: !vault secret/data/owntracks#source_pass.
+const vaultTag = "!vault"
+
+// VaultSettings configures the Vault server !vault values are read from.
+// Address and Token default to VAULT_ADDR and VAULT_TOKEN; with RoleID the
+// bridge logs in through AppRole instead of using a token.
+type VaultSettings struct {
+	Address      string `yaml:"address"`
+	Token        string `yaml:"token" secret:"true"`
+	RoleID       string `yaml:"role_id"`
+	SecretID     string `yaml:"secret_id" secret:"true"`
+	AppRoleMount string `yaml:"approle_mount"`
+	Namespace    string `yaml:"namespace"`
+}
+
+var vaultClient = http.Client{Timeout: 10 * time.Second}
+
+// resolveVaultTags replaces every !vault value below root by the secret it
+// refers to. The vault settings are taken from the same document, so they
+// may themselves use !secret_file or _file keys.
+func resolveVaultTags(root *yaml.Node) error {
+	var tagged []*yaml.Node
+	var collect func(node *yaml.Node)
+	collect = func(node *yaml.Node) {
+		if node.Kind == yaml.ScalarNode && node.Tag == vaultTag {
+			tagged = append(tagged, node)
+		}
+		for _, child := range node.Content {
+			collect(child)
+		}
+	}
+	collect(root)
+	if len(tagged) == 0 {
+		return nil
+	}
+
+	var settings VaultSettings
+	if node := mappingValue(root, "vault"); node != nil {
+		if err := node.Decode(&settings); err != nil {
+			return fmt.Errorf("invalid vault settings: %w", err)
+		}
+	}
+	if err := applyEnvOverrides(reflect.ValueOf(&settings).Elem(), envPrefix+"VAULT_"); err != nil {
+		return err
+	}
+	v, err := newVaultSession(settings)
+	if err != nil {
+		return err
+	}
+
+	secrets := map[string]map[string]interface{}{}
+	for _, node := range tagged {
+		path, key, ok := strings.Cut(node.Value, "#")
+		if !ok || path == "" || key == "" {
+			return fmt.Errorf("line %d: expected !vault <path>#<key>, got %q", node.Line, node.Value)
+		}
+		data, read := secrets[path]
+		if !read {
+			if data, err = v.read(path); err != nil {
+				return fmt.Errorf("line %d: %w", node.Line, err)
+			}
+			secrets[path] = data
+		}
+		value, ok := data[key]
+		if !ok {
+			return fmt.Errorf("line %d: vault secret %s has no key %q", node.Line, path, key)
+		}
+		setSecret(node, fmt.Sprint(value))
+	}
+	return nil
+}
+
+// mappingValue returns the value of key in the top-level mapping of a
+// document, or nil.
+func mappingValue(root *yaml.Node, key string) *yaml.Node {
+	node := root
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// vaultSession is a Vault address with the token to read secrets with.
+type vaultSession struct {
+	settings VaultSettings
+	token    string
+}
+
+func newVaultSession(settings VaultSettings) (*vaultSession, error) {
+	if settings.Address == "" {
+		settings.Address = os.Getenv("VAULT_ADDR")
+	}
+	if settings.Address == "" {
+		return nil, errors.New("!vault values need vault.address or VAULT_ADDR")
+	}
+	if settings.Namespace == "" {
+		settings.Namespace = os.Getenv("VAULT_NAMESPACE")
+	}
+	v := &vaultSession{settings: settings, token: settings.Token}
+	if settings.RoleID != "" {
+		if err := v.loginAppRole(); err != nil {
+			return nil, err
+		}
+	}
+	if v.token == "" {
+		v.token = os.Getenv("VAULT_TOKEN")
+	}
+	if v.token == "" {
+		return nil, errors.New("!vault values need vault.token, vault.role_id or VAULT_TOKEN")
+	}
+	return v, nil
+}
+
+// loginAppRole exchanges the role and secret id for a token.
+func (v *vaultSession) loginAppRole() error {
+	mount := v.settings.AppRoleMount
+	if mount == "" {
+		mount = "approle"
+	}
+	body, _ := json.Marshal(map[string]string{"role_id": v.settings.RoleID, "secret_id": v.settings.SecretID})
+	var resp struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	if err := v.call(http.MethodPost, "auth/"+mount+"/login", body, &resp); err != nil {
+		return fmt.Errorf("vault approle login failed: %w", err)
+	}
+	v.token = resp.Auth.ClientToken
+	return nil
+}
+
+// read returns the data of the secret at path. KV version 2 paths
+// (<mount>/data/<name>) nest it one level deeper than version 1.
+func (v *vaultSession) read(path string) (map[string]interface{}, error) {
+	var resp struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := v.call(http.MethodGet, strings.TrimPrefix(path, "/"), nil, &resp); err != nil {
+		return nil, fmt.Errorf("failed to read vault secret %s: %w", path, err)
+	}
+	if nested, ok := resp.Data["data"].(map[string]interface{}); ok && resp.Data["metadata"] != nil {
+		return nested, nil
+	}
+	return resp.Data, nil
+}
+
+func (v *vaultSession) call(method, path string, body []byte, out interface{}) error {
+	req, err := http.NewRequest(method, strings.TrimSuffix(v.settings.Address, "/")+"/v1/"+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if v.token != "" {
+		req.Header.Set("X-Vault-Token", v.token)
+	}
+	if v.settings.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.settings.Namespace)
+	}
+	resp, err := vaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("vault returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
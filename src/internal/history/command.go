@@ -0,0 +1,105 @@
+package history
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"owntracks2ha/internal/config"
+)
+
+// Command runs "owntracks2ha history", which lists recorded locations or
+// writes them as GPX or GeoJSON tracks, and returns the exit code.
+func Command(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("history", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	configPath := flags.String("config", "config/config.yaml", "path to the config file (YAML, JSON or TOML)")
+	configFormat := flags.String("config-format", "", "config file format: yaml, json or toml (defaults to the file extension)")
+	dbPath := flags.String("db", "", "history database (defaults to history.sqlite_path from the config)")
+	device := flags.String("device", "", "only show this device, e.g. phone1")
+	since := flags.String("since", "24h", "show locations newer than this, e.g. 90m, 24h or 7d")
+	showPayload := flags.Bool("payload", false, "also print the raw OwnTracks payload")
+	format := flags.String("format", "table", "output format: table, gpx or geojson")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if *format != "table" && !slices.Contains(Formats, *format) {
+		fmt.Fprintf(stderr, "invalid -format %q: expected table, gpx or geojson\n", *format)
+		return 2
+	}
+	window, err := parseSince(*since)
+	if err != nil {
+		fmt.Fprintf(stderr, "invalid -since %q: %v\n", *since, err)
+		return 2
+	}
+
+	path := *dbPath
+	if path == "" {
+		cfg, err := config.ReadFormat(*configPath, *configFormat)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		path = cfg.History.SQLitePath
+	}
+	if path == "" {
+		fmt.Fprintln(stderr, "no history database: set history.sqlite_path in the config or pass -db")
+		return 1
+	}
+
+	recorder, err := Open(path)
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to open history database: %v\n", err)
+		return 1
+	}
+	defer recorder.Close()
+
+	entries, err := recorder.Query(*device, time.Now().Add(-window))
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to query history: %v\n", err)
+		return 1
+	}
+
+	if *format != "table" {
+		if err := WriteTracks(stdout, *format, entries); err != nil {
+			fmt.Fprintf(stderr, "failed to write tracks: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	header := "TIME\tUSER\tDEVICE\tLATITUDE\tLONGITUDE\tRECEIVED"
+	if *showPayload {
+		header += "\tPAYLOAD"
+	}
+	fmt.Fprintln(w, header)
+	for _, entry := range entries {
+		line := fmt.Sprintf("%s\t%s\t%s\t%.6f\t%.6f\t%s", entry.Time.Format(time.RFC3339), entry.User, entry.Device,
+			entry.Lat, entry.Lon, entry.Received.Format(time.RFC3339))
+		if *showPayload {
+			line += "\t" + string(entry.Payload)
+		}
+		fmt.Fprintln(w, line)
+	}
+	w.Flush()
+	return 0
+}
+
+// parseSince parses a Go duration, also accepting whole days such as 7d.
+func parseSince(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
+}
@@ -0,0 +1,204 @@
+package history
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Formats lists the track formats of Exporter and WriteTracks.
+var Formats = []string{"gpx", "geojson"}
+
+// pointDetails are the fields of the OwnTracks payload a track point keeps
+// next to its position.
+type pointDetails struct {
+	Alt  int `json:"alt"`
+	Acc  int `json:"acc"`
+	Vel  int `json:"vel"`
+	Batt int `json:"batt"`
+}
+
+func details(entry Entry) pointDetails {
+	var d pointDetails
+	json.Unmarshal(entry.Payload, &d)
+	return d
+}
+
+func coordinate(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+func xmlText(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+const (
+	gpxHeader = `<?xml version="1.0" encoding="UTF-8"?>` + "\n" +
+		`<gpx version="1.1" creator="owntracks2ha" xmlns="http://www.topografix.com/GPX/1/1">` + "\n"
+	gpxFooter        = "</gpx>\n"
+	gpxTrackFooter   = "</trkseg></trk>\n"
+	geoJSONHeader    = `{"type":"FeatureCollection","features":[` + "\n"
+	geoJSONFooter    = "]}\n"
+	geoJSONSeparator = ",\n"
+)
+
+func gpxTrackHeader(user, device string) string {
+	return "<trk><name>" + xmlText(user+"/"+device) + "</name><trkseg>\n"
+}
+
+func gpxPoint(entry Entry) string {
+	d := details(entry)
+	return fmt.Sprintf("<trkpt lat=\"%s\" lon=\"%s\"><ele>%d</ele><time>%s</time></trkpt>\n",
+		coordinate(entry.Lat), coordinate(entry.Lon), d.Alt, entry.Time.UTC().Format(time.RFC3339))
+}
+
+// geoJSONPoint renders an entry as a Point feature.
+func geoJSONPoint(entry Entry) string {
+	d := details(entry)
+	properties, _ := json.Marshal(map[string]interface{}{
+		"user":     entry.User,
+		"device":   entry.Device,
+		"time":     entry.Time.UTC().Format(time.RFC3339),
+		"accuracy": d.Acc,
+		"altitude": d.Alt,
+		"velocity": d.Vel,
+		"battery":  d.Batt,
+	})
+	return fmt.Sprintf(`{"type":"Feature","geometry":{"type":"Point","coordinates":[%s,%s]},"properties":%s}`,
+		coordinate(entry.Lon), coordinate(entry.Lat), properties)
+}
+
+// WriteTracks writes entries as one GPX file with a track per device, or as
+// a GeoJSON FeatureCollection of points.
+func WriteTracks(w io.Writer, format string, entries []Entry) error {
+	var b bytes.Buffer
+	switch format {
+	case "gpx":
+		b.WriteString(gpxHeader)
+		byDevice := map[string][]Entry{}
+		var order []string
+		for _, entry := range entries {
+			key := entry.User + "/" + entry.Device
+			if _, ok := byDevice[key]; !ok {
+				order = append(order, key)
+			}
+			byDevice[key] = append(byDevice[key], entry)
+		}
+		for _, key := range order {
+			track := byDevice[key]
+			b.WriteString(gpxTrackHeader(track[0].User, track[0].Device))
+			for _, entry := range track {
+				b.WriteString(gpxPoint(entry))
+			}
+			b.WriteString(gpxTrackFooter)
+		}
+		b.WriteString(gpxFooter)
+	case "geojson":
+		b.WriteString(geoJSONHeader)
+		for i, entry := range entries {
+			if i > 0 {
+				b.WriteString(geoJSONSeparator)
+			}
+			b.WriteString(geoJSONPoint(entry))
+		}
+		b.WriteString("\n" + geoJSONFooter)
+	default:
+		return fmt.Errorf("unknown track format %q (expected gpx or geojson)", format)
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// Exporter writes the forwarded locations to a track file per device and
+// day, <dir>/<user>/<device>/<YYYY-MM-DD>.gpx or .geojson in local time.
+// Every point is appended in place of the closing tags, which are written
+// back after it, so a file is complete between locations and survives a
+// restart.
+type Exporter struct {
+	dir    string
+	format string
+	mu     sync.Mutex
+}
+
+// NewExporter creates dir if needed.
+func NewExporter(dir, format string) (*Exporter, error) {
+	if format == "" {
+		format = "gpx"
+	}
+	if !slices.Contains(Formats, format) {
+		return nil, fmt.Errorf("unknown track format %q (expected gpx or geojson)", format)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Exporter{dir: dir, format: format}, nil
+}
+
+// Add appends an entry to the track file of its device and day.
+func (e *Exporter) Add(entry Entry) error {
+	if entry.User == "" || entry.Device == "" {
+		entry.User, entry.Device = topicUserDevice(entry.Topic)
+	}
+	day := entry.Time.Local().Format(time.DateOnly)
+	path := filepath.Join(e.dir, safeName(entry.User), safeName(entry.Device), day+"."+e.format)
+
+	var header, point, footer, separator string
+	switch e.format {
+	case "gpx":
+		header = gpxHeader + gpxTrackHeader(entry.User, entry.Device)
+		point, footer = gpxPoint(entry), gpxTrackFooter+gpxFooter
+	default:
+		header, point, footer, separator = geoJSONHeader, geoJSONPoint(entry), "\n"+geoJSONFooter, geoJSONSeparator
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	size := info.Size()
+	switch {
+	case size == 0:
+		_, err = f.WriteString(header + point + footer)
+		return err
+	case size < int64(len(header)+len(footer)):
+		return fmt.Errorf("%s is not a track file written by owntracks2ha", path)
+	}
+	tail := make([]byte, len(footer))
+	if _, err := f.ReadAt(tail, size-int64(len(footer))); err != nil {
+		return err
+	}
+	if string(tail) != footer {
+		return fmt.Errorf("%s does not end like a track file written by owntracks2ha", path)
+	}
+	_, err = f.WriteAt([]byte(separator+point+footer), size-int64(len(footer)))
+	return err
+}
+
+// safeName keeps a topic level from leaving the export directory.
+func safeName(level string) string {
+	if level == "" || level == "." || level == ".." {
+		return "_"
+	}
+	return filepath.Base(filepath.Clean("/" + level))
+}
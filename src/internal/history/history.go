@@ -0,0 +1,166 @@
+// Package history records the locations the bridge forwarded in a SQLite
+// database and implements the history command that queries them.
+package history
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS locations (
+	id       INTEGER PRIMARY KEY AUTOINCREMENT,
+	topic    TEXT    NOT NULL,
+	user     TEXT    NOT NULL,
+	device   TEXT    NOT NULL,
+	tst      INTEGER NOT NULL,
+	received INTEGER NOT NULL,
+	lat      REAL    NOT NULL,
+	lon      REAL    NOT NULL,
+	payload  TEXT    NOT NULL
+);
+CREATE INDEX IF NOT EXISTS locations_device_tst ON locations (device, tst);
+`
+
+// Entry is one recorded location.
+type Entry struct {
+	Topic    string
+	User     string
+	Device   string
+	Time     time.Time
+	Received time.Time
+	Lat      float64
+	Lon      float64
+	Payload  []byte
+}
+
+// Recorder stores entries in a SQLite database.
+type Recorder struct {
+	db *sql.DB
+}
+
+// Open opens the database at path, creating it and the schema if needed.
+func Open(path string) (*Recorder, error) {
+	// WAL lets the history command read while the bridge is writing.
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create history schema: %w", err)
+	}
+	return &Recorder{db: db}, nil
+}
+
+// Close closes the database.
+func (r *Recorder) Close() error {
+	return r.db.Close()
+}
+
+// Record stores an entry. User and device default to the last two levels of
+// the topic.
+func (r *Recorder) Record(entry Entry) error {
+	if entry.User == "" || entry.Device == "" {
+		entry.User, entry.Device = topicUserDevice(entry.Topic)
+	}
+	_, err := r.db.Exec(
+		`INSERT INTO locations (topic, user, device, tst, received, lat, lon, payload) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		entry.Topic, entry.User, entry.Device, entry.Time.Unix(), entry.Received.Unix(), entry.Lat, entry.Lon, string(entry.Payload),
+	)
+	return err
+}
+
+// Query returns the entries of device (all devices when empty) recorded at
+// or after since, oldest first.
+func (r *Recorder) Query(device string, since time.Time) ([]Entry, error) {
+	return r.query(
+		`SELECT topic, user, device, tst, received, lat, lon, payload FROM locations
+		WHERE (? = '' OR device = ?) AND tst >= ? ORDER BY tst, id`,
+		device, device, since.Unix(),
+	)
+}
+
+// Range returns the entries of user and device (all when empty) recorded
+// from from until before to, oldest first.
+func (r *Recorder) Range(user, device string, from, to time.Time) ([]Entry, error) {
+	return r.query(
+		`SELECT topic, user, device, tst, received, lat, lon, payload FROM locations
+		WHERE (? = '' OR user = ?) AND (? = '' OR device = ?) AND tst >= ? AND tst < ? ORDER BY tst, id`,
+		user, user, device, device, from.Unix(), to.Unix(),
+	)
+}
+
+// Last returns the latest entry of every device of user (all users when
+// empty), or of one device.
+func (r *Recorder) Last(user, device string) ([]Entry, error) {
+	return r.query(
+		`SELECT topic, user, device, tst, received, lat, lon, payload FROM locations
+		WHERE id IN (SELECT MAX(id) FROM locations WHERE (? = '' OR user = ?) AND (? = '' OR device = ?) GROUP BY user, device)
+		ORDER BY user, device`,
+		user, user, device, device,
+	)
+}
+
+// Users returns the users with recorded locations, or with user set the
+// devices of that user.
+func (r *Recorder) Users(user string) ([]string, error) {
+	query := `SELECT DISTINCT user FROM locations ORDER BY user`
+	args := []interface{}{}
+	if user != "" {
+		query, args = `SELECT DISTINCT device FROM locations WHERE user = ? ORDER BY device`, []interface{}{user}
+	}
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	names := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+func (r *Recorder) query(query string, args ...interface{}) ([]Entry, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []Entry
+	for rows.Next() {
+		var entry Entry
+		var tst, received int64
+		var payload string
+		if err := rows.Scan(&entry.Topic, &entry.User, &entry.Device, &tst, &received, &entry.Lat, &entry.Lon, &payload); err != nil {
+			return nil, err
+		}
+		entry.Time = time.Unix(tst, 0)
+		entry.Received = time.Unix(received, 0)
+		entry.Payload = []byte(payload)
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// topicUserDevice returns the user and device levels of an OwnTracks topic,
+// e.g. user1 and phone1 for owntracks/user1/phone1.
+func topicUserDevice(topic string) (user, device string) {
+	parts := strings.Split(topic, "/")
+	device = parts[len(parts)-1]
+	if len(parts) > 1 {
+		user = parts[len(parts)-2]
+	}
+	return user, device
+}
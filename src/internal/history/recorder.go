@@ -0,0 +1,170 @@
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Store writes locations in the store layout of OwnTracks Recorder, so its
+// tools and frontends can read them: a line per location in
+// rec/<user>/<device>/<YYYY-MM>.rec and the latest location of every device
+// in last/<user>/<device>/<user>-<device>.json.
+type Store struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// NewStore creates the store directory if needed.
+func NewStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir}, nil
+}
+
+// Write adds an entry to the store.
+func (s *Store) Write(entry Entry) error {
+	if entry.User == "" || entry.Device == "" {
+		entry.User, entry.Device = topicUserDevice(entry.Topic)
+	}
+	user, device := safeName(entry.User), safeName(entry.Device)
+	payload := strings.TrimSpace(string(entry.Payload))
+	when := entry.Time.UTC()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	recDir := filepath.Join(s.dir, "rec", user, device)
+	if err := os.MkdirAll(recDir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(recDir, when.Format("2006-01")+".rec"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%s\t%-18s\t%s\n", when.Format(time.RFC3339), "*", payload)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	last, err := recorderLocation(entry)
+	if err != nil {
+		return err
+	}
+	lastDir := filepath.Join(s.dir, "last", user, device)
+	if err := os.MkdirAll(lastDir, 0o755); err != nil {
+		return err
+	}
+	// Written aside and renamed, so readers never see half a file.
+	path := filepath.Join(lastDir, user+"-"+device+".json")
+	if err := os.WriteFile(path+".tmp", last, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// recorderLocation returns the payload of an entry with the fields Recorder
+// adds: topic, username, device and isotime.
+func recorderLocation(entry Entry) ([]byte, error) {
+	location := map[string]interface{}{}
+	if err := json.Unmarshal(entry.Payload, &location); err != nil {
+		return nil, fmt.Errorf("decoding payload: %w", err)
+	}
+	location["topic"] = entry.Topic
+	location["username"] = entry.User
+	location["device"] = entry.Device
+	location["isotime"] = entry.Time.UTC().Format(time.RFC3339)
+	return json.Marshal(location)
+}
+
+// APIHandler serves the read-only part of the OwnTracks Recorder HTTP API
+// from the history database, for frontends written against Recorder:
+//
+//	/api/0/list               users, or the devices of ?user=
+//	/api/0/locations          locations of ?user= and ?device= between ?from=
+//	                          and ?to= (default the last 6 hours)
+//	/api/0/last               the latest location of every device
+func APIHandler(r *Recorder) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/0/list", func(w http.ResponseWriter, req *http.Request) {
+		names, err := r.Users(req.FormValue("user"))
+		if err != nil {
+			apiError(w, err)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"results": names})
+	})
+	mux.HandleFunc("/api/0/locations", func(w http.ResponseWriter, req *http.Request) {
+		to := time.Now()
+		from := to.Add(-6 * time.Hour)
+		var err error
+		if value := req.FormValue("from"); value != "" {
+			if from, err = parseAPITime(value); err != nil {
+				http.Error(w, "invalid from: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if value := req.FormValue("to"); value != "" {
+			if to, err = parseAPITime(value); err != nil {
+				http.Error(w, "invalid to: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		entries, err := r.Range(req.FormValue("user"), req.FormValue("device"), from, to)
+		if err != nil {
+			apiError(w, err)
+			return
+		}
+		data := locations(entries)
+		writeJSON(w, map[string]interface{}{"count": len(data), "data": data, "status": http.StatusOK})
+	})
+	mux.HandleFunc("/api/0/last", func(w http.ResponseWriter, req *http.Request) {
+		entries, err := r.Last(req.FormValue("user"), req.FormValue("device"))
+		if err != nil {
+			apiError(w, err)
+			return
+		}
+		writeJSON(w, locations(entries))
+	})
+	return mux
+}
+
+// locations renders entries as Recorder locations, skipping any whose
+// payload is not a JSON object.
+func locations(entries []Entry) []json.RawMessage {
+	data := []json.RawMessage{}
+	for _, entry := range entries {
+		if location, err := recorderLocation(entry); err == nil {
+			data = append(data, location)
+		}
+	}
+	return data
+}
+
+// parseAPITime accepts the time formats of the Recorder API: a date, a date
+// and time, or RFC 3339.
+func parseAPITime(value string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02T15:04", time.DateOnly} {
+		if t, err := time.ParseInLocation(layout, value, time.UTC); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is not a date (YYYY-MM-DD) or time (YYYY-MM-DDTHH:MM:SS)", value)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func apiError(w http.ResponseWriter, err error) {
+	http.Error(w, "history query failed: "+err.Error(), http.StatusInternalServerError)
+}
@@ -0,0 +1,313 @@
+// Package mqttclient creates the broker connections of the bridge. MQTT 3.1
+// and 3.1.1 use the paho client directly; MQTT 5 goes through an autopaho
+// adapter with the same MQTT.Client interface.
+package mqttclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+
+	"owntracks2ha/internal/config"
+)
+
+// BrokerURL builds the broker URL from host, port and transport
+// (tcp, ssl, ws or wss). Port 0 selects the standard port of the transport,
+// e.g. 1883, or 8883 with TLS. A broker given as a full URL, such as
+// wss://mqtt.example.com/mqtt, is used as is.
+func BrokerURL(broker string, port int, useTLS bool, transport string) (string, error) {
+	if strings.Contains(broker, "://") {
+		return broker, nil
+	}
+	if broker == "" {
+		return "", errors.New("no broker host set")
+	}
+
+	var protocol string
+	switch transport {
+	case "", "tcp", "mqtt":
+		protocol = "mqtt"
+		if useTLS {
+			protocol = "mqtts"
+		}
+	case "ssl", "tls", "mqtts":
+		protocol = "mqtts"
+	case "ws":
+		protocol = "ws"
+		if useTLS {
+			protocol = "wss"
+		}
+	case "wss":
+		protocol = "wss"
+	default:
+		return "", fmt.Errorf("unknown transport %q (expected tcp, ssl, ws or wss)", transport)
+	}
+	if port == 0 {
+		port = config.DefaultPort(transport, useTLS)
+	}
+	return fmt.Sprintf("%s://%s:%d", protocol, broker, port), nil
+}
+
+// BrokerURLs builds the URLs of a broker failover list with BrokerURL.
+func BrokerURLs(brokers []string, port int, useTLS bool, transport string) ([]string, error) {
+	if len(brokers) == 0 {
+		return nil, errors.New("no broker host set")
+	}
+	urls := make([]string, len(brokers))
+	for i, broker := range brokers {
+		address, err := BrokerURL(broker, port, useTLS, transport)
+		if err != nil {
+			return nil, err
+		}
+		urls[i] = address
+	}
+	return urls, nil
+}
+
+// URLUsesTLS reports whether the scheme of a broker URL implies TLS.
+func URLUsesTLS(brokerURL string) bool {
+	scheme, _, _ := strings.Cut(brokerURL, "://")
+	switch scheme {
+	case "ssl", "tls", "mqtts", "tcps", "wss":
+		return true
+	}
+	return false
+}
+
+// BuildTLSConfig creates the TLS configuration for a broker connection.
+func BuildTLSConfig(settings config.TLSSettings) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS13,
+		InsecureSkipVerify: settings.InsecureSkipVerify,
+		ServerName:         settings.ServerName,
+		NextProtos:         settings.ALPN,
+	}
+	switch settings.MinVersion {
+	case "", "1.3":
+	case "1.2":
+		tlsConfig.MinVersion = tls.VersionTLS12
+	default:
+		return nil, fmt.Errorf("unsupported TLS min_version %q (expected 1.2 or 1.3)", settings.MinVersion)
+	}
+	if len(settings.CipherSuites) > 0 {
+		suites, err := cipherSuites(settings.CipherSuites)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.CipherSuites = suites
+	}
+
+	if settings.CAFile != "" {
+		ca, err := os.ReadFile(settings.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", settings.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	switch {
+	case settings.CertFile != "" && settings.KeyFile != "":
+		cert, err := tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.GetClientCertificate = clientCertificate(settings, cert)
+	case settings.CertFile != "" || settings.KeyFile != "":
+		return nil, errors.New("cert_file and key_file must be set together for client certificate authentication")
+	}
+
+	return tlsConfig, nil
+}
+
+// cipherSuites returns the IDs of cipher suites given by name, such as
+// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256.
+func cipherSuites(names []string) ([]uint16, error) {
+	known := map[string]uint16{}
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[suite.Name] = suite.ID
+	}
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// clientCertificate re-reads the client certificate on every handshake, so
+// a renewed certificate is used from the next reconnect on. When the files
+// cannot be read the last good certificate is kept.
+func clientCertificate(settings config.TLSSettings, cert tls.Certificate) func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	var mu sync.Mutex
+	return func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		renewed, err := tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile)
+		if err != nil {
+			slog.Warn("Failed to reload client certificate, using the previous one", "cert_file", settings.CertFile, "error", err)
+		} else {
+			cert = renewed
+		}
+		return &cert, nil
+	}
+}
+
+// Credentials returns the username and password to connect with for an
+// auth mode: none sends no credentials, basic needs a username, token sends
+// the password setting (or the username when there is no password) as the
+// username without a password, and an empty mode sends whichever of the two
+// is set.
+func Credentials(auth, username, password string) (string, string, error) {
+	switch auth {
+	case "":
+		return username, password, nil
+	case "none":
+		return "", "", nil
+	case "basic":
+		if username == "" {
+			return "", "", errors.New("auth basic needs a username")
+		}
+		return username, password, nil
+	case "token":
+		token := password
+		if token == "" {
+			token = username
+		}
+		if token == "" {
+			return "", "", errors.New("auth token needs the token as the password")
+		}
+		return token, "", nil
+	}
+	return "", "", fmt.Errorf("unknown auth %q (expected none, basic or token)", auth)
+}
+
+// Options builds the client options for brokers, which are tried in order.
+// A nil tlsConfig leaves TLS disabled.
+func Options(brokers []string, clientID, username, password string, tlsConfig *tls.Config, protocolVersion int) *MQTT.ClientOptions {
+	opts := MQTT.NewClientOptions()
+	for _, broker := range brokers {
+		opts.AddBroker(broker)
+	}
+	opts.SetClientID(clientID)
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
+	opts.SetOrderMatters(false)
+
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	// Version 5 is handled by New; 3 (3.1) and 4 (3.1.1) are passed to paho,
+	// which otherwise negotiates the version itself.
+	if protocolVersion == 3 || protocolVersion == 4 {
+		opts.SetProtocolVersion(uint(protocolVersion))
+	}
+
+	if username != "" {
+		opts.SetUsername(username)
+	}
+	if password != "" {
+		opts.SetPassword(password)
+	}
+
+	return opts
+}
+
+// WatchBroker calls changed with the broker of its failover list the client
+// connected to on the first connect and whenever that differs from the
+// previous one. It wraps the connect handler, so it is called once that is
+// set.
+func WatchBroker(opts *MQTT.ClientOptions, changed func(previous, current string)) {
+	var mu sync.Mutex
+	var attempted, active string
+	attempt := opts.OnConnectAttempt
+	opts.SetConnectionAttemptHandler(func(broker *url.URL, tlsConfig *tls.Config) *tls.Config {
+		mu.Lock()
+		attempted = broker.String()
+		mu.Unlock()
+		if attempt != nil {
+			return attempt(broker, tlsConfig)
+		}
+		return tlsConfig
+	})
+	onConnect := opts.OnConnect
+	opts.SetOnConnectHandler(func(client MQTT.Client) {
+		mu.Lock()
+		previous := active
+		active = attempted
+		mu.Unlock()
+		if previous != active {
+			changed(previous, active)
+		}
+		if onConnect != nil {
+			onConnect(client)
+		}
+	})
+}
+
+// ApplyConnectionSettings sets the keepalive, connect timeout, maximum
+// reconnect interval and write timeout from the config. Settings left at 0
+// keep the paho defaults.
+func ApplyConnectionSettings(opts *MQTT.ClientOptions, cfg *config.Config) {
+	if cfg.KeepAliveSeconds > 0 {
+		opts.SetKeepAlive(time.Duration(cfg.KeepAliveSeconds) * time.Second)
+	}
+	if cfg.ConnectTimeoutSeconds > 0 {
+		opts.SetConnectTimeout(time.Duration(cfg.ConnectTimeoutSeconds) * time.Second)
+	}
+	if cfg.MaxReconnectSeconds > 0 {
+		opts.SetMaxReconnectInterval(time.Duration(cfg.MaxReconnectSeconds) * time.Second)
+	}
+	if cfg.WriteTimeoutSeconds > 0 {
+		opts.SetWriteTimeout(time.Duration(cfg.WriteTimeoutSeconds) * time.Second)
+	}
+}
+
+// New creates the client for the protocol version. MQTT v5 connections go
+// through an autopaho adapter that implements the same interface, so the
+// rest of the bridge does not care which one is used. sessionExpirySeconds
+// only applies to v5.
+func New(opts *MQTT.ClientOptions, protocolVersion, sessionExpirySeconds int) MQTT.Client {
+	if protocolVersion == 5 {
+		return newV5Client(opts, sessionExpirySeconds)
+	}
+	return MQTT.NewClient(opts)
+}
+
+// Message is a publish together with the properties MQTT v5 can carry.
+type Message struct {
+	Topic    string
+	QoS      byte
+	Retained bool
+	Payload  []byte
+
+	// MessageExpirySeconds and SourceTopic are only sent over MQTT v5.
+	MessageExpirySeconds int
+	SourceTopic          string
+}
+
+// Publish publishes msg on client, adding the MQTT v5 properties when the
+// client speaks v5: the message expiry and the original OwnTracks topic as
+// the source_topic user property for debugging.
+func Publish(client MQTT.Client, msg Message) MQTT.Token {
+	if v5, ok := client.(*v5Client); ok {
+		return v5.publishWithProperties(msg)
+	}
+	return client.Publish(msg.Topic, msg.QoS, msg.Retained, msg.Payload)
+}
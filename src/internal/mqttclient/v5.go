@@ -0,0 +1,329 @@
+package mqttclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+
+	"owntracks2ha/internal/config"
+)
+
+// defaultSessionExpirySeconds applies to persistent sessions when
+// session_expiry_seconds is not set.
+const defaultSessionExpirySeconds = 24 * 60 * 60
+
+// v5Client adapts an autopaho connection manager to the paho v3 MQTT.Client
+// interface. It is configured from the same ClientOptions as a v3 client.
+type v5Client struct {
+	opts      *MQTT.ClientOptions
+	cfg       autopaho.ClientConfig
+	connected atomic.Bool
+
+	mu     sync.Mutex
+	cm     *autopaho.ConnectionManager
+	cancel context.CancelFunc
+	routes map[string]MQTT.MessageHandler
+}
+
+func newV5Client(opts *MQTT.ClientOptions, sessionExpirySeconds int) *v5Client {
+	c := &v5Client{opts: opts, routes: make(map[string]MQTT.MessageHandler)}
+	// A v5 session ends with the connection unless it has an expiry, so a
+	// persistent session without one is kept for a day.
+	if !opts.CleanSession && sessionExpirySeconds == 0 {
+		sessionExpirySeconds = defaultSessionExpirySeconds
+	}
+
+	c.cfg = autopaho.ClientConfig{
+		ServerUrls:                    opts.Servers,
+		TlsCfg:                        opts.TLSConfig,
+		KeepAlive:                     uint16(opts.KeepAlive),
+		CleanStartOnInitialConnection: opts.CleanSession,
+		SessionExpiryInterval:         uint32(sessionExpirySeconds),
+		ConnectTimeout:                opts.ConnectTimeout,
+		ReconnectBackoff:              reconnectBackoff(opts.MaxReconnectInterval),
+		ConnectUsername:               opts.Username,
+		ConnectPassword:               []byte(opts.Password),
+		OnConnectionUp: func(*autopaho.ConnectionManager, *paho.Connack) {
+			c.connected.Store(true)
+			if opts.OnConnect != nil {
+				go opts.OnConnect(c)
+			}
+		},
+		OnConnectionDown: func() bool {
+			c.connected.Store(false)
+			if opts.OnConnectionLost != nil {
+				go opts.OnConnectionLost(c, errors.New("connection to broker lost"))
+			}
+			return true
+		},
+		// Reports the broker of the failover list tried, as paho v3 does.
+		ConnectPacketBuilder: func(connect *paho.Connect, broker *url.URL) (*paho.Connect, error) {
+			if opts.OnConnectAttempt != nil {
+				opts.OnConnectAttempt(broker, opts.TLSConfig)
+			}
+			return connect, nil
+		},
+		OnConnectError: func(err error) {
+			slog.Warn("MQTT v5 connection attempt failed", "client_id", opts.ClientID, "error", err)
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID:          opts.ClientID,
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){c.route},
+		},
+	}
+	if opts.WillEnabled {
+		c.cfg.WillMessage = &paho.WillMessage{
+			Retain:  opts.WillRetained,
+			QoS:     opts.WillQos,
+			Topic:   opts.WillTopic,
+			Payload: opts.WillPayload,
+		}
+	}
+	return c
+}
+
+// reconnectBackoff waits like paho v3 between reconnect attempts: starting
+// around a second and growing up to maxInterval.
+func reconnectBackoff(maxInterval time.Duration) autopaho.Backoff {
+	if maxInterval <= time.Second {
+		return autopaho.NewConstantBackoff(max(maxInterval, 100*time.Millisecond))
+	}
+	return autopaho.NewExponentialBackoff(500*time.Millisecond, maxInterval, min(2*time.Second, maxInterval), 2)
+}
+
+// route hands a received message to the matching subscription callback or
+// the default publish handler. Like paho v3 it runs the callback in its own
+// goroutine unless order matters.
+func (c *v5Client) route(received paho.PublishReceived) (bool, error) {
+	msg := v5Message{received.Packet}
+	handler := c.opts.DefaultPublishHandler
+
+	c.mu.Lock()
+	for filter, callback := range c.routes {
+		// Shared subscriptions match on the filter after $share/<group>/.
+		if shared, ok := strings.CutPrefix(filter, "$share/"); ok {
+			_, filter, _ = strings.Cut(shared, "/")
+		}
+		if _, ok := config.TopicMatch(filter, msg.Topic()); ok {
+			handler = callback
+			break
+		}
+	}
+	c.mu.Unlock()
+
+	switch {
+	case handler == nil:
+	case c.opts.Order:
+		handler(c, msg)
+	default:
+		go handler(c, msg)
+	}
+	return true, nil
+}
+
+func (c *v5Client) manager() *autopaho.ConnectionManager {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cm
+}
+
+// operation runs fn against the connection manager with the write timeout
+// and wraps the result in a token.
+func (c *v5Client) operation(fn func(ctx context.Context, cm *autopaho.ConnectionManager) error) MQTT.Token {
+	return runV5Token(func() error {
+		cm := c.manager()
+		if cm == nil {
+			return MQTT.ErrNotConnected
+		}
+		timeout := c.opts.WriteTimeout
+		if timeout <= 0 {
+			timeout = 30 * time.Second
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return fn(ctx, cm)
+	})
+}
+
+func (c *v5Client) IsConnected() bool      { return c.connected.Load() }
+func (c *v5Client) IsConnectionOpen() bool { return c.connected.Load() }
+
+// Connect starts the connection manager. Like a v3 client with connect
+// retry enabled, the token completes once the first connection is up.
+func (c *v5Client) Connect() MQTT.Token {
+	return runV5Token(func() error {
+		ctx, cancel := context.WithCancel(context.Background())
+		cm, err := autopaho.NewConnection(ctx, c.cfg)
+		if err != nil {
+			cancel()
+			return err
+		}
+		c.mu.Lock()
+		c.cm, c.cancel = cm, cancel
+		c.mu.Unlock()
+		return cm.AwaitConnection(ctx)
+	})
+}
+
+func (c *v5Client) Disconnect(quiesce uint) {
+	c.mu.Lock()
+	cm, cancel := c.cm, c.cancel
+	c.mu.Unlock()
+	if cm == nil {
+		return
+	}
+
+	ctx, cancelTimeout := context.WithTimeout(context.Background(), time.Duration(quiesce)*time.Millisecond)
+	defer cancelTimeout()
+	if err := cm.Disconnect(ctx); err != nil {
+		slog.Warn("MQTT v5 disconnect failed", "client_id", c.opts.ClientID, "error", err)
+	}
+	cancel()
+	c.connected.Store(false)
+}
+
+func (c *v5Client) Publish(topic string, qos byte, retained bool, payload interface{}) MQTT.Token {
+	return c.publish(&paho.Publish{Topic: topic, QoS: qos, Retain: retained}, payload)
+}
+
+// publishWithProperties publishes with the message expiry and user
+// properties of msg.
+func (c *v5Client) publishWithProperties(msg Message) MQTT.Token {
+	props := &paho.PublishProperties{}
+	if msg.MessageExpirySeconds > 0 {
+		expiry := uint32(msg.MessageExpirySeconds)
+		props.MessageExpiry = &expiry
+	}
+	if msg.SourceTopic != "" {
+		props.User.Add("source_topic", msg.SourceTopic)
+	}
+	return c.publish(&paho.Publish{Topic: msg.Topic, QoS: msg.QoS, Retain: msg.Retained, Properties: props}, msg.Payload)
+}
+
+func (c *v5Client) publish(pub *paho.Publish, payload interface{}) MQTT.Token {
+	switch p := payload.(type) {
+	case []byte:
+		pub.Payload = p
+	case string:
+		pub.Payload = []byte(p)
+	default:
+		return runV5Token(func() error { return fmt.Errorf("unknown payload type %T", payload) })
+	}
+	return c.operation(func(ctx context.Context, cm *autopaho.ConnectionManager) error {
+		_, err := cm.Publish(ctx, pub)
+		return err
+	})
+}
+
+func (c *v5Client) Subscribe(topic string, qos byte, callback MQTT.MessageHandler) MQTT.Token {
+	return c.SubscribeMultiple(map[string]byte{topic: qos}, callback)
+}
+
+func (c *v5Client) SubscribeMultiple(filters map[string]byte, callback MQTT.MessageHandler) MQTT.Token {
+	sub := &paho.Subscribe{}
+	for topic, qos := range filters {
+		sub.Subscriptions = append(sub.Subscriptions, paho.SubscribeOptions{Topic: topic, QoS: qos})
+		if callback != nil {
+			c.AddRoute(topic, callback)
+		}
+	}
+	return c.operation(func(ctx context.Context, cm *autopaho.ConnectionManager) error {
+		suback, err := cm.Subscribe(ctx, sub)
+		if err != nil {
+			return err
+		}
+		for i, reason := range suback.Reasons {
+			if reason >= 0x80 && i < len(sub.Subscriptions) {
+				return fmt.Errorf("subscription to %s refused with reason code 0x%02x", sub.Subscriptions[i].Topic, reason)
+			}
+		}
+		return nil
+	})
+}
+
+func (c *v5Client) Unsubscribe(topics ...string) MQTT.Token {
+	c.mu.Lock()
+	for _, topic := range topics {
+		delete(c.routes, topic)
+	}
+	c.mu.Unlock()
+	return c.operation(func(ctx context.Context, cm *autopaho.ConnectionManager) error {
+		_, err := cm.Unsubscribe(ctx, &paho.Unsubscribe{Topics: topics})
+		return err
+	})
+}
+
+func (c *v5Client) AddRoute(topic string, callback MQTT.MessageHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.routes[topic] = callback
+}
+
+func (c *v5Client) OptionsReader() MQTT.ClientOptionsReader {
+	return MQTT.NewOptionsReader(c.opts)
+}
+
+// v5Token implements MQTT.Token for operations run by v5Client.
+type v5Token struct {
+	done chan struct{}
+	err  error
+}
+
+func runV5Token(fn func() error) *v5Token {
+	t := &v5Token{done: make(chan struct{})}
+	go func() {
+		t.err = fn()
+		close(t.done)
+	}()
+	return t
+}
+
+func (t *v5Token) Wait() bool {
+	<-t.done
+	return true
+}
+
+func (t *v5Token) WaitTimeout(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-t.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (t *v5Token) Done() <-chan struct{} { return t.done }
+
+func (t *v5Token) Error() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
+
+// v5Message implements MQTT.Message for received v5 publishes.
+type v5Message struct {
+	packet *paho.Publish
+}
+
+func (m v5Message) Duplicate() bool   { return m.packet.Duplicate() }
+func (m v5Message) Qos() byte         { return m.packet.QoS }
+func (m v5Message) Retained() bool    { return m.packet.Retain }
+func (m v5Message) Topic() string     { return m.packet.Topic }
+func (m v5Message) MessageID() uint16 { return m.packet.PacketID }
+func (m v5Message) Payload() []byte   { return m.packet.Payload }
+func (m v5Message) Ack()              {}
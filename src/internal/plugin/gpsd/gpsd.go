@@ -0,0 +1,213 @@
+// Package gpsd is an input that reads the position of a GPS receiver from
+// gpsd (https://gpsd.io/), so a vehicle, RV or boat with a USB GPS shows up
+// as a device tracker. The latest fix is delivered as an OwnTracks location
+// on topic every interval_seconds:
+//
+//	inputs:
+//	  - name: car
+//	    type: gpsd
+//	    options: {address: "localhost:2947", topic: owntracks/anna/car, interval_seconds: 60}
+package gpsd
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"owntracks2ha/converter"
+	"owntracks2ha/internal/config"
+	"owntracks2ha/internal/plugin"
+)
+
+func init() {
+	plugin.RegisterInput("gpsd", func(name string, settings config.PluginSettings) (plugin.Input, error) {
+		topic := settings.StringOption("topic", "")
+		if topic == "" {
+			return nil, errors.New("topic is required for gpsd inputs")
+		}
+		seconds, err := settings.IntOption("interval_seconds", 60)
+		if err != nil {
+			return nil, err
+		}
+		if seconds <= 0 {
+			return nil, fmt.Errorf("interval_seconds must be positive, not %d", seconds)
+		}
+		return &input{
+			name:     name,
+			address:  settings.StringOption("address", "localhost:2947"),
+			topic:    topic,
+			interval: time.Duration(seconds) * time.Second,
+			done:     make(chan struct{}),
+		}, nil
+	})
+}
+
+// maxRetryDelay caps the wait between attempts to reach gpsd.
+const maxRetryDelay = time.Minute
+
+type input struct {
+	name     string
+	address  string
+	topic    string
+	interval time.Duration
+	done     chan struct{}
+	once     sync.Once
+
+	mu   sync.Mutex
+	conn net.Conn
+	fix  *tpv
+}
+
+// tpv is the part of a gpsd TPV (time-position-velocity) report the input
+// uses.
+type tpv struct {
+	Class string    `json:"class"`
+	Mode  int       `json:"mode"`
+	Time  time.Time `json:"time"`
+	Lat   *float64  `json:"lat"`
+	Lon   *float64  `json:"lon"`
+	Alt   float64   `json:"alt"`
+	Speed float64   `json:"speed"`
+	Track float64   `json:"track"`
+	Epx   float64   `json:"epx"`
+	Epy   float64   `json:"epy"`
+	Epv   float64   `json:"epv"`
+}
+
+func (in *input) Start(deliver plugin.Deliver) error {
+	go in.read()
+	go in.report(deliver)
+	slog.Info("Reading positions from gpsd", "input", in.name, "address", in.address, "interval", in.interval)
+	return nil
+}
+
+func (in *input) Close() {
+	in.once.Do(func() {
+		close(in.done)
+		in.mu.Lock()
+		if in.conn != nil {
+			in.conn.Close()
+		}
+		in.mu.Unlock()
+	})
+}
+
+// read keeps a connection to gpsd and the latest fix, reconnecting with a
+// growing delay when gpsd is unreachable or goes away. The delay starts over
+// after a connection that worked.
+func (in *input) read() {
+	delay := time.Second
+	for {
+		connected, err := in.watch()
+		select {
+		case <-in.done:
+			return
+		default:
+		}
+		if connected {
+			delay = time.Second
+		}
+		slog.Warn("gpsd connection failed", "input", in.name, "address", in.address, "error", err, "retry_in", delay)
+		select {
+		case <-in.done:
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, maxRetryDelay)
+	}
+}
+
+// watch streams the reports of one gpsd connection until it fails. It
+// reports whether gpsd accepted the watch.
+func (in *input) watch() (bool, error) {
+	conn, err := net.DialTimeout("tcp", in.address, 10*time.Second)
+	if err != nil {
+		return false, err
+	}
+	in.mu.Lock()
+	// Close may have run while dialing, and would not see this connection.
+	select {
+	case <-in.done:
+		in.mu.Unlock()
+		conn.Close()
+		return false, errors.New("input closed")
+	default:
+	}
+	in.conn = conn
+	in.mu.Unlock()
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(`?WATCH={"enable":true,"json":true};` + "\n")); err != nil {
+		return false, err
+	}
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var report tpv
+		if json.Unmarshal(scanner.Bytes(), &report) != nil || report.Class != "TPV" {
+			continue
+		}
+		// Mode 2 and 3 are 2D and 3D fixes; 0 and 1 carry no position.
+		if report.Mode < 2 || report.Lat == nil || report.Lon == nil {
+			continue
+		}
+		in.mu.Lock()
+		in.fix = &report
+		in.mu.Unlock()
+	}
+	if err := scanner.Err(); err != nil {
+		return true, err
+	}
+	return true, errors.New("connection closed")
+}
+
+// report delivers the latest fix every interval, once per fix.
+func (in *input) report(deliver plugin.Deliver) {
+	ticker := time.NewTicker(in.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-in.done:
+			return
+		case <-ticker.C:
+		}
+		in.mu.Lock()
+		fix := in.fix
+		in.fix = nil
+		in.mu.Unlock()
+		if fix == nil {
+			continue
+		}
+		payload, err := json.Marshal(location(fix))
+		if err != nil {
+			continue
+		}
+		deliver(in.topic, payload)
+	}
+}
+
+// location converts a TPV report into an OwnTracks location.
+func location(fix *tpv) converter.Location {
+	location := converter.Location{
+		Type:    "location",
+		Lat:     *fix.Lat,
+		Lon:     *fix.Lon,
+		Acc:     int(math.Round(math.Max(fix.Epx, fix.Epy))),
+		Cog:     int(math.Round(fix.Track)),
+		Vel:     int(math.Round(fix.Speed * 3.6)),
+		Trigger: "t",
+	}
+	if fix.Mode == 3 {
+		location.Alt = int(math.Round(fix.Alt))
+		location.Vac = int(math.Round(fix.Epv))
+	}
+	if !fix.Time.IsZero() {
+		location.Tst = fix.Time.Unix()
+	}
+	return location
+}
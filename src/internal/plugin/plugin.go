@@ -0,0 +1,162 @@
+// Package plugin defines the extension points of the bridge: inputs that
+// deliver OwnTracks messages next to the source broker, filters that drop
+// locations and outputs converted locations fan out to. An implementation
+// registers its factory from an init function, so a package that is compiled
+// in is all it takes to add one, e.g. with a blank import in main.go:
+//
+//	import _ "owntracks2ha/internal/plugin/gpsd"
+//
+// The bridge then creates the configured inputs, filters and outputs by
+// their type.
+package plugin
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"owntracks2ha/converter"
+	"owntracks2ha/internal/config"
+)
+
+// Deliver hands a received OwnTracks message to the bridge. The topic
+// selects the mapping as for messages from the source broker, e.g.
+// owntracks/<user>/<device>.
+type Deliver func(topic string, payload []byte)
+
+// Input receives OwnTracks messages from somewhere other than the source
+// broker. Start must not block; Close stops the input on shutdown.
+type Input interface {
+	Start(deliver Deliver) error
+	Close()
+}
+
+// Filter decides whether a location is forwarded. It runs after the
+// built-in accuracy, age and speed checks.
+type Filter interface {
+	Keep(sourceTopic string, location converter.Location) bool
+}
+
+// Location is a converted location handed to the outputs.
+type Location struct {
+	SourceTopic string
+	TargetTopic string
+	Payload     []byte
+	Source      converter.Location
+	Received    time.Time
+}
+
+// Output is a sink converted locations fan out to, next to the target
+// broker or Home Assistant. Send is called from one goroutine per output.
+type Output interface {
+	Send(location Location) error
+	Close()
+}
+
+// InputFactory creates an input from its settings.
+type InputFactory func(name string, settings config.PluginSettings) (Input, error)
+
+// FilterFactory creates a filter from its settings.
+type FilterFactory func(name string, settings config.PluginSettings) (Filter, error)
+
+// OutputFactory creates an output from its settings.
+type OutputFactory func(name string, settings config.OutputSettings) (Output, error)
+
+var (
+	mu      sync.RWMutex
+	inputs  = map[string]InputFactory{}
+	filters = map[string]FilterFactory{}
+	outputs = map[string]OutputFactory{}
+)
+
+// RegisterInput makes an input type available. It panics when the type is
+// registered twice.
+func RegisterInput(typ string, factory InputFactory) {
+	register(inputs, "input", typ, factory)
+}
+
+// RegisterFilter makes a filter type available. It panics when the type is
+// registered twice.
+func RegisterFilter(typ string, factory FilterFactory) {
+	register(filters, "filter", typ, factory)
+}
+
+// RegisterOutput makes an output type available. It panics when the type is
+// registered twice.
+func RegisterOutput(typ string, factory OutputFactory) {
+	register(outputs, "output", typ, factory)
+}
+
+// NewInput creates an input of a registered type.
+func NewInput(typ, name string, settings config.PluginSettings) (Input, error) {
+	factory, err := lookup(inputs, "input", typ)
+	if err != nil {
+		return nil, err
+	}
+	return factory(name, settings)
+}
+
+// NewFilter creates a filter of a registered type.
+func NewFilter(typ, name string, settings config.PluginSettings) (Filter, error) {
+	factory, err := lookup(filters, "filter", typ)
+	if err != nil {
+		return nil, err
+	}
+	return factory(name, settings)
+}
+
+// NewOutput creates an output of a registered type.
+func NewOutput(typ, name string, settings config.OutputSettings) (Output, error) {
+	factory, err := lookup(outputs, "output", typ)
+	if err != nil {
+		return nil, err
+	}
+	return factory(name, settings)
+}
+
+// CheckInputType reports an error when no input type typ is registered.
+func CheckInputType(typ string) error {
+	_, err := lookup(inputs, "input", typ)
+	return err
+}
+
+// CheckFilterType reports an error when no filter type typ is registered.
+func CheckFilterType(typ string) error {
+	_, err := lookup(filters, "filter", typ)
+	return err
+}
+
+// CheckOutputType reports an error when no output type typ is registered.
+func CheckOutputType(typ string) error {
+	_, err := lookup(outputs, "output", typ)
+	return err
+}
+
+func register[F any](registry map[string]F, kind, typ string, factory F) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, exists := registry[typ]; exists {
+		panic(fmt.Sprintf("plugin: %s type %q registered twice", kind, typ))
+	}
+	registry[typ] = factory
+}
+
+func lookup[F any](registry map[string]F, kind, typ string) (F, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	factory, ok := registry[typ]
+	if !ok {
+		types := make([]string, 0, len(registry))
+		for t := range registry {
+			types = append(types, t)
+		}
+		if len(types) == 0 {
+			return factory, fmt.Errorf("unknown %s type %q (none compiled in)", kind, typ)
+		}
+		sort.Strings(types)
+		return factory, fmt.Errorf("unknown %s type %q (available: %s)", kind, typ, strings.Join(types, ", "))
+	}
+	return factory, nil
+}
@@ -0,0 +1,192 @@
+// Package traccar is an input that listens for the OsmAnd protocol of
+// Traccar (https://www.traccar.org/osmand/), so the Traccar Client app and
+// trackers set up to report to a Traccar server can report to the bridge
+// instead. Each report is delivered as an OwnTracks location on
+// owntracks/<user>/<id>:
+//
+//	inputs:
+//	  - type: traccar
+//	    options: {address: ":5055", user: traccar}
+package traccar
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"owntracks2ha/converter"
+	"owntracks2ha/internal/config"
+	"owntracks2ha/internal/plugin"
+)
+
+func init() {
+	plugin.RegisterInput("traccar", func(name string, settings config.PluginSettings) (plugin.Input, error) {
+		user := settings.StringOption("user", "traccar")
+		if user == "" || strings.ContainsAny(user, "/+#") {
+			return nil, errors.New("invalid user: it must be one topic level")
+		}
+		return &input{
+			name:    name,
+			address: settings.StringOption("address", ":5055"),
+			user:    user,
+		}, nil
+	})
+}
+
+// knotsToMS converts the OsmAnd protocol speed to m/s.
+const knotsToMS = 0.514444
+
+type input struct {
+	name    string
+	address string
+	user    string
+	server  *http.Server
+	deliver plugin.Deliver
+}
+
+func (in *input) Start(deliver plugin.Deliver) error {
+	listener, err := net.Listen("tcp", in.address)
+	if err != nil {
+		return err
+	}
+	in.deliver = deliver
+	in.server = &http.Server{Handler: in, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := in.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Traccar input failed", "input", in.name, "error", err)
+		}
+	}()
+	slog.Info("Accepting Traccar OsmAnd reports", "input", in.name, "address", in.address)
+	return nil
+}
+
+func (in *input) Close() {
+	if in.server != nil {
+		in.server.Close()
+	}
+}
+
+// ServeHTTP accepts a report as URL parameters or a form post, as sent by
+// OsmAnd and most trackers, or as the JSON body of the current Traccar
+// Client.
+func (in *input) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+
+	var id string
+	var location converter.Location
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		id, location, err = parseJSON(r.Body)
+	} else if err = r.ParseForm(); err == nil {
+		id = r.Form.Get("id")
+		if id == "" {
+			id = r.Form.Get("deviceid")
+		}
+		location, err = parseQuery(r.Form)
+	}
+	if err != nil && !errors.Is(err, converter.ErrNullIsland) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if id == "" || strings.ContainsAny(id, "/+#") {
+		http.Error(w, "missing or invalid device id", http.StatusBadRequest)
+		return
+	}
+
+	payload, err := json.Marshal(location)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	in.deliver("owntracks/"+in.user+"/"+id, payload)
+}
+
+// parseQuery parses OsmAnd parameters, whose speed is in knots.
+func parseQuery(query url.Values) (converter.Location, error) {
+	if value := query.Get("speed"); value != "" {
+		knots, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return converter.Location{}, errors.New("invalid speed " + strconv.Quote(value))
+		}
+		query = cloneValues(query)
+		query.Set("speed", strconv.FormatFloat(knots*knotsToMS, 'f', -1, 64))
+	}
+	return converter.ParseQuery(query)
+}
+
+func cloneValues(values url.Values) url.Values {
+	clone := make(url.Values, len(values))
+	for k, v := range values {
+		clone[k] = append([]string(nil), v...)
+	}
+	return clone
+}
+
+// report is the JSON body of Traccar Client.
+type report struct {
+	DeviceID string `json:"device_id"`
+	Location struct {
+		Timestamp time.Time `json:"timestamp"`
+		Coords    struct {
+			Latitude  *float64 `json:"latitude"`
+			Longitude *float64 `json:"longitude"`
+			Accuracy  float64  `json:"accuracy"`
+			Speed     float64  `json:"speed"`
+			Heading   float64  `json:"heading"`
+			Altitude  float64  `json:"altitude"`
+		} `json:"coords"`
+		Battery struct {
+			Level      *float64 `json:"level"`
+			IsCharging *bool    `json:"is_charging"`
+		} `json:"battery"`
+	} `json:"location"`
+}
+
+func parseJSON(body io.Reader) (string, converter.Location, error) {
+	var r report
+	if err := json.NewDecoder(body).Decode(&r); err != nil {
+		return "", converter.Location{}, err
+	}
+	coords := r.Location.Coords
+	location := converter.Location{
+		Type: "location",
+		Acc:  int(math.Round(coords.Accuracy)),
+		Alt:  int(math.Round(coords.Altitude)),
+		Cog:  int(math.Round(coords.Heading)),
+		// Speed is in m/s and OwnTracks velocity in km/h; negative means
+		// unknown.
+		Vel: int(math.Round(math.Max(coords.Speed, 0) * 3.6)),
+	}
+	if !r.Location.Timestamp.IsZero() {
+		location.Tst = r.Location.Timestamp.Unix()
+	}
+	if level := r.Location.Battery.Level; level != nil && *level >= 0 {
+		location.Batt = int(math.Round(*level * 100))
+	}
+	if charging := r.Location.Battery.IsCharging; charging != nil {
+		location.BS = 1
+		if *charging {
+			location.BS = 2
+		}
+	}
+	if coords.Latitude == nil || coords.Longitude == nil {
+		return r.DeviceID, location, converter.ErrInvalidCoordinates
+	}
+	location.Lat, location.Lon = *coords.Latitude, *coords.Longitude
+	if location.Lat == 0 && location.Lon == 0 {
+		return r.DeviceID, location, converter.ErrNullIsland
+	}
+	return r.DeviceID, location, nil
+}
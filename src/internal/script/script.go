@@ -0,0 +1,123 @@
+// Package script runs the Starlark transform scripts mappings can set. A
+// script defines
+//
+//	def transform(topic, message, payload):
+//
+// which receives the source topic, the decoded OwnTracks message and the
+// payload the bridge would publish, both as dicts. It returns None to drop
+// the location, a dict to publish instead of payload, a (topic, dict) tuple
+// to also change the target topic, or a list of those to publish several
+// messages.
+package script
+
+import (
+	"fmt"
+
+	"go.starlark.net/lib/json"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// maxSteps bounds the work of one transform call, so a runaway loop fails
+// the message instead of stalling its worker.
+const maxSteps = 1_000_000
+
+// Script is a compiled transform script. It is safe for concurrent use.
+type Script struct {
+	path      string
+	transform *starlark.Function
+}
+
+// Result is one message a script asks to publish. An empty Topic keeps the
+// target topic of the mapping.
+type Result struct {
+	Topic   string
+	Payload []byte
+}
+
+// Load compiles the script at path and checks that it defines transform.
+func Load(path string) (*Script, error) {
+	thread := &starlark.Thread{Name: path}
+	thread.SetMaxExecutionSteps(maxSteps)
+	predeclared := starlark.StringDict{"json": json.Module}
+	globals, err := starlark.ExecFileOptions(&syntax.FileOptions{}, thread, path, nil, predeclared)
+	if err != nil {
+		return nil, err
+	}
+	fn, ok := globals["transform"].(*starlark.Function)
+	if !ok {
+		return nil, fmt.Errorf("%s: no transform function", path)
+	}
+	if fn.NumParams() != 3 {
+		return nil, fmt.Errorf("%s: transform must take (topic, message, payload)", path)
+	}
+	return &Script{path: path, transform: fn}, nil
+}
+
+// Transform runs the script on a message and returns what to publish; no
+// results means the location is dropped.
+func (s *Script) Transform(topic string, message, payload []byte) ([]Result, error) {
+	thread := &starlark.Thread{Name: s.path}
+	thread.SetMaxExecutionSteps(maxSteps)
+
+	decodedMessage, err := decode(thread, message)
+	if err != nil {
+		return nil, fmt.Errorf("decoding message: %w", err)
+	}
+	decodedPayload, err := decode(thread, payload)
+	if err != nil {
+		return nil, fmt.Errorf("decoding payload: %w", err)
+	}
+	value, err := starlark.Call(thread, s.transform, starlark.Tuple{starlark.String(topic), decodedMessage, decodedPayload}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if value == starlark.None {
+		return nil, nil
+	}
+	if list, ok := value.(*starlark.List); ok {
+		results := make([]Result, 0, list.Len())
+		for i := range list.Len() {
+			result, err := toResult(thread, list.Index(i))
+			if err != nil {
+				return nil, fmt.Errorf("result %d: %w", i, err)
+			}
+			results = append(results, result)
+		}
+		return results, nil
+	}
+	result, err := toResult(thread, value)
+	if err != nil {
+		return nil, err
+	}
+	return []Result{result}, nil
+}
+
+// toResult converts a dict or a (topic, dict) tuple returned by a script.
+func toResult(thread *starlark.Thread, value starlark.Value) (Result, error) {
+	var result Result
+	if tuple, ok := value.(starlark.Tuple); ok {
+		if len(tuple) != 2 {
+			return result, fmt.Errorf("expected a (topic, dict) tuple, got %d items", len(tuple))
+		}
+		topic, ok := starlark.AsString(tuple[0])
+		if !ok {
+			return result, fmt.Errorf("topic must be a string, got %s", tuple[0].Type())
+		}
+		result.Topic, value = topic, tuple[1]
+	}
+	if _, ok := value.(*starlark.Dict); !ok {
+		return result, fmt.Errorf("expected a dict, got %s", value.Type())
+	}
+	encoded, err := starlark.Call(thread, json.Module.Members["encode"], starlark.Tuple{value}, nil)
+	if err != nil {
+		return result, err
+	}
+	result.Payload = []byte(encoded.(starlark.String))
+	return result, nil
+}
+
+func decode(thread *starlark.Thread, data []byte) (starlark.Value, error) {
+	return starlark.Call(thread, json.Module.Members["decode"], starlark.Tuple{starlark.String(data)}, nil)
+}